@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"mydb/database"
+)
+
+// The flags the inspecting commands share, the file is the first argument after them
+type inspectFlags struct {
+	set 	*flag.FlagSet
+	json 	*bool
+	options func() (database.Options, error)
+}
+
+func newInspectFlags(name string) *inspectFlags {
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	return &inspectFlags{ set: set, json: set.Bool("json", false, "print JSON"), options: openFlags(set) }
+}
+
+// Parses args and opens the file, args wants the arguments after it
+func (f *inspectFlags) open(args []string, want int) (*database.Inspector, error) {
+	f.set.Parse(args)
+	if f.set.NArg() != want + 1 { usage() }
+	opts, err := f.options()
+	if err != nil { return nil, err }
+	return database.Inspect(f.set.Arg(0), opts)
+}
+
+func (f *inspectFlags) print(v any, text func(w io.Writer)) int {
+	if *f.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(v); err != nil { return fail(err) }
+		return 0
+	}
+	text(os.Stdout)
+	return 0
+}
+
+func page(args []string) int {
+	f := newInspectFlags("page")
+	in, err := f.open(args, 1)
+	if err != nil { return fail(err) }
+	defer in.Close()
+	id, err := strconv.ParseUint(f.set.Arg(1), 10, 64)
+	if err != nil { return fail(fmt.Errorf("Bad page id: %w", err)) }
+	dump, err := in.Page(id)
+	if err != nil { return fail(err) }
+	return f.print(dump, func(w io.Writer) { printPage(w, dump) })
+}
+
+func tree(args []string) int {
+	f := newInspectFlags("tree")
+	in, err := f.open(args, 1)
+	if err != nil { return fail(err) }
+	defer in.Close()
+	schema, ok := database.TreeSchema(strings.ToUpper(f.set.Arg(1)))
+	if !ok { return fail(fmt.Errorf("No tree for %s, there are FSM, FTYPE_IDX, FTIME_IDX and FID_IDX", f.set.Arg(1))) }
+	dump, err := in.Tree(schema)
+	if err != nil { return fail(err) }
+	return f.print(dump, func(w io.Writer) { printTree(w, dump) })
+}
+
+func logs(args []string) int {
+	f := newInspectFlags("log")
+	from := f.set.Uint64("from", 0, "first lsn to print")
+	limit := f.set.Int("limit", 0, "most records to print, 0 for all")
+	values := f.set.Int("values", 32, "bytes of each value to print, -1 for all")
+	in, err := f.open(args, 0)
+	if err != nil { return fail(err) }
+	defer in.Close()
+	records, err := in.Log(*from, *limit, *values)
+	if err != nil { return fail(err) }
+	return f.print(records, func(w io.Writer) {
+		for _, r := range records { printRecord(w, r) }
+	})
+}
+
+func printPage(w io.Writer, p *database.PageDump) {
+	fmt.Fprintf(w, "page %d %s lsn %d checksum %08x", p.Id, p.Type, p.Lsn, p.Checksum)
+	if p.Compressed { fmt.Fprint(w, " compressed") }
+	if p.Next != 0 || p.Prev != 0 { fmt.Fprintf(w, " next %d prev %d", p.Next, p.Prev) }
+	fmt.Fprintln(w)
+	if p.Corrupt != "" { fmt.Fprintf(w, "  CORRUPT: %s\n", p.Corrupt) }
+
+	switch {
+		case p.Meta != nil:
+			m := p.Meta
+			fmt.Fprintf(w, "  format %d page size %d features %x mirror %d generation %d\n", m.Version, m.PageSize, m.Features, m.Mirror, m.Generation)
+			fmt.Fprintf(w, "  total %d max %d free trunk %d free count %d checkpoint lsn %d\n", m.Total, m.Max, m.FreeTrunk, m.FreeCount, m.CheckpointLsn)
+			fmt.Fprintf(w, "  log from segment %d offset %d after lsn %d, last trx %d\n", m.LogSegment, m.LogOffset, m.LogLsn, m.LastTrx)
+			for _, name := range []string{ "FSM", "FTYPE_IDX", "FTIME_IDX", "FID_IDX" } {
+				fmt.Fprintf(w, "  %s root %d\n", name, m.Roots[name])
+			}
+		case p.Item != nil && p.Item.Leaf:
+			it := p.Item
+			fmt.Fprintf(w, "  keys of %d entries of %d, %d entries %d dirty, next %d prev %d\n", it.KeySize, it.EntrySize, it.N, it.Dirty, it.Next, it.Prev)
+			for i, e := range it.Entries { fmt.Fprintf(w, "  %4d %s\n", i, entry(e)) }
+		case p.Item != nil:
+			it := p.Item
+			fmt.Fprintf(w, "  keys of %d, %d keys\n", it.KeySize, it.N)
+			for i, child := range it.Children {
+				fmt.Fprintf(w, "  child %d\n", child)
+				if i < len(it.Keys) { fmt.Fprintf(w, "  key %s\n", it.Keys[i]) }
+			}
+		case p.Slots != nil:
+			s := p.Slots
+			fmt.Fprintf(w, "  slots of %d bytes, %d of %d taken\n", s.Size, s.Used, s.Capacity)
+			printBitmap(w, s.Bitmap)
+		case p.Free != nil:
+			fmt.Fprintf(w, "  free list trunk with %d pages\n", len(p.Free))
+			for i := 0; i < len(p.Free); i += 16 {
+				fmt.Fprintf(w, "  %v\n", p.Free[i:min(i+16, len(p.Free))])
+			}
+	}
+}
+
+func entry(e database.EntryDump) string {
+	var b strings.Builder
+	b.WriteString(e.Key)
+	switch {
+		case e.Slot != nil: fmt.Fprintf(&b, " -> page %d slot %d", e.Page, *e.Slot)
+		case e.Size != nil: fmt.Fprintf(&b, " -> page %d, %d free of %d bytes", e.Page, *e.Free, *e.Size)
+	}
+	if e.Dirty { b.WriteString(" (deleted)") }
+	return b.String()
+}
+
+// 64 slots a line in bytes of 8, slot 0 first
+func printBitmap(w io.Writer, bitmap string) {
+	for i := 0; i < len(bitmap); i += 64 {
+		line := bitmap[i:min(i+64, len(bitmap))]
+		fmt.Fprintf(w, "  %4d ", i)
+		for j := 0; j < len(line); j += 8 { fmt.Fprintf(w, " %s", line[j:min(j+8, len(line))]) }
+		fmt.Fprintln(w)
+	}
+}
+
+func printTree(w io.Writer, t *database.TreeDump) {
+	fmt.Fprintf(w, "%s root %d\n", t.Schema, t.Root)
+	for depth, level := range t.Levels {
+		fmt.Fprintf(w, "level %d, %d pages\n", depth, len(level))
+		for _, p := range level {
+			it := p.Item
+			if it == nil {
+				fmt.Fprintf(w, "  page %d %s is not part of a tree\n", p.Id, p.Type)
+				continue
+			}
+			if it.Leaf {
+				fmt.Fprintf(w, "  page %d leaf %d entries %d dirty prev %d next %d", p.Id, it.N, it.Dirty, it.Prev, it.Next)
+				if len(it.Entries) > 0 { fmt.Fprintf(w, " keys %s .. %s", it.Entries[0].Key, it.Entries[len(it.Entries)-1].Key) }
+			} else {
+				fmt.Fprintf(w, "  page %d node children %v", p.Id, it.Children)
+				for _, key := range it.Keys { fmt.Fprintf(w, "\n    %s", key) }
+			}
+			if p.Corrupt != "" { fmt.Fprintf(w, " CORRUPT") }
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+func printRecord(w io.Writer, r *database.RecordDump) {
+	fmt.Fprintf(w, "lsn %d trx %d %s %s %s dest %d", r.Lsn, r.TrxId, r.Flag, r.Op, r.VType, r.Dest)
+	if r.Page != nil { fmt.Fprintf(w, " page %d", *r.Page) }
+	fmt.Fprintf(w, " len %d at %d:%d", r.Length, r.Segment, r.Offset)
+	if r.At != 0 { fmt.Fprintf(w, " committed %s", time.Unix(0, r.At).UTC().Format(time.RFC3339Nano)) }
+	if r.Value != "" { fmt.Fprintf(w, " %s", r.Value) }
+	fmt.Fprintln(w)
+}
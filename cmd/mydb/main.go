@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"mydb/core/prims"
+	"mydb/database"
+)
+
+const USAGE = `usage: mydb <command> [flags] <file> [args]
+
+commands:
+	check <file> 			walks every tree, the free space map and the free list,
+							lists what is wrong and exits 1 if anything is.
+							A file being written is checked as of when check opened it
+	page <file> <id> 		dumps a page with its header decoded
+	tree <file> <schema> 	prints the tree of FSM, FTYPE_IDX, FTIME_IDX or FID_IDX a level at a time
+	log <file> 				decodes the log records from where the file says the log starts
+
+flags:
+	-key 		hex key of an encrypted file
+	-as-is 		check looks at a file that needs recovery without replaying
+				its log, and prints the lsns the log would replay
+	-json 		page, tree and log print JSON
+	-from 		log starts at this lsn
+	-limit 		log prints this many records, 0 for all
+	-values 	log prints this many bytes of each value, -1 for all
+
+page, tree and log look at the file as it is on disk,
+one that needs recovery isnt recovered first
+`
+
+func main() {
+	if len(os.Args) < 2 { usage() }
+	switch os.Args[1] {
+		case "check": os.Exit(check(os.Args[2:]))
+		case "page": os.Exit(page(os.Args[2:]))
+		case "tree": os.Exit(tree(os.Args[2:]))
+		case "log": os.Exit(logs(os.Args[2:]))
+		case "help", "-h", "--help":
+			fmt.Print(USAGE)
+		default: usage()
+	}
+}
+
+func usage() {
+	fmt.Fprint(os.Stderr, USAGE)
+	os.Exit(2)
+}
+
+// The flags every command takes to open a file
+func openFlags(set *flag.FlagSet) func() (database.Options, error) {
+	key := set.String("key", "", "hex key the file is encrypted with")
+	return func() (database.Options, error) {
+		var opts database.Options
+		if *key == "" { return opts, nil }
+		k, err := hex.DecodeString(*key)
+		if err != nil { return opts, fmt.Errorf("Bad key: %w", err) }
+		opts.Keys = prims.StaticKey(k)
+		return opts, nil
+	}
+}
+
+func check(args []string) int {
+	set := flag.NewFlagSet("check", flag.ExitOnError)
+	options := openFlags(set)
+	asIs := set.Bool("as-is", false, "check the file without replaying its log")
+	set.Parse(args)
+	if set.NArg() != 1 { usage() }
+	opts, err := options()
+	if err != nil { return fail(err) }
+
+	run := database.Check
+	if *asIs { run = database.CheckAsIs }
+	report, err := run(set.Arg(0), opts)
+	if err != nil { return fail(err) }
+	for _, v := range report.Violations { fmt.Println(v) }
+	fmt.Printf("%d pages, %d in use, %d reached, %d problems\n", report.Pages, report.Used, report.Reached, len(report.Violations))
+	if p := report.Pending; p.From != 0 { fmt.Printf("log holds lsns %d to %d the file hasnt got yet\n", p.From, p.To) }
+	if !report.Ok() { return 1 }
+	return 0
+}
+
+func fail(err error) int {
+	fmt.Fprintln(os.Stderr, "mydb:", err)
+	return 2
+}
@@ -30,7 +30,7 @@ func (bp *Pool[T]) Put(buf T) {
 	bp.Signal()
 }
 
-func NewBufferPool(count int) *Pool[[]byte] {
+func NewBufferPool(count int, pageSize uint16) *Pool[[]byte] {
 	pool := &Pool[[]byte]{
 		stack: make([][]byte, 0, count),
 		Cond: &sync.Cond{
@@ -38,7 +38,7 @@ func NewBufferPool(count int) *Pool[[]byte] {
 		},
 	}
 	for range count {
-		pool.stack = append(pool.stack, make([]byte, pages.PAGE_SIZE))
+		pool.stack = append(pool.stack, make([]byte, pageSize))
 	}
 	return pool
 }
@@ -8,6 +8,7 @@ import (
 	"mydb/core/types"
 )
 
+// Defaults, the database options override them
 const (
 	CACHE_SIZE = 256
 	CACHE_MIN  = 25
@@ -23,7 +24,11 @@ type cacheEntry struct {
 }
 
 type Cache struct {
-	fd 			int
+	store 		prims.Storage
+	pageSize 	uint16
+	size 		uint16
+	min 		uint16
+	sweepEvery 	int
 	m 			map[uint64]*cacheEntry
 	total 		uint16
 	mux 		*sync.RWMutex
@@ -39,25 +44,97 @@ type Cache struct {
 	nodePool 	*Pool[*indexes.BTreeNode]
 	leafPool 	*Pool[*indexes.BTreeLeaf]
 
+	// before images of the pages touched by the running transaction
+	snaps 		map[uint64]*Snapshot
+	snapMux 	*sync.Mutex
+	spare 		[][]byte
+
+	// gets the log on disk up to an lsn, set by the table
+	ForceLog 	func(uint64) error
+}
+
+type Snapshot struct {
+	P 		types.PageLike
+	Before 	[]byte
 }
 
-func NewCache(fd int) *Cache { 
+// size pages at most, a full cache is emptied down to min,
+// sweeps run every sweep hits unless it is negative
+func NewCache(store prims.Storage, pageSize uint16, size, min, sweep int) *Cache { 
 	return &Cache{ 
-		fd: fd,
-		m:make(map[uint64]*cacheEntry, CACHE_SIZE),
+		store: store,
+		pageSize: pageSize,
+		size: uint16(size),
+		min: uint16(min),
+		sweepEvery: sweep,
+		m:make(map[uint64]*cacheEntry, size),
 		total: 0,
 		mux: &sync.RWMutex{},
 		oldest: nil,
 		newest: nil,
 
-		buffPool: 	NewBufferPool(CACHE_SIZE),
-		entryPool: 	NewCacheEntryPool(CACHE_SIZE),
-		bBasePool: NewBaseItemPool(CACHE_SIZE),
+		buffPool: 	NewBufferPool(size, pageSize),
+		entryPool: 	NewCacheEntryPool(size),
+		bBasePool: NewBaseItemPool(size),
+
+		nodePool: 	NewNodePool(size),
+		leafPool: 	NewLeafPool(size),
+		pagePool: 	NewPagePool(size),
+
+		snapMux: &sync.Mutex{},
+	}
+}
+
+// Starts keeping the before image of every page the cache hands out.
+// Tracked pages stay pinned until EndTracking.
+func (c *Cache) BeginTracking() {
+	c.snapMux.Lock()
+	defer c.snapMux.Unlock()
+	c.snaps = make(map[uint64]*Snapshot)
+}
+
+// Stops tracking and returns the snapshots,
+// hand them back with PutSnapshots once done
+func (c *Cache) EndTracking() map[uint64]*Snapshot {
+	c.snapMux.Lock()
+	defer c.snapMux.Unlock()
+	snaps := c.snaps
+	c.snaps = nil
+	return snaps
+}
+
+func (c *Cache) PutSnapshots(snaps map[uint64]*Snapshot) {
+	c.snapMux.Lock()
+	defer c.snapMux.Unlock()
+	for _, s := range snaps { c.spare = append(c.spare, s.Before) }
+}
+
+// Tracks a page the cache doesnt own, like the meta page
+func (c *Cache) Track(p types.PageLike) { c.snapshot(p, false) }
 
-		nodePool: 	NewNodePool(CACHE_SIZE),
-		leafPool: 	NewLeafPool(CACHE_SIZE),
-		pagePool: 	NewPagePool(CACHE_SIZE),
+func (c *Cache) snapshot(p types.PageLike, isNew bool) {
+	c.snapMux.Lock()
+	defer c.snapMux.Unlock()
+	if c.snaps == nil { return }
+	if _, ok := c.snaps[p.GetId()]; ok { return }
+
+	var before []byte
+	if n := len(c.spare); n > 0 {
+		before = c.spare[n-1]
+		c.spare = c.spare[:n-1]
+	} else {
+		before = make([]byte, c.pageSize)
 	}
+	if isNew { clear(before)
+	} else { copy(before, p.ToBytes()) }
+	c.snaps[p.GetId()] = &Snapshot{P: p, Before: before}
+}
+
+func (c *Cache) isTracked(id uint64) bool {
+	c.snapMux.Lock()
+	defer c.snapMux.Unlock()
+	_, ok := c.snaps[id]
+	return ok
 }
 
 func (c *Cache) GetBuffer() ([]byte) { return c.buffPool.Get() }
@@ -69,9 +146,7 @@ func (c *Cache) GetNode(id uint64) *indexes.BTreeNode {
 	if !ok {
 		node := c.nodePool.Get() 
 		buff := c.buffPool.Get()
-		offset:= int64(id * uint64(pages.PAGE_SIZE))
-
-		_, err := prims.Read(c.fd, buff, offset)
+		err := pages.ReadPage(c.store, id, buff)
 		if err != nil {
 			c.nodePool.Put(node)
 			c.buffPool.Put(buff)
@@ -97,9 +172,7 @@ func (c *Cache) GetLeaf(id uint64) *indexes.BTreeLeaf {
 	if !ok {
 		lea := c.leafPool.Get() 
 		buff := c.buffPool.Get()
-		offset:= int64(id * uint64(pages.PAGE_SIZE))
-
-		_, err := prims.Read(c.fd, buff, offset)
+		err := pages.ReadPage(c.store, id, buff)
 		if err != nil {
 			c.leafPool.Put(lea)
 			c.buffPool.Put(buff)
@@ -125,9 +198,7 @@ func (c *Cache) GetPage(id uint64) *pages.Page {
 	if !ok {
 		pa := c.pagePool.Get() 
 		buff := c.buffPool.Get()
-		offset:= int64(id * uint64(pages.PAGE_SIZE))
-
-		_, err := prims.Read(c.fd, buff, offset)
+		err := pages.ReadPage(c.store, id, buff)
 		if err != nil {
 			c.pagePool.Put(pa)
 			c.buffPool.Put(buff)
@@ -152,6 +223,7 @@ func (c *Cache) Get(id uint64) (types.PageLike, bool) {
 	defer c.mux.RUnlock()
 	e, ok := c.m[id]
 	if !ok { return nil, false }
+	c.snapshot(e.p, false)
 
 	if e.used < 5 {
 		e.used ++
@@ -171,9 +243,15 @@ func (c *Cache) Get(id uint64) (types.PageLike, bool) {
 	return e.p, true
 }
 
-func (c *Cache) Set(item types.PageLike) {
+func (c *Cache) Set(item types.PageLike) { c.set(item, false) }
+
+// The page was just claimed so its before image is an empty page
+func (c *Cache) SetNew(item types.PageLike) { c.set(item, true) }
+
+func (c *Cache) set(item types.PageLike, isNew bool) {
 	c.mux.Lock()
 	defer c.mux.Unlock()
+	c.snapshot(item, isNew)
 	e := c.entryPool.Get()
 	e.p = item
 	e.prev = nil
@@ -187,11 +265,11 @@ func (c *Cache) Set(item types.PageLike) {
 	c.newest = e
 	c.total++
 
-	if c.total >= CACHE_SIZE {
+	if c.total >= c.size {
 		c.HandleFullCache()
 	} else if c.total == 1 {
 		c.oldest = e 
-	} else if c.sinceSweep >= SWEEP_INTERVAL {
+	} else if c.sweepEvery >= 0 && c.sinceSweep >= uint64(c.sweepEvery) {
 		c.RunSweep()
 	}
 }
@@ -202,14 +280,8 @@ func (c *Cache) RunSweep() {
 	for node != nil {
 		node.used--
 		if node.used == 0 {
-			if !node.p.InUse() {
-				buff := node.p.ToBytes()
-				if node.p.IsDirty() {
-					node.p.Lock()
-					node.p.Flush(buff)
-					node.p.Unlock()
-				}
-				c.PutBuffer(buff)
+			if !node.p.InUse() && !c.isTracked(node.p.GetId()) && c.flush(node.p) == nil {
+				c.PutBuffer(node.p.ToBytes())
 				c.ReturnToPool(node.p)
 
 				delete(c.m, node.p.GetId())
@@ -238,18 +310,10 @@ func (c *Cache) RunSweep() {
 func (c *Cache)HandleFullCache() {
 	node := c.oldest
 	var deletedCount int
-	for c.total > CACHE_MIN && node != nil {
-		if !node.p.InUse() { 
-			var buff []byte
-			buff = node.p.ToBytes()
-			if node.p.IsDirty() { 
-				node.p.Lock()
-				node.p.Flush(buff)
-				node.p.Unlock()
-			}
-
+	for c.total > c.min && node != nil {
+		if !node.p.InUse() && !c.isTracked(node.p.GetId()) && c.flush(node.p) == nil { 
 			if deletedCount <= MAX_DELETE {
-				c.PutBuffer(buff)
+				c.PutBuffer(node.p.ToBytes())
 				delete(c.m, node.p.GetId())
 				if node.prev != nil {
 					node.prev.next = node.next
@@ -271,14 +335,117 @@ func (c *Cache)HandleFullCache() {
 }
 
 func (c *Cache) ReturnToPool(p types.PageLike) {
-	switch p.GetType() {
-	case pages.IDX_LEAF:
-		c.bBasePool.Put(p.(*indexes.BTreeLeaf).BTItemBase)
-		c.leafPool.Put(p.(*indexes.BTreeLeaf))
-	case pages.IDX_NODE:
-		c.bBasePool.Put(p.(*indexes.BTreeNode).BTItemBase)
-		c.nodePool.Put(p.(*indexes.BTreeNode))
-	default:
-		c.pagePool.Put(p.(*pages.Page))
+	switch item := p.(type) {
+	case *indexes.BTreeLeaf:
+		c.bBasePool.Put(item.BTItemBase)
+		c.leafPool.Put(item)
+	case *indexes.BTreeNode:
+		c.bBasePool.Put(item.BTItemBase)
+		c.nodePool.Put(item)
+	case *pages.Page:
+		c.pagePool.Put(item)
+	}
+}
+
+// Writes a dirty page, but only once the log holds everything up to
+// the page lsn. If the log cant get there the page stays in the cache.
+func (c *Cache) flush(p types.PageLike) error {
+	if !p.IsDirty() { return nil }
+	if c.ForceLog != nil {
+		if err := c.ForceLog(p.GetLsn()); err != nil { return err }
+	}
+	p.Lock()
+	defer p.Unlock()
+	if err := p.Flush(p.ToBytes()); err != nil { return err }
+	p.SetIsDirty(false)
+	return nil
+}
+
+// Writes every dirty page but keeps them cached,
+// the running transaction's pages are left alone
+func (c *Cache) FlushAll() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for node := c.newest; node != nil; node = node.next {
+		if c.isTracked(node.p.GetId()) { continue }
+		if err := c.flush(node.p); err != nil { return err }
+	}
+	return nil
+}
+
+// Ids of the pages that have changes not on disk yet
+func (c *Cache) DirtyPages() []uint64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	ids := make([]uint64, 0)
+	for node := c.newest; node != nil; node = node.next {
+		if node.p.IsDirty() { ids = append(ids, node.p.GetId()) }
+	}
+	return ids
+}
+
+// Writes the pages that are still cached and dirty. A page that was let go of
+// was written then. Returns the ones the running transaction has, they
+// can only be written once it is done
+func (c *Cache) FlushPages(ids []uint64) ([]uint64, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	held := make([]uint64, 0)
+	for _, id := range ids {
+		e, ok := c.m[id]
+		if !ok { continue }
+		if c.isTracked(id) {
+			held = append(held, id)
+			continue
+		}
+		if err := c.flush(e.p); err != nil { return held, err }
+	}
+	return held, nil
+}
+
+// Forgets a page without flushing it, the next Get goes to disk
+func (c *Cache) Drop(id uint64) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	e, ok := c.m[id]
+	if !ok { return }
+	delete(c.m, id)
+
+	if e.prev != nil {
+		e.prev.next = e.next
+	} else {
+		c.newest = e.next
+	}
+	if e.next != nil {
+		e.next.prev = e.prev
+	} else {
+		c.oldest = e.prev
+	}
+	c.PutBuffer(e.p.ToBytes())
+	c.entryPool.Put(e)
+	c.total--
+}
+
+// Flushes every dirty page and empties the cache
+func (c *Cache) Purge() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	// everything goes out before anything is let go,
+	// a flush that fails leaves the cache as it was
+	for node := c.newest; node != nil; node = node.next {
+		if err := c.flush(node.p); err != nil { return err }
+	}
+	for node := c.newest; node != nil; {
+		c.PutBuffer(node.p.ToBytes())
+		c.ReturnToPool(node.p)
+		delete(c.m, node.p.GetId())
+
+		next := node.next
+		c.entryPool.Put(node)
+		node = next
 	}
+	c.newest = nil
+	c.oldest = nil
+	c.total = 0
+	return nil
 }
@@ -3,50 +3,117 @@ package engine
 import (
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"mydb/core/logger"
 	"mydb/core/pages"
 	"mydb/core/types"
 )
 
+// Applies the action to the bytes of the page.
+// The page is re-read from those bytes afterwards,
+// ToBytes is only called once since it writes the page out first.
 func ExecuteAction(l *logger.Logger, a *types.Action, p types.PageLike) error {
+	var err error
+	buff := p.ToBytes()
 	switch a.GetOperation() {
-		case types.INSERT, types.UPDATE: return Insert(l,a, p)
-		case types.DELETE: return Delete(l, a, p)
-		case types.NONE, types.NEWPAGE: return nil
+		case types.INSERT, types.UPDATE: err = Insert(l, a, buff)
+		case types.DELETE: err = Delete(l, a, p.GetId(), buff)
+		case types.NEWPAGE: err = Delete(l, a, p.GetId(), buff)
+		case types.SNAPSHOT: err = Snapshot(l, a, buff)
+		case types.UNDO, types.NONE, types.CHECKPOINT: return nil
 		default: return errors.New("Unknown action operation")
 	}
+	if err != nil { return err }
+	return p.FromBytes(buff)
 }
 
-func ExecuteTrx(l *logger.Logger, trxId int32 )error {
+// Replays the actions of a pending transaction
+func ExecuteTrx(l *logger.Logger, trxId uint64 ) error {
 	actions := l.GetActions(trxId)
 	if actions == nil || len(*actions) == 0 {
 		return errors.New("No actions found for transaction")
 	}
-	fmt.Printf("TRX: %d, AXSLen: %d\n", trxId, len(*actions))
-	var err error
-	ps := make(map[int32]types.PageLike)
-	for _, action := range *actions {
-		pageId := int32(action.GetDest()/int64(pages.PAGE_SIZE))
+	return ExecuteActions(l, *actions)
+}
+
+// Replays actions in order. An action only touches its page
+// when the page has not seen that lsn yet, so replaying twice is safe.
+func ExecuteActions(l *logger.Logger, actions []*types.Action) error {
+	ps := make(map[uint64]types.PageLike)
+	defer func() { for _, p := range ps { p.Unlock() } }()
+
+	for _, action := range actions {
+		pageId, ok := action.GetPageId(l.PageSize)
+		if !ok { continue }
+
 		if _, ok := ps[pageId]; !ok {
-			tablePage, err := l.GetPageLike(uint64(action.GetDest())/uint64(pages.PAGE_SIZE))
+			tablePage, err := getPage(l, pageId, actions)
 			if err != nil { return err }
 			tablePage.Lock()
 			ps[pageId] = tablePage
 		}
+		p := ps[pageId]
+		if p.GetLsn() >= action.Lsn { continue }
+
+		if err := ExecuteAction(l, action, p); err != nil { return err }
+		p.SetLsn(action.Lsn)
+		p.SetIsDirty(true)
+	}
+	return nil
+}
 
-		ExecuteAction(l, action, ps[pageId])
+// Loads the page for recovery. One a crash tore is put back from
+// the image its first change since the checkpoint logged.
+func getPage(l *logger.Logger, pageId uint64, actions []*types.Action) (types.PageLike, error) {
+	p, err := l.GetPageLike(pageId)
+	var corrupt *pages.CorruptPageError
+	if !errors.As(err, &corrupt) { return p, err }
+	for _, a := range actions {
+		if a.GetOperation() != types.SNAPSHOT { continue }
+		if id, _ := a.GetPageId(l.PageSize); id != pageId { continue }
+		if err := l.RepairPage(pageId, a); err != nil { return nil, err }
+		return l.GetPageLike(pageId)
 	}
+	return nil, err
+}
 
-	for _, p := range ps { p.Unlock() }
+// Walks the actions of an unfinished transaction backwards,
+// puts the before images back and empties the pages it claimed.
+// The pages get the last lsn of the log since they are newer than any record.
+func UndoActions(l *logger.Logger, actions []*types.Action) error {
+	ps := make(map[uint64]types.PageLike)
+	defer func() { for _, p := range ps { p.Unlock() } }()
+
+	for i := len(actions) - 1; i >= 0; i-- {
+		action := actions[i]
+		op := action.GetOperation()
+		if op != types.UNDO && op != types.NEWPAGE { continue }
+		pageId, _ := action.GetPageId(l.PageSize)
+
+		if _, ok := ps[pageId]; !ok {
+			tablePage, err := getPage(l, pageId, actions)
+			if err != nil { return err }
+			tablePage.Lock()
+			ps[pageId] = tablePage
+		}
+		p := ps[pageId]
 
-	return err
+		buff := p.ToBytes()
+		var err error
+		if op == types.UNDO {
+			err = Insert(l, action, buff)
+		} else {
+			err = Delete(l, action, pageId, buff)
+		}
+		if err != nil { return err }
+		if err := p.FromBytes(buff); err != nil { return err }
+		p.SetLsn(l.Lsn)
+		p.SetIsDirty(true)
+	}
+	return nil
 }
 
-func Insert(l *logger.Logger, action *types.Action, p types.PageLike) error {
-	// Load in table page
-	cursor := uint16(action.GetDest() % int64(pages.PAGE_SIZE))
-	dest := p.ToBytes()
+func Insert(l *logger.Logger, action *types.Action, dest []byte) error {
+	cursor := uint16(action.GetDest() % int64(l.PageSize))
 
 	vType := types.DataType(action.GetVType())
 	if vType == types.ChainBlob {
@@ -64,25 +131,30 @@ func Insert(l *logger.Logger, action *types.Action, p types.PageLike) error {
 		cursor += 2
 	}
 
-	if action.GetVLength() == 0 { 
-		fmt.Println(action.GetVType())
-		return nil 
-	}
+	if action.GetVLength() == 0 { return nil }
 
-	copy(dest[cursor:], l.GetValue(action))
+	val, err := l.GetValue(action)
+	if err != nil { return err }
+	copy(dest[cursor:], val)
 	return nil
 }
 
 // Only handles the deletion of pages.
 // because otherwise deletion is just inserting/updating the FSM
-// but with pages we have to send the page to the database struct
-func Delete(l *logger.Logger, action *types.Action, p types.PageLike) error {
+// A freed or freshly claimed page starts out empty,
+// the free list itself is left to the database struct
+func Delete(l *logger.Logger, action *types.Action, pageId uint64, dest []byte) error {
 	if types.DataType(action.GetVType()) == types.Page {
-		pageId := uint64(action.GetDest()) / uint64(pages.PAGE_SIZE)
-		p, err := l.GetPageLike(pageId)
-		if err != nil { return err }
-
-		return l.NewFreePage(p)
+		clear(dest)
+		binary.LittleEndian.PutUint64(dest[pages.PAGEID_OFF:], pageId)
 	}
 	return nil
 }
+
+// Puts a whole page image back
+func Snapshot(l *logger.Logger, action *types.Action, dest []byte) error {
+	val, err := l.PageImage(action)
+	if err != nil { return err }
+	copy(dest, val)
+	return nil
+}
@@ -9,7 +9,7 @@ import (
 	"mydb/core/types"
 )
 
-func (f *FSM) GetFixedSpace(size uint16, pType pages.PageType, trxId int32) (*pages.PageId, error) {
+func (f *FSM) GetFixedSpace(size uint16, pType pages.PageType, trxId uint64) (*pages.PageId, error) {
 	// LOG IT
 	axs := types.AtomicAx(types.GET_FIX_SPACE, types.NLBlob, 0, size)
 	f.Logger.NewTxn(&[]*types.Action{axs}, &[]*[]byte{}, trxId)
@@ -97,7 +97,7 @@ func (f *FSM) GetFixedSpace(size uint16, pType pages.PageType, trxId int32) (*pa
 	return pid, nil
 }
 
-func (f *FSM) PutFixedSpace(size uint16, pid *pages.PageId, trxId int32) error {
+func (f *FSM) PutFixedSpace(size uint16, pid *pages.PageId, trxId uint64) error {
 
 	// LOGG THE THING
 	axs := types.AtomicAx(types.PUT_FIX_SPACE, types.NLBlob, 0, size)
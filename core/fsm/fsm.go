@@ -54,7 +54,7 @@ func partialCompareKey(qkey, key []byte, _ pages.PageType) int8 {
 
 type fsmIdxQuery struct { *indexes.IdxQuery }
 
-func (f *FSM) NewQuery(key []byte, limit int, trxId int32) *fsmIdxQuery {
+func (f *FSM) NewQuery(key []byte, limit int, trxId uint64) *fsmIdxQuery {
 	return &fsmIdxQuery{IdxQuery: indexes.NewIdxQuery(
 			f.Idx, key, limit, FSM_ENTRY_SIZE, FSM_KEY_SIZE, pages.FSM, trxId,
 	)}
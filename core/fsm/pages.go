@@ -11,8 +11,11 @@ func (f *FSM)GetPage(pid *pages.PageId) (*pages.Page, error) {
 	var page *pages.Page
 	if !ok {
 		buff := f.Cache.GetBuffer()
-		page, err = pages.LoadPage(f.Db.GetFd(), pid.PID, buff)
-		if err != nil { return nil, err }
+		page, err = pages.LoadPage(f.Db.GetStore(), pid.PID, buff)
+		if err != nil {
+			f.Cache.PutBuffer(buff)
+			return nil, err
+		}
 
 		f.Cache.Set(page)
 
@@ -22,13 +25,14 @@ func (f *FSM)GetPage(pid *pages.PageId) (*pages.Page, error) {
 	return page, nil
 }
 
-func (f *FSM)ClaimFreePage(pType pages.PageType, trxId int32) (*pages.Page, error) {
+func (f *FSM)ClaimFreePage(pType pages.PageType, trxId uint64) (*pages.Page, error) {
 	// create a new node for the leaf
 	newId, err := f.Db.ClaimFreePage(pType)
 	if err != nil { return nil, err }
 
 	axs, vs := make([]*types.Action, 1), make([]*[]byte, 1)
 	axs[0], vs[0] = types.AtomicAx(types.NEWPAGE, types.Page, newId), &[]byte{}
+	if _, err = f.Logger.NewTxn(&axs, &vs, trxId); err != nil { return nil, err }
 
 	page, err := f.GetPage(pages.NewPageId(newId))
 	if err != nil { return nil, err }
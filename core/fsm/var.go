@@ -7,7 +7,7 @@ import (
 	"mydb/core/types"
 )
 
-func (f *FSM) GetVarSpace(size uint16, trxId int32) (*pages.PageId, error) {
+func (f *FSM) GetVarSpace(size uint16, trxId uint64) (*pages.PageId, error) {
 	axs := types.AtomicAx(types.GET_VAR_SPACE, types.NLBlob, 0, size)
 	f.Logger.NewTxn(&[]*types.Action{axs}, &[]*[]byte{}, trxId)
 
@@ -85,7 +85,7 @@ func (f *FSM) GetVarSpace(size uint16, trxId int32) (*pages.PageId, error) {
 
 		// create a new entry/key for the new page
 		key[0] = 0 // !isFixed
-		newFreeSize := pages.PAGE_SIZE - pages.PAGE_HEADER_LENGTH - (2*pages.TUPLE_SIZE) - size
+		newFreeSize := uint16(len(page.Body)) - (2*pages.TUPLE_SIZE) - size
 	 	binary.LittleEndian.PutUint16(key[SIZE_OFFSET:], newFreeSize)
 
 		key[DIRTY_OFFSET] = indexes.IS_CLEAN
@@ -100,7 +100,7 @@ func (f *FSM) GetVarSpace(size uint16, trxId int32) (*pages.PageId, error) {
 	return pid, err
 }
 
-func (f *FSM) PutVarSpace(pid *pages.PageId, size uint16, trxId int32, isRecursed ...bool) error {
+func (f *FSM) PutVarSpace(pid *pages.PageId, size uint16, trxId uint64, isRecursed ...bool) error {
 	// LOG THE THING
 	axs := types.AtomicAx(types.PUT_VAR_SPACE, types.NLBlob, pid.Pack(), size)
 	f.Logger.NewTxn(&[]*types.Action{axs}, &[]*[]byte{}, trxId)
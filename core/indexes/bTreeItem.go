@@ -6,12 +6,13 @@ import (
 	"fmt"
 	"sync"
 	"mydb/core/pages"
+	"mydb/core/prims"
 	"mydb/core/types"
 )
 
 type BTreeItem interface {
 	types.PageLike
-	init(fd int, entrySizes ...int)
+	init(store prims.Storage, entrySizes ...int)
 	IsLeaf() bool
 	ToBytes() []byte
 	Flush([]byte) error
@@ -29,14 +30,14 @@ type BTreeItem interface {
 }
 
 const ( 
-	// header
-	BNODE_HEADER_LENGTH = 1 + 8 + 2 + 2 + 2 + 8
-	PAGETYPE_OFFSET = 0
-	ID_OFFSET = 1
-	KEY_SIZE_OFFSET = 9
-	ENTRY_SIZE_OFFSET = 11
-	N_OFFSET 	= 13
-	LSN_OFFSET = 15
+	// header, shares { type, id, lsn, checksum } with pages.Page
+	BNODE_HEADER_LENGTH = 1 + 8 + 8 + 4 + 2 + 2 + 2
+	PAGETYPE_OFFSET = pages.PAGETYPE_OFF
+	ID_OFFSET = pages.PAGEID_OFF
+	LSN_OFFSET = pages.LSN_OFF
+	KEY_SIZE_OFFSET = 21
+	ENTRY_SIZE_OFFSET = 23
+	N_OFFSET 	= 25
 
 	// sizes
 	N_SIZE = 2
@@ -47,7 +48,7 @@ const (
 )
 
 type BTItemBase struct {
-	fd 			int
+	store 		prims.Storage
 	isDirty 	bool
 	Lsn 		uint64
 	PType  		pages.PageType
@@ -62,6 +63,7 @@ type BTItemBase struct {
 }
 func (n *BTItemBase) IsDirty() bool { return n.isDirty }
 func (n *BTItemBase) SetIsDirty(is bool) { n.isDirty = is }
+func (n *BTItemBase) GetLsn() uint64 { return n.Lsn }
 func (n *BTItemBase) SetLsn(lsn uint64) { n.Lsn = lsn }
 func (n *BTItemBase) GetId() (uint64) { return n.Id }
 func (n *BTItemBase) GetType() (pages.PageType) { return n.PType }
@@ -114,8 +116,8 @@ func (b *BTItemBase)GetParent(q *IdxQuery) (*BTreeNode, error){
 				return nil, err 
 			}
 
-			if curr.GetId() == b.Id { return prev, nil }
 			prev = node
+			if curr.GetId() == b.Id { return prev, nil }
 
 		} else {
 			return prev, nil
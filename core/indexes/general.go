@@ -12,6 +12,7 @@ import (
 )
 
 func SearchKeys(q *IdxQuery, item BTreeItem) (*BTreeLeaf, error) {
+	if item == nil { return nil, EntryNotFoundError }
 	i := 0
 	if node, ok := item.(*BTreeNode); ok {
 		node.RLock()
@@ -40,15 +41,12 @@ func SearchKeys(q *IdxQuery, item BTreeItem) (*BTreeLeaf, error) {
 	}
 }
 
-func JustLoadNode[T BTreeItem](I *Idx, fd int, id uint64, node T) (error) {
-	offset := int64(id) * int64(pages.PAGE_SIZE)
-
+func JustLoadNode[T BTreeItem](I *Idx, store prims.Storage, id uint64, node T) (error) {
 	data := I.Cache.GetBuffer()
-	n, err := prims.Read(fd, data, offset)
-	if n < int(pages.PAGE_SIZE) {
-		panic("wronglength")
+	if err := pages.ReadPage(store, id, data); err != nil {
+		I.Cache.PutBuffer(data)
+		return err
 	}
-	if err != nil { return err	}
 
 	node.FromBytes(data)
 
@@ -60,13 +58,13 @@ func LoadNode(q *IdxQuery, id uint64) (*BTreeNode, error) {
 	nl, ok := q.I.Cache.Get(id)
 	if !ok {
 		node = new(BTreeNode)
-		err := JustLoadNode(q.I,q.fd, id, node)
+		err := JustLoadNode(q.I,q.store, id, node)
 		if err != nil { return nil, err }
 		node.Id = id
 		node.PType = pages.IDX_NODE
 
 		// add the node to the cache
-		node.init(q.fd, q.entrySize)
+		node.init(q.store, q.entrySize)
 		q.I.Cache.Set(node)
 
 	} else {
@@ -81,13 +79,13 @@ func LoadLeaf(q *IdxQuery, id uint64) (*BTreeLeaf, error) {
 	nl, ok := q.I.Cache.Get(id)
 	if !ok {
 		leaf = new(BTreeLeaf)
-		err := JustLoadNode(q.I,q.fd, id, leaf)
+		err := JustLoadNode(q.I,q.store, id, leaf)
 		if err != nil { return nil, err }
 
 		// add the node to the cache
 		leaf.Id = id
 		leaf.PType = pages.IDX_LEAF
-		leaf.init(q.fd, q.entrySize)
+		leaf.init(q.store, q.entrySize)
 		q.I.Cache.Set(leaf)
 	} else {
 		leaf, ok = nl.(*BTreeLeaf)
@@ -100,11 +98,11 @@ func LoadItem(q *IdxQuery, id uint64) (BTreeItem, error) {
 	var i BTreeItem
 	nl, ok := q.I.Cache.Get(id)
 	if !ok {
-		offset := int64(id) * int64(pages.PAGE_SIZE)
-
 		data := q.I.Cache.GetBuffer()
-		_, err := prims.Read(q.fd, data, offset)
-		if err != nil { return nil, err	}
+		if err := pages.ReadPage(q.store, id, data); err != nil {
+			q.I.Cache.PutBuffer(data)
+			return nil, err
+		}
 
 		if data[0] == byte(pages.IDX_LEAF) {
 			i = new(BTreeLeaf)
@@ -114,12 +112,13 @@ func LoadItem(q *IdxQuery, id uint64) (BTreeItem, error) {
 			fmt.Println("loadd",time.Now().UnixMicro(), id) 
 			theType := pages.PageType(data[0]).String()
 			errorString := fmt.Sprintf("NOT A LEAF OR NODE:%s",theType)
+			q.I.Cache.PutBuffer(data)
 			return nil, errors.New(errorString)
 		}
 		i.FromBytes(data)
 
 		// add the node to the cache
-		i.init(q.fd, q.entrySize)
+		i.init(q.store, q.entrySize)
 
 		q.I.Cache.Set(i)
 	} else {
@@ -159,33 +158,6 @@ func (leaf *BTreeLeaf)FindMatchingEntries(
 	// if not found cursor returns closest entry > key
 	cursor, found := leaf.BinSearchBody(q.key)
 	if !found && exact { 
-		// fmt.Printf("%d:%d ", leaf.Id, cursor)
-		// if leaf.Id == 13600 && cursor == 2665{
-		// 	leaf.PrintEntries(true,cursor)
-		// 	q.PrintKey()
-			// fmt.Println(leaf.N, leaf.Max)
-
-		// //
-		// if cursor == 5863 && leaf.Id == 1597 && leaf.N == 141 && leaf.Dirty == 2 {
-		// 	fmt.Printf("\n%d:%s ", leaf.Id, q.schema.String())
-		//
-			// q.PrintKey()
-		// 	// leaf.PrintEntries(true, cursor)
-			// parent, err := leaf.GetParent(q)
-			// if err != nil || parent == nil { return nil, EntryNotFoundError }
-			//
-			// fmt.Printf("\nparent N: %d", parent.N)
-			// for i,k:=range parent.Keys {
-			// 	fmt.Printf("\n%v %d",k[16:],parent.Children[i])
-			// 	cursor+=entrySize
-			// }
-		//
-		// 	// leaf, err := LoadLeaf(q,831)
-		// 	// if err != nil { return nil, EntryNotFoundError }
-		//
-		//
-		// }
-
 		return nil, EntryNotFoundError 
 	}
 	lengthOFBody := int((leaf.N + leaf.Dirty) * leaf.EntrySize)
@@ -278,6 +250,7 @@ func NewBItem(q *IdxQuery, item BTreeItem) (error) {
 	if err != nil { return err }
 
 	buff := q.I.Cache.GetBuffer()
+	clear(buff)
 
 	if item.IsLeaf() { 
 		buff[PAGETYPE_OFFSET] = byte(pages.IDX_LEAF)
@@ -292,9 +265,9 @@ func NewBItem(q *IdxQuery, item BTreeItem) (error) {
 	binary.LittleEndian.PutUint64(buff[LSN_OFFSET:], lsn)
 
 	item.FromBytes(buff)
-	item.init(q.fd, q.entrySize)
+	item.init(q.store, q.entrySize)
 
-	q.I.Cache.Set(item)
+	q.I.Cache.SetNew(item)
 
 	return nil
 }
@@ -3,7 +3,6 @@ package indexes
 import (
 	"bytes"
 	"encoding/binary"
-	"fmt"
 	"mydb/core/pages"
 	"mydb/core/prims"
 )
@@ -68,49 +67,18 @@ func (l *BTreeLeaf) WriteToBuffer(buff []byte) {
 }
 
 func (l *BTreeLeaf) Flush(buff []byte) error { 
-	offset := int64(l.Id) * int64(pages.PAGE_SIZE)
-	n, err := prims.Write(l.fd, buff, offset)
-	if n < int(pages.PAGE_SIZE) {
-		panic("didnt write it all")
-	}
-	if err != nil { return err }
+	if err := pages.WritePage(l.store, uint64(l.Id), buff); err != nil { return err }
 	l.isDirty = false
 	return nil
 }
 
-func (l *BTreeLeaf) init(fd int, entrySizes ...int) { 
-	l.fd = fd
-	l.Max = (((pages.PAGE_SIZE - uint16(l.BodyOffset())) / uint16(entrySizes[0])))
+func (l *BTreeLeaf) init(store prims.Storage, entrySizes ...int) { 
+	l.store = store
+	// the page size comes with the buffer
+	l.Max = (((uint16(len(l.fullBuff)) - uint16(l.BodyOffset())) / uint16(entrySizes[0])))
 	l.PType = pages.IDX_LEAF
 }
 
-func (l *BTreeLeaf) PrintEntries(hasUid bool, cursors ...int) {
-	isCursor := false
-	cursor := 0
-	if len(cursors) > 0 {
-		isCursor = true
-		cursor = cursors[0]
-	}
-
-	cursor1 := 0
-	entrySize:= int(l.EntrySize)
-	fmt.Printf("\n======================================")
-	fmt.Printf("\nENTRIES")
-	for cursor1 < int((l.N+l.Dirty)*uint16(entrySize)) {
-		if hasUid {
-			fmt.Printf("\n%v",l.Body[cursor1+16:cursor1+entrySize-8])
-
-		} else {
-			fmt.Printf("\n%v",l.Body[cursor1:cursor1+entrySize])
-		}
-		cursor1+=entrySize
-		if isCursor && cursor1 == cursor {
-			fmt.Printf("\n-- bin search cursor --")
-		}
-	}
-	fmt.Printf("\n======================================")
-}
-
 func (l *BTreeLeaf)SearchNextSibling(q *IdxQuery) ([]int, []*BTreeLeaf){
 	l.RLock()
 
@@ -243,8 +211,10 @@ func (leaf *BTreeLeaf)SplitAndAdd(q *IdxQuery, entry []byte) (error) {
 	entrySize := int(leaf.EntrySize)
 	halfEntryCount := int(leaf.N / 2)
 	cursor := halfEntryCount * entrySize
+	// searches go left on an equal key, so the separator
+	// is the last entry that stays in the old leaf
 	midEntry := make([]byte, entrySize)
-	copy(midEntry, leaf.Body[cursor:cursor+entrySize])
+	copy(midEntry, leaf.Body[cursor-entrySize:cursor])
 	midKey := q.deriveKeyFromEntry(midEntry)
 
 	// create new leaf
@@ -269,12 +239,13 @@ func (leaf *BTreeLeaf)SplitAndAdd(q *IdxQuery, entry []byte) (error) {
 	// split them
 	copy(newLeaf.Body[:], leaf.Body[cursor:])
 
-	newLeaf.N = uint16(halfEntryCount)
-	leaf.N -= uint16(halfEntryCount)
+	// the new leaf takes everything after the separator
+	newLeaf.N = leaf.N - uint16(halfEntryCount)
+	leaf.N = uint16(halfEntryCount)
 
 	// fmt.Printf("SPLIT:%d:%d ", leaf.Id, newLeaf.Id)
  
-	if q.compareKey(midKey) < 0 { 
+	if q.compareKey(midKey) <= 0 { 
 		leaf.Insert(entry)
 	} else { 
 		newLeaf.Insert(entry) 
@@ -32,7 +32,10 @@ func (n *BTreeNode) FromBytes(buff []byte) error {
 	cursor := uint16(BNODE_HEADER_LENGTH)
 	var i int
 	for ;i < int(n.N); {
-		n.Keys[i] = buff[cursor:cursor+n.KeySize]
+		// keys are copied out because WriteToBuffer
+		// rewrites buff while shifting them around
+		n.Keys[i] = make([]byte, n.KeySize)
+		copy(n.Keys[i], buff[cursor:cursor+n.KeySize])
 		cursor += n.KeySize
 		n.Children[i] = binary.LittleEndian.Uint64(buff[cursor:])
 		cursor += CHILD_SIZE
@@ -67,18 +70,13 @@ func (n *BTreeNode) WriteToBuffer(buff []byte) {
 }
 
 func (no *BTreeNode) Flush(buff []byte) error { 
-	offset := int64(no.Id) * int64(pages.PAGE_SIZE)
-	n, err := prims.Write(no.fd, buff, offset)
-	if n < int(pages.PAGE_SIZE) {
-		panic("didnt write it all")
-	}
-	if err != nil { return err }
+	if err := pages.WritePage(no.store, uint64(no.Id), buff); err != nil { return err }
 	no.isDirty = false
 	return nil
 }
 
-func (n *BTreeNode) init(fd int, entrySizes ...int) { 
-	n.fd = fd
+func (n *BTreeNode) init(store prims.Storage, entrySizes ...int) { 
+	n.store = store
 	n.PType = pages.IDX_NODE
 	var entrySize uint16
 	if len(entrySizes) > 0 {
@@ -86,7 +84,7 @@ func (n *BTreeNode) init(fd int, entrySizes ...int) {
 	} else {
 		entrySize = n.KeySize + uint16(CHILD_SIZE)
 	}
-	n.Max = (pages.PAGE_SIZE - BNODE_HEADER_LENGTH - CHILD_SIZE) / uint16(entrySize)
+	n.Max = (uint16(len(n.fullBuff)) - BNODE_HEADER_LENGTH - CHILD_SIZE) / uint16(entrySize)
 }
 
 func (node *BTreeNode) SplitAndInsert(q *IdxQuery, newNode *BTreeNode, key []byte, child uint64) error {
@@ -123,7 +121,7 @@ func (node *BTreeNode) SplitAndInsert(q *IdxQuery, newNode *BTreeNode, key []byt
 		parent.Lock()
 		defer parent.Unlock()
 		parent.Lsn = node.Lsn
-		err = parent.AddKey(q, promotedKey, node.Id)
+		err = parent.AddKey(q, promotedKey, newNode.Id)
 		if err != nil { return err }
 	}
 
@@ -192,7 +190,7 @@ func (q *IdxQuery) NewRootNode(node BTreeItem, newNode BTreeItem, midKey []byte)
 	root.KeySize = uint16(q.keySize)
 	root.EntrySize = uint16(q.entrySize)
 	root.N = 1 // root starts with one keys
-	root.init(q.fd, q.entrySize)
+	root.init(q.store, q.entrySize)
 	root.Keys = make([][]byte, 1)
 	root.Children = make([]uint64, 2)
 	root.Keys[0] = midKey
@@ -201,7 +199,7 @@ func (q *IdxQuery) NewRootNode(node BTreeItem, newNode BTreeItem, midKey []byte)
 	root.isDirty = true
 
 	root.Lsn, err = q.I.Logger.NewTxn(&axs, &vs, q.trxId)
-	start := q.I.MetaPage.Cursor + (SchemaToOrderedInt(q.schema) * 8)
+	start := q.I.metaCursor + (SchemaToOrderedInt(q.schema) * 8)
 	binary.LittleEndian.PutUint64(q.I.MetaPage.Body[start: start + 8], newId)
 
 	return err
@@ -221,8 +219,7 @@ func (q *IdxQuery)DeleteFromParent(n *BTreeNode, key []byte) error {
 		err = q.DeleteFromParent(parent, n.Keys[0])
 		if err != nil { return err }
 
-		err = q.I.Db.NewFreePage(n)
-		return err
+		return q.freeNode(n)
 	}
 
 	idx := -1
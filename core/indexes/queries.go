@@ -6,9 +6,6 @@ import (
 	"fmt"
 	"mydb/core/types"
 )
-func (q *IdxQuery)PrintKey() {
-	fmt.Printf("\n%v-MYKEY-%s\n",q.key[16:], q.schema.String())
-}
 
 func (q *IdxQuery)GetEntries(skipKey, exactMatch bool) ([]uint64,  error) {
 	root := q.GetRoot()
@@ -121,7 +118,6 @@ func (q *IdxQuery)DeleteEntry() error {
 		parent, err := leaf.GetParent(q)
 		if err != nil {
 			leaf.Unlock()
-			q.I.Logger.CancelTxn(q.GetTrxId())
 			return types.ErrInvalidPage
 		}
 
@@ -143,15 +139,12 @@ func (q *IdxQuery)DeleteEntry() error {
 		} else {
 			// we can safely delete the leaf
 			err = q.DeleteFromParent(parent, leaf.Key)
-			if err != nil {
-				q.I.Logger.CancelTxn(q.GetTrxId())
-				return err
-			}
+			if err != nil { return err }
 			leaf.RemoveLinkedList(q)
 			q.freeNode(leaf)
 		}
 
-		q.I.Logger.CommitTxn(q.GetTrxId())
+		// the table commits or cancels the whole transaction
 		return nil
 
 	} else {
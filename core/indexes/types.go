@@ -19,7 +19,7 @@ type Idx struct {
 	Logger *logger.Logger
 	Db types.DatabaseI
 	Cache types.CacheI
-	Fd int
+	Store prims.Storage
 	MetaPage *pages.Page
 	metaCursor uint16 // cursor for the meta page
 	PartialCompareKey func(qkey, key []byte, schema pages.PageType) int8
@@ -31,7 +31,7 @@ type Idx struct {
 // for PartialCompareKey, DeriveKeyFromEntry, DeriveEntryAndKey
 func NewIdx(d types.DatabaseI, l *logger.Logger, cache types.CacheI, meta *pages.Page) *Idx {
 	idx := new(Idx)
-	idx.Fd = d.GetFd()
+	idx.Store = d.GetStore()
 	idx.Db = d
 	idx.Cache = cache
 	idx.Logger = l
@@ -42,8 +42,8 @@ func NewIdx(d types.DatabaseI, l *logger.Logger, cache types.CacheI, meta *pages
 
 type IdxQuery struct {
 	I *Idx
-	fd int
-	trxId int32
+	store prims.Storage
+	trxId uint64
 	key []byte
 	limit int
 	entrySize int
@@ -54,13 +54,13 @@ type IdxQuery struct {
 func NewIdxQuery(
 	i *Idx, key []byte, 
 	limit, entrySize, keySize int, 
-	schema pages.PageType, trxId int32,
+	schema pages.PageType, trxId uint64,
 ) *IdxQuery {
-	return &IdxQuery{ i, i.Fd, trxId, key, limit, entrySize, keySize, schema}
+	return &IdxQuery{ i, i.Store, trxId, key, limit, entrySize, keySize, schema}
 }
 
-func (q *IdxQuery) GetTrxId() int32 { return q.trxId }
-func (q *IdxQuery) SetTrxId(id int32) { q.trxId = id }
+func (q *IdxQuery) GetTrxId() uint64 { return q.trxId }
+func (q *IdxQuery) SetTrxId(id uint64) { q.trxId = id }
 func (q *IdxQuery) GetEntrySize() int { return q.entrySize }
 func (q *IdxQuery) getLimit() int { return q.limit }
 func (q *IdxQuery) setLimit(limit int) { q.limit = limit }
@@ -100,11 +100,11 @@ func (q *IdxQuery) freeNode(p BTreeItem) error {
 	lsn, err := q.I.Logger.NewTxn(&axs, &vs, q.GetTrxId())
 	if err != nil { return err }
 	p.SetLsn(lsn)
-	return nil
+	return q.I.Logger.FreePage(q.GetTrxId(), p.GetId())
 }
 
 func (q *IdxQuery) GetRoot() BTreeItem { 
-	start := q.I.MetaPage.Cursor + (SchemaToOrderedInt(q.schema) * 8)
+	start := q.I.metaCursor + (SchemaToOrderedInt(q.schema) * 8)
 	byt := q.I.MetaPage.Body[start: start + 8]
 
 	rootId := binary.LittleEndian.Uint64(byt)
@@ -116,6 +116,8 @@ func (q *IdxQuery) GetRoot() BTreeItem {
 	}
 
 	if rootId == 0 {
+		// only writers get to plant a new root
+		if q.trxId == 0 { return nil }
 		root = new(BTreeLeaf)
 		err := NewBItem(q, root)
 		if err != nil { return nil }
@@ -125,17 +127,18 @@ func (q *IdxQuery) GetRoot() BTreeItem {
 	} else if root == nil {
 
 		buff := q.I.Cache.GetBuffer()
-		_, err := prims.Read(q.fd, buff, int64(rootId) * int64(pages.PAGE_SIZE))
-		if err != nil { return nil }
+		if err := pages.ReadPage(q.store, rootId, buff); err != nil {
+			q.I.Cache.PutBuffer(buff)
+			return nil
+		}
 
-		var root BTreeItem
 		if buff[0] == byte(pages.IDX_LEAF) {
 			root = new(BTreeLeaf)
 		} else {
 			root = new(BTreeNode)
 		}
-		root.init(q.fd, q.entrySize)
 		root.FromBytes(buff)
+		root.init(q.store, q.entrySize)
 
 		q.I.Cache.Set(root)
 	}
@@ -0,0 +1,80 @@
+package logger
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"mydb/core/prims"
+	"mydb/core/types"
+)
+
+const (
+	// Every commit record carries the unix time it was made at in nanoseconds,
+	// records from before that have none
+	COMMIT_TIME_SIZE = 8
+	// added to the name of a segment while it is copied to the archive
+	ARCHIVE_TEMP = ".tmp"
+)
+
+// Copies a segment a checkpoint is done with to the archive,
+// it is synced there before the segment is deleted.
+// The copy is written next to its place and renamed over it once synced,
+// a crash on the way never leaves a short copy of a segment the archive had
+func (l *Logger) archive(seg uint32) error {
+	data, err := l.readSegment(seg)
+	if os.IsNotExist(err) { return nil } // gone already
+	if err != nil { return err }
+	if err = l.vol.Mkdir(l.Archive); err != nil { return err }
+	dest := SegmentPath(l.Archive, seg)
+	if err = writeFile(l.vol, dest + ARCHIVE_TEMP, data); err != nil { return err }
+	if err = l.vol.Rename(dest + ARCHIVE_TEMP, dest); err != nil { return err }
+	return l.vol.SyncDir(l.Archive)
+}
+
+func writeFile(vol prims.Volume, path string, data []byte) error {
+	file, err := vol.Open(path, os.O_RDWR | os.O_CREATE)
+	if err != nil { return err }
+	defer file.Close()
+	if err = file.Truncate(0); err != nil { return err }
+	n, err := file.WriteAt(data, 0)
+	if err != nil { return err }
+	if n < len(data) { return io.ErrShortWrite }
+	return file.Sync()
+}
+
+// When the commit in data was made, 0 if its record has no time
+func CommitTime(a *types.Action, data []byte) int64 {
+	if a.GetVLength() != COMMIT_TIME_SIZE { return 0 }
+	return int64(binary.LittleEndian.Uint64(data[a.Offset:]))
+}
+
+// Walks the log in dir from the start of segment seg and cuts it off
+// at the first commit keep turns down, at is when it was made.
+// The transaction it commits is left unfinished for recovery to undo,
+// the log after it is gone. Returns the lsn of that commit, 0 if all were kept.
+// An error from keep stops the walk and leaves the log as it was
+func CutLog(vol prims.Volume, dir string, seg uint32, keep func(lsn uint64, at int64) (bool, error)) (uint64, error) {
+	var cut *LogRecord
+	var kerr error
+	err := WalkLog(vol, dir, seg, 0, func(r *LogRecord) bool {
+		if r.Flag != types.TxnCommit || r.Action.GetOperation() != types.NONE { return true }
+		ok, err := keep(r.Action.Lsn, r.At)
+		if err != nil {
+			kerr = err
+			return false
+		}
+		if !ok { cut = r }
+		return cut == nil
+	})
+	if err == nil { err = kerr }
+	if err != nil || cut == nil { return 0, err }
+
+	file, err := vol.Open(SegmentPath(dir, cut.Segment), os.O_RDWR)
+	if err != nil { return 0, err }
+	if err = file.Truncate(int64(cut.Offset)); err == nil { err = file.Sync() }
+	file.Close()
+	if err != nil { return 0, err }
+	l := &Logger{ vol: vol, Dir: dir }
+	l.removeAfter(cut.Segment)
+	return cut.Action.Lsn, vol.SyncDir(dir)
+}
@@ -0,0 +1,73 @@
+package logger
+
+import (
+	"encoding/binary"
+	"mydb/core/types"
+)
+
+// Where the log stood when a checkpoint started,
+// records from here on may not be in the data pages yet
+type Mark struct {
+	Segment uint32
+	Offset 	uint32
+	Lsn 	uint64
+	bytes 	uint32
+}
+
+// Only called between transactions, the writer is idle then.
+// False if nothing was logged since the last checkpoint.
+func (l *Logger) Mark() (Mark, bool) {
+	m := Mark{Segment: l.Segment, Offset: l.Offset, Lsn: l.Lsn, bytes: l.ByteCount}
+	return m, l.Lsn != l.lastCheckpoint
+}
+
+// Where the log starts, recovery of the file needs everything from here
+func (l *Logger) Start() Mark {
+	return Mark{Segment: l.oldest, Offset: l.oldestCursor, Lsn: l.oldestLsn}
+}
+
+// Where the log ends once all of it is synced, between transactions
+func (l *Logger) End() (Mark, error) {
+	if !l.readOnly {
+		if err := l.ForceLog(l.Lsn); err != nil { return Mark{}, err }
+	}
+	return Mark{Segment: l.Segment, Offset: l.Offset, Lsn: l.Lsn}, nil
+}
+
+// Logs the checkpoint and moves the start of the log up to the mark,
+// or to where the oldest transaction still open began, recovery needs
+// all of those to finish or undo them.
+// The new start only lives in the meta page, so the segments before it
+// stay until that is on disk, FreeBefore drops them after.
+// Returns the segment the log used to start in.
+func (l *Logger) Checkpoint(m Mark) (uint32, error) {
+	trxId := l.NextTrxId()
+	axs, vs := make([]*types.Action, 1), make([]*[]byte, 1)
+	val := binary.LittleEndian.AppendUint64(nil, m.Lsn)
+	axs[0], vs[0] = types.AtomicAx(types.CHECKPOINT, types.NLBlob, 0, 8), &val
+	lsn, err := l.NewTxn(&axs, &vs, trxId, types.TxnCommit)
+	l.forget(trxId)
+	if err != nil { return 0, err }
+	if err = l.ForceLog(lsn); err != nil { return 0, err }
+	l.lastCheckpoint = lsn
+
+	start := m
+	for _, s := range l.trxStarts {
+		if s.Lsn < start.Lsn { start = s }
+	}
+	oldest := l.oldest
+	l.oldest, l.oldestCursor, l.oldestLsn = start.Segment, start.Offset, start.Lsn
+	// counted from the new start from here on
+	l.ByteCount -= start.bytes
+	for id, s := range l.trxStarts {
+		s.bytes -= start.bytes
+		l.trxStarts[id] = s
+	}
+	l.writeState()
+	return oldest, nil
+}
+
+// Deletes the segments from oldest up to the one the log starts in now
+func (l *Logger) FreeBefore(oldest, start uint32) error {
+	return l.removeSegments(oldest, start)
+}
@@ -2,124 +2,221 @@ package logger
 
 import (
 	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"time"
 	"mydb/core/pages"
+	"mydb/core/prims"
 	"mydb/core/types"
 )
 
-var (
-	LOGGER_HEADER_SIZE = pages.PAGE_SIZE
-)
 const (
-	// once this is hit we free up the log space
-	LogThreshold = 1024 * 1024 * 40 // 40MB
+	// once this is hit a checkpoint frees up the log space
+	LogThreshold = 1024 * 1024 * 40 // 40MB, default for a checkpoint
 
 	// add 22 bytes as padding so logger slots are easier to manage
 	// length, trxId, begin, commit.
-	TxHeaderLength = 4 + 4 + 1 + 1 + 22 
+	TxHeaderLength = 4 + 4 + 1 + 1 + 22
+
+	// LOGGER STATE ON THE META PAGE
+	// offsets are relative to the cursor handed to StartLogger
+	LOG_OLDEST_OFF 	 	= 0  // segment of the oldest record
+	LOG_OLDEST_CUR_OFF 	= 4  // offset of the oldest record in it
+	LOG_OLDEST_LSN_OFF 	= 8  // lsn before the oldest record
+	LOG_TRX_OFF 		= 16 // last transaction id handed out, uint32 before format 2
+	LOG_STATE_SIZE 	 	= 32
+
+	// GROUP COMMIT DEFAULTS
+	GROUP_WINDOW = 2 * time.Millisecond
+	GROUP_SIZE = 64
 )
 
+// a read only open cant replay the log into the file
+var ErrNeedsRecovery = errors.New("Database was not closed cleanly, open it for writing to recover it")
+
 type Logger struct {
-	HeaderId uint64
-	Fd int
+	Dir string // where the segments live
+	Archive string // where they go once a checkpoint is done with them, "" deletes them
+	Compress bool // deflates the page images
 	RecoverChan chan *[]*types.Action
+	UndoChan chan uint64
 	Lsn uint64
+	flushedLsn atomic.Uint64 // everything up to here is on disk
 
 	WriterIn chan *Record
 	WriterOut chan error
 
-	pendingTrxs map[int32][]*types.Action
+	Durability types.Durability
+	PageSize uint16 // turns the byte offsets in records into page ids
+	groupIn chan *waiter
+
+	pendingTrxs map[uint64][]*types.Action
+	trxStarts map[uint64]Mark // where each pending transaction began, the log cant start after
+	lastTrx atomic.Uint64
 	GetPageLike func(uint64) (types.PageLike, error)
 
 	db types.DatabaseI
-	Page *pages.Page
+	vol prims.Volume // where the segments are
+	metaPage *pages.Page
+	metaCursor uint16
+
+	// the segment being appended to
+	Segment uint32
+	Offset uint32 // end of the log, buffered records included
+	written uint32 // end of what was handed to the file
+	seg prims.Storage
+	buff []byte // records not written out yet
+	// blocks of an encrypted volume, a synced block is never written
+	// again, the log goes on in the next one. 0 for plain files
+	align uint32
+	// a failed fsync may have dropped what it was syncing,
+	// the log cant be trusted again until a restart recovers it
+	syncErr error
+	// a segment recovery couldnt read, the log is left as it is
+	recoverErr error
+
+	// segment values are read back from
+	reader prims.Storage
+	readerSeg uint32
 
-	Offset uint16
 	ByteCount uint32
-	oldest uint64
-	oldestCursor uint16
-
-	buff []byte
+	oldest uint32
+	oldestCursor uint32
+	oldestLsn uint64
+	lastCheckpoint uint64 // lsn of the last checkpoint record
+
+	// only reads, recovery just looks for commits the file is behind on
+	readOnly bool
+	behind bool
+	// reads next to a writer, its log is still growing
+	shared bool
 }
 
-// LOGGER DOESNT NEED A FREE PAGE LIST
-// BECAUSE YOU DELETE PAGES WHOLESALE
-// YOU DONT DELETE INDIVIDUAL ENTRIES
-func StartLogger( 
-	db types.DatabaseI, metaPage *pages.Page, 
+// The log lives in its own segment files, only where it starts
+// is kept on the meta page. Old segments are deleted wholesale
+// by checkpoints so there is no free list.
+func StartLogger(
+	db types.DatabaseI, metaPage *pages.Page,
 	getPLike func(uint64) (types.PageLike, error),
+	dur types.Durability, readOnly bool,
 ) (*Logger, error) {
+	if dur.Mode == types.GROUP_COMMIT {
+		if dur.Window <= 0 { dur.Window = GROUP_WINDOW }
+		if dur.GroupSize <= 0 { dur.GroupSize = GROUP_SIZE }
+	}
 	l := &Logger{
-		Fd: db.GetFd(), 
+		Dir: LogDir(db.GetPath()),
 		db: db,
+		PageSize: db.GetPageSize(),
 		GetPageLike: getPLike,
-		Page: nil, Offset: 0, ByteCount: 0,
-		oldest: 0, oldestCursor: 0,
+		Durability: dur,
+		groupIn: make(chan *waiter, GROUP_SIZE),
+		vol: db.GetVolume(),
+		align: blockSize(db.GetVolume()),
+		metaPage: metaPage,
+		metaCursor: metaPage.Cursor,
 		WriterIn: make(chan *Record, 1),
 		WriterOut: make(chan error, 1),
 		RecoverChan: make(chan *[]*types.Action, 1),
-		pendingTrxs: make(map[int32][]*types.Action),
-		buff: make([]byte, pages.PAGE_SIZE),
+		UndoChan: make(chan uint64, 1),
+		pendingTrxs: make(map[uint64][]*types.Action),
+		trxStarts: make(map[uint64]Mark),
+		buff: make([]byte, 0, db.GetPageSize()),
 	}
-	var err error
-	id := binary.LittleEndian.Uint64(metaPage.Body[metaPage.Cursor:])
-	if id <= 0 {
-		id, err = db.ClaimFreePage(pages.LOGGER_PAGE)
-		if err != nil { return nil, err }
-		binary.LittleEndian.PutUint32(metaPage.Body[metaPage.Cursor:], uint32(id))
+	if dur.Mode == types.GROUP_COMMIT { go l.groupCommit() }
+
+	state := metaPage.Body[l.metaCursor:]
+	l.oldest = binary.LittleEndian.Uint32(state[LOG_OLDEST_OFF:])
+	l.oldestCursor = binary.LittleEndian.Uint32(state[LOG_OLDEST_CUR_OFF:])
+	l.oldestLsn = binary.LittleEndian.Uint64(state[LOG_OLDEST_LSN_OFF:])
+	l.lastTrx.Store(binary.LittleEndian.Uint64(state[LOG_TRX_OFF:]))
+	metaPage.Cursor += LOG_STATE_SIZE
+
+	if readOnly {
+		// nothing gets written. What a writer at work committed since its
+		// checkpoint is replayed into memory the database keeps over the
+		// file, what it still has open is its own business. The tail it
+		// is writing ends the log like a torn one would.
+		// Without a writer a log that has more than the file is refused
+		l.readOnly = true
+		l.shared = db.HasWriter()
+		close(l.UndoChan)
+		if l.oldest == 0 {
+			close(l.RecoverChan)
+			return l, nil
+		}
+		if l.shared {
+			go l.StartupRecovery()
+			return l, nil
+		}
+		losers := l.StartupRecovery()
+		if l.recoverErr != nil { return nil, l.recoverErr }
+		if len(losers) > 0 || l.behind { return nil, ErrNeedsRecovery }
+		return l, nil
 	}
-	metaPage.Cursor += 4 // pass through the pageId
-	l.Offset = binary.LittleEndian.Uint16(metaPage.Body[metaPage.Cursor:])
-	metaPage.Cursor += 2 // pass through the offset
-	l.ByteCount = binary.LittleEndian.Uint32(metaPage.Body[metaPage.Cursor:])
-	metaPage.Cursor += 4 // pass through the byteCount
-	l.oldest = binary.LittleEndian.Uint64(metaPage.Body[metaPage.Cursor:])
-	metaPage.Cursor += 4 // pass through the oldest pageId
-	l.oldestCursor = binary.LittleEndian.Uint16(metaPage.Body[metaPage.Cursor:])
-	metaPage.Cursor += 2 // pass through the oldest cursor
-
-	// Load into the logger
-	buff := make([]byte, pages.PAGE_SIZE)
-	l.Page, err = pages.LoadPage(l.Fd, id, buff)
-	if err != nil { return nil, err }
-
-	if l.oldest != 0 { l.StartupRecovery()
-	} else { l.oldest = l.Page.PageId }
-
-	go l.StartWriter()
-	return l, nil
-}
 
-func (l *Logger) Close() {
-	buff := make([]byte, pages.PAGE_SIZE)
-	meta, err := pages.LoadPage(l.Fd, l.HeaderId, buff)
-	if err != nil { return }
-	// Write current info to the meta page
-	binary.LittleEndian.PutUint16(meta.Body[0:2], l.Offset)
-	binary.LittleEndian.PutUint32(meta.Body[2:6], l.ByteCount)
-	binary.LittleEndian.PutUint32(meta.Body[6:10], uint32(l.Page.PageId))
-	binary.LittleEndian.PutUint32(meta.Body[10:14], uint32(l.oldest))
-	binary.LittleEndian.PutUint16(meta.Body[14:16], l.oldestCursor)
-}
+	if err := l.vol.Mkdir(l.Dir); err != nil { return nil, err }
 
+	if l.oldest == 0 {
+		// brand new log, persist where it starts
+		// so that recovery can always find it
+		l.oldest = 1
+		if err := l.openSegment(l.oldest, 0); err != nil { return nil, err }
+		l.removeAfter(l.oldest)
 
-func (l *Logger) NewPage() (*pages.Page, error) {
-	pageId, err := l.db.ClaimFreePage(pages.LOGGER_PAGE)
-	if err != nil { return nil, err }
+		l.writeState()
+		if err := db.WriteMeta(); err != nil { return nil, err }
 
-	newPage, err := pages.LoadPage(l.Fd, pageId, l.buff)
-	if err != nil { return nil, err }
+		close(l.RecoverChan)
+		close(l.UndoChan)
+		go l.StartWriter()
+		return l, nil
+	}
 
-	// point current page to the next
-	l.Page.Next = pageId
-	l.Offset = 0
+	// Recovery finds the end of the log and opens the segment there,
+	// the unfinished transactions are undone once the writer runs
+	// so their cancel can be logged
+	go func() {
+		losers := l.StartupRecovery()
+		go l.StartWriter()
+		for _, trxId := range losers { l.UndoChan <- trxId }
+		close(l.UndoChan)
+	}()
+	return l, nil
+}
 
-	return newPage, nil
+func (l *Logger) writeState() {
+	state := l.metaPage.Body[l.metaCursor:]
+	binary.LittleEndian.PutUint32(state[LOG_OLDEST_OFF:], l.oldest)
+	binary.LittleEndian.PutUint32(state[LOG_OLDEST_CUR_OFF:], l.oldestCursor)
+	binary.LittleEndian.PutUint64(state[LOG_OLDEST_LSN_OFF:], l.oldestLsn)
+	// ids used since are in the log, recovery picks up from the highest
+	binary.LittleEndian.PutUint64(state[LOG_TRX_OFF:], l.lastTrx.Load())
 }
 
-func (l *Logger) NewFreePage(p types.PageLike) error {
-	return l.db.NewFreePage(p)
+// Stops the writer once what it has is synced and puts the log state
+// on the meta page, writing that out is left to the database.
+// Nothing can be logged after
+func (l *Logger) Close() error {
+	var err error
+	if !l.readOnly {
+		err = l.ForceLog(l.Lsn)
+		if l.Durability.Mode == types.GROUP_COMMIT { close(l.groupIn) }
+		close(l.WriterIn)
+		// Write current info to the meta page
+		l.writeState()
+	}
+	if l.seg != nil { l.seg.Close() }
+	if l.reader != nil { l.reader.Close() }
+	l.seg, l.reader = nil, nil
+	return err
 }
 
+func (l *Logger) FlushedLsn() uint64 { return l.flushedLsn.Load() }
+
+// Why recovery stopped short of the end of the log, read once RecoverChan is closed
+func (l *Logger) RecoveryErr() error { return l.recoverErr }
+
 func (l *Logger) NextLsn() uint64 {
 	l.Lsn++
 	return l.Lsn
@@ -0,0 +1,178 @@
+package logger
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"testing"
+	"mydb/core/pages"
+	"mydb/core/prims"
+	"mydb/core/types"
+)
+
+// A log in memory with its writer running, no database behind it
+func testLogger(t *testing.T) *Logger {
+	t.Helper()
+	l := &Logger{
+		Dir: "test.wal",
+		vol: prims.NewMemVolume(),
+		PageSize: pages.DEFAULT_PAGE_SIZE,
+		metaPage: &pages.Page{ Body: make([]byte, LOG_STATE_SIZE) },
+		WriterIn: make(chan *Record, 1),
+		WriterOut: make(chan error, 1),
+		pendingTrxs: make(map[uint64][]*types.Action),
+		trxStarts: make(map[uint64]Mark),
+		oldest: 1,
+	}
+	if err := l.vol.Mkdir(l.Dir); err != nil { t.Fatalf("Failed to make the log dir: %v", err) }
+	if err := l.openSegment(1, 0); err != nil { t.Fatalf("Failed to open the segment: %v", err) }
+	go l.StartWriter()
+	t.Cleanup(func() { close(l.WriterIn) })
+	return l
+}
+
+// Logs one insert of value under trxId, the transaction stays open
+func logInsert(t *testing.T, l *Logger, trxId uint64, value []byte) {
+	t.Helper()
+	axs := []*types.Action{ types.InsertAx(types.NLBlob, 1, uint16(len(value))) }
+	if _, err := l.NewTxn(&axs, &[]*[]byte{&value}, trxId); err != nil { t.Fatalf("Failed to log: %v", err) }
+}
+
+// Every record in the log with its transaction
+func walk(t *testing.T, l *Logger) []*LogRecord {
+	t.Helper()
+	if err := l.ForceLog(l.Lsn); err != nil { t.Fatalf("Failed to sync the log: %v", err) }
+	var recs []*LogRecord
+	err := WalkLog(l.vol, l.Dir, l.oldest, int(l.oldestCursor), func(r *LogRecord) bool {
+		recs = append(recs, r)
+		return true
+	})
+	if err != nil { t.Fatalf("Failed to walk the log: %v", err) }
+	return recs
+}
+
+// The card a build before format 2 wrote for the wide one, a 4 byte id
+func narrowCard(wide []byte, value []byte) []byte {
+	card := make([]byte, TRX_SIZE - NARROW_GAP)
+	card[REC_BEGIN_OFF] = byte(types.TxnBegin)
+	copy(card[REC_TRX_OFF:], wide[REC_TRX_OFF:REC_TRX_OFF + 4])
+	copy(card[REC_LSN_OFF - NARROW_GAP:], wide[REC_LSN_OFF:REC_CRC_OFF])
+	crc := crc32.Update(crc32.Checksum(card[:REC_CRC_OFF - NARROW_GAP], crcTable), crcTable, value)
+	binary.LittleEndian.PutUint32(card[REC_CRC_OFF - NARROW_GAP:], crc)
+	return card
+}
+
+func Test_RecordCards(t *testing.T) {
+	l := testLogger(t)
+	value := []byte("value")
+	logInsert(t, l, 7, value)
+	// past what 4 bytes hold
+	logInsert(t, l, 1 << 40, value)
+	recs := walk(t, l)
+	if len(recs) != 2 || recs[0].TrxId != 7 || recs[1].TrxId != 1 << 40 { t.Fatalf("Read back %d records", len(recs)) }
+
+	// a log upgraded to format 2 has the narrow cards first
+	data, err := l.readSegment(1)
+	if err != nil { t.Fatalf("Failed to read the segment: %v", err) }
+	wide := data[:TRX_SIZE + len(value)]
+	log := append(narrowCard(wide, value), value...)
+	log = append(log, data[len(wide):]...)
+
+	trxId, a, flag, next, err := l.ReadAction(log, 0)
+	if err != nil || trxId != 7 || a.Lsn != 1 || flag != types.TxnPending { t.Fatalf("Narrow card read as trx %d, err %v", trxId, err) }
+	if string(log[a.Offset:next]) != "value" { t.Fatalf("Narrow card has value %q", log[a.Offset:next]) }
+	trxId, a, _, next, err = l.ReadAction(log, next)
+	if err != nil || trxId != 1 << 40 || a.Lsn != 2 || next != len(log) { t.Fatalf("Wide card after a narrow one read as trx %d, err %v", trxId, err) }
+
+	// a bit flipped anywhere in it fails the crc
+	for _, at := range []int{ REC_TRX_OFF, REC_LSN_OFF - NARROW_GAP, TRX_SIZE - NARROW_GAP } {
+		log[at] ^= 1
+		if _, _, _, _, err := l.ReadAction(log, 0); err == nil { t.Fatalf("Read a narrow card flipped at %d", at) }
+		log[at] ^= 1
+	}
+	log[REC_BEGIN_OFF] = 0
+	if _, _, _, _, err := l.ReadAction(log, 0); err == nil { t.Fatalf("Read a card without a begin flag") }
+}
+
+func commit(t *testing.T, l *Logger, trxId uint64) {
+	t.Helper()
+	errc := make(chan error, 1)
+	l.CommitTxn(trxId, func(err error) { errc <- err })
+	if err := <-errc; err != nil { t.Fatalf("Failed to commit %d: %v", trxId, err) }
+}
+
+func Test_CutLog(t *testing.T) {
+	l := testLogger(t)
+	for trxId := uint64(1); trxId <= 3; trxId++ {
+		logInsert(t, l, trxId, []byte("value"))
+		commit(t, l, trxId)
+	}
+	recs := walk(t, l)
+	if len(recs) != 6 { t.Fatalf("Logged %d records", len(recs)) }
+	for i := 1; i < len(recs); i += 2 {
+		if recs[i].Flag != types.TxnCommit || recs[i].At == 0 { t.Fatalf("Commit %d has no time", recs[i].TrxId) }
+	}
+
+	// an error leaves every record where it was
+	refused := errors.New("refused")
+	_, err := CutLog(l.vol, l.Dir, 1, func(lsn uint64, at int64) (bool, error) { return false, refused })
+	if !errors.Is(err, refused) { t.Fatalf("Cut the log past an error, err %v", err) }
+	if n := len(walk(t, l)); n != 6 { t.Fatalf("Failed cut left %d records", n) }
+
+	// the second commit and everything after it goes, its insert is left unfinished
+	lsn, err := CutLog(l.vol, l.Dir, 1, func(lsn uint64, at int64) (bool, error) { return lsn < recs[3].Action.Lsn, nil })
+	if err != nil || lsn != recs[3].Action.Lsn { t.Fatalf("Cut at lsn %d, err %v", lsn, err) }
+	kept := walk(t, l)
+	if len(kept) != 3 || kept[2].TrxId != 2 || kept[2].Flag != types.TxnPending { t.Fatalf("Cut left %d records", len(kept)) }
+
+	// all kept, nothing cut
+	lsn, err = CutLog(l.vol, l.Dir, 1, func(lsn uint64, at int64) (bool, error) { return true, nil })
+	if err != nil || lsn != 0 || len(walk(t, l)) != 3 { t.Fatalf("Cut at lsn %d keeping all, err %v", lsn, err) }
+}
+
+func Test_CheckpointStart(t *testing.T) {
+	l := testLogger(t)
+	open, done := l.NextTrxId(), l.NextTrxId()
+	logInsert(t, l, open, []byte("open"))
+	logInsert(t, l, done, []byte("done"))
+	commit(t, l, done)
+
+	// the open transaction holds the start of the log where it began
+	m, _ := l.Mark()
+	if _, err := l.Checkpoint(m); err != nil { t.Fatalf("Failed to checkpoint: %v", err) }
+	if s := l.Start(); s.Segment != 1 || s.Offset != 0 || s.Lsn != 0 { t.Fatalf("Log starts at %+v with a transaction open", s) }
+	if l.ByteCount != l.Offset { t.Fatalf("Counted %d bytes of %d", l.ByteCount, l.Offset) }
+
+	// once it is done the next checkpoint moves it to its mark
+	commit(t, l, open)
+	m, _ = l.Mark()
+	if _, err := l.Checkpoint(m); err != nil { t.Fatalf("Failed to checkpoint: %v", err) }
+	if s := l.Start(); s.Offset != m.Offset || s.Lsn != m.Lsn { t.Fatalf("Log starts at %+v, not the mark %+v", s, m) }
+	if l.ByteCount != l.Offset - m.Offset { t.Fatalf("Counted %d bytes past the mark, not %d", l.ByteCount, l.Offset - m.Offset) }
+	state := l.metaPage.Body
+	if binary.LittleEndian.Uint32(state[LOG_OLDEST_CUR_OFF:]) != m.Offset || binary.LittleEndian.Uint64(state[LOG_OLDEST_LSN_OFF:]) != m.Lsn {
+		t.Fatalf("Meta page has another start than the log")
+	}
+	recs := walk(t, l)
+	if len(recs) != 1 || recs[0].Action.GetOperation() != types.CHECKPOINT { t.Fatalf("%d records past the start", len(recs)) }
+}
+
+// Redo cant go on without the value of a record
+func Test_GetValue(t *testing.T) {
+	l := testLogger(t)
+	logInsert(t, l, 1, []byte("value"))
+	recs := walk(t, l)
+	a := recs[0].Action
+	if val, err := l.GetValue(a); err != nil || string(val) != "value" { t.Fatalf("Read value %q, err %v", val, err) }
+
+	moved := *a
+	moved.Segment = 9
+	if _, err := l.GetValue(&moved); !errors.Is(err, os.ErrNotExist) { t.Fatalf("Read a value from a missing segment, err %v", err) }
+	moved = *a
+	moved.Offset = l.Offset - 2
+	if _, err := l.GetValue(&moved); !errors.Is(err, io.ErrUnexpectedEOF) { t.Fatalf("Read a value past the end, err %v", err) }
+	// a value shorter than a page is a deflated image, this one isnt
+	if _, err := l.PageImage(a); err == nil { t.Fatalf("Took %d bytes for a page image", a.GetVLength()) }
+}
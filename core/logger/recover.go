@@ -4,7 +4,12 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
 	"mydb/core/pages"
+	"mydb/core/prims"
 	"mydb/core/types"
 )
 
@@ -16,159 +21,279 @@ import (
 // we can still just replay the action and derive a different state
 
 
-const TRX_SIZE = types.ACTION_SIZE + 2 + 4 // + comit flags + 4 bytes for trxId
+const (
+	// RECORD CARD, the value follows it
+	REC_BEGIN_OFF 	= 0
+	REC_TRX_OFF 	= 1
+	REC_LSN_OFF 	= 9
+	REC_ACTION_OFF 	= 17
+	REC_COMMIT_OFF 	= REC_ACTION_OFF + types.ACTION_SIZE
+	REC_CRC_OFF 	= REC_COMMIT_OFF + 1 // covers the card and the value
+	TRX_SIZE 		= REC_CRC_OFF + 4
 
+	// The begin byte tells the cards apart. Before format 2 it was TxnBegin
+	// and the id took 4 bytes, everything after it sits NARROW_GAP earlier.
+	// A log can hold both, the ones a file was upgraded with come first
+	REC_WIDE 	byte = 124
+	NARROW_GAP 	= 4
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errOutOfOrder = errors.New("Record doesnt follow the one before")
 
-func (l *Logger) StartupRecovery() {
-	p, err := pages.LoadPage(l.Fd, l.oldest, l.buff)
-	if err != nil { return }
 
-	cursor := int(l.oldestCursor)
-	pending := make(map[int32][]*types.Action)
-	var next uint64
+// Walks the log from the oldest record and hands every committed
+// transaction, in commit order, to whoever reads RecoverChan.
+// Transactions that committed before the last checkpoint are
+// already on disk and skipped.
+// The ones that never finished are left pending and returned
+// newest first, the order they have to be undone in.
+// Once the end of the log is found the writer is set up to continue there.
+// A segment that is there but cant be read ends it with RecoveryErr set
+func (l *Logger) StartupRecovery() []uint64 {
 	defer close(l.RecoverChan)
 
-	for {
-		if cursor + TRX_SIZE >= len(p.Body) {
-			// no more actions in this Page
-			if p.Next == 0 { break }
-			cursor = cursor % len(p.Body)
-			// load the next Page
-			p, err = pages.LoadPage(l.Fd, next, l.buff)
-			if err != nil { return }
+	seg, cursor := l.oldest, int(l.oldestCursor)
+	lsn := l.oldestLsn
+	redo := l.db.GetCheckpoint()
+	pending := make(map[uint64][]*types.Action)
+	starts := make(map[uint64]Mark)
+
+	// a missing segment is an empty log
+	data, err := l.readSegment(seg)
+	if err != nil && !errors.Is(err, os.ErrNotExist) { l.recoverErr = err }
+	cursor = min(cursor, len(data))
+
+	for l.recoverErr == nil {
+		// read the action, anything unreadable is the end of the log,
+		// so is a record left over from an older use of the file
+		trxId, action, commitFlag, next, err := l.ReadAction(data, cursor)
+		if err == nil && action.Lsn != lsn + 1 { err = errOutOfOrder }
+		if err != nil {
+			// the rest of a block a sync left is empty, or torn
+			if next, ok := l.nextBlock(cursor); ok {
+				if next < len(data) {
+					cursor = next
+					continue
+				}
+				cursor = len(data)
+			}
+			// only a segment read to its end carries on in the next
+			if cursor < len(data) { break }
+			more, err := l.readSegment(seg + 1)
+			if err != nil {
+				if !errors.Is(err, os.ErrNotExist) { l.recoverErr = err }
+				break
+			}
+			seg, data, cursor = seg + 1, more, 0
+			continue
 		}
+		if _, ok := pending[trxId]; !ok {
+			starts[trxId] = Mark{Segment: seg, Offset: uint32(cursor), Lsn: lsn, bytes: l.ByteCount}
+		}
+		lsn = action.Lsn
+		if trxId > l.lastTrx.Load() { l.lastTrx.Store(trxId) }
+		action.Segment = seg
+		// it was read back so it is on disk
+		l.flushedLsn.Store(lsn)
+		l.ByteCount += uint32(next - cursor)
 
-		// read the action
-		trxId, action, commitFlag, err := l.ReadAction(p.GetId(), &cursor)
-		if err != nil { return }
+		// pages that show up in the log are in use no matter what
+		if pageId, ok := action.GetPageId(l.PageSize); ok { l.db.MarkClaimed(pageId) }
 
 		switch commitFlag {
 			case types.TxnCommit:
-				// commit the action
-				if acts, ok := pending[trxId]; ok {
-					l.RecoverChan <- &acts
-					delete(pending, trxId)
-				} else {
-					// commit the action
-					acts := []*types.Action{action}
-					l.RecoverChan <- &acts
+				// commit the actions
+				acts := append(pending[trxId], action)
+				delete(pending, trxId)
+				if action.GetOperation() == types.CHECKPOINT {
+					l.lastCheckpoint = lsn
+					break
+				}
+				if lsn <= redo { break }
+				if l.readOnly && !l.shared {
+					l.behind = true
+					break
+				}
+				// the checkpoint wrote out the free list as it was before
+				for _, a := range acts {
+					if a.GetOperation() == types.FREEPAGE { l.db.NewFreePage(uint64(a.GetDest())) }
 				}
+				l.RecoverChan <- &acts
 			case types.TxnPending:
 				// add to pending list
-				if _, ok := pending[trxId]; !ok {
-					acts := []*types.Action{action}
-					pending[trxId] = acts
-				}
 				pending[trxId] = append(pending[trxId], action)
-
-			default: return
-		}
-	}
-	for _, acts := range pending {
-		// these are all pending actions that didnt get committed
-		for _, act := range acts {
-			// if we took a new page, we need to return it
-			if act.GetOperation() == types.NEWPAGE {
-				// return the page to the database
-				page, err := pages.LoadPage(l.Fd, uint64(act.GetDest())/ uint64(pages.PAGE_SIZE), l.buff)
-				if err != nil { return }
-				if err = l.db.NewFreePage(page); err != nil { return }
-			}
-			// otherwise I dont think there is anything to do here
+			case types.TxnCancel:
+				// nothing of it is replayed, the pages it claimed went
+				// back on the free list after the checkpoint did
+				for _, a := range pending[trxId] {
+					if a.GetOperation() != types.NEWPAGE { continue }
+					l.db.NewFreePage(uint64(a.GetDest()))
+				}
+				delete(pending, trxId)
 		}
+		cursor = next
 	}
-}
-
-
-func (l *Logger) TruncateLogs() {
-	// this skips ... begin flag, opcode, destOffset, vtype, vlength
-	fmt.Println("CALLED TRUNCATE LOGS")
-
-	var length uint16
-	var next uint64
-	cursor := int(l.oldestCursor)
-	for l.ByteCount > LogThreshold/4 {
-		page, err := pages.LoadPage(l.Fd, l.oldest, l.buff)
-		if err != nil { return }
-
-		for {
-			cursor += TRX_SIZE
-			if cursor <= len(page.Body) { break }
-
-			length = binary.LittleEndian.Uint16(page.Body[cursor-3:cursor])
 
-			cursor += int(length)
-
-			if cursor >= len(page.Body) { break }
-		}
-
-		l.ByteCount -= uint32(cursor - (cursor % int(pages.PAGE_SIZE)))
-		cursor = cursor % int(pages.PAGE_SIZE)
+	// the rest of the log may be in a segment that cant be read,
+	// nothing is cut off or undone and the log takes no writes
+	if l.recoverErr != nil {
+		l.Lsn = lsn
+		l.flushedLsn.Store(lsn)
+		return nil
+	}
 
-		if page.Next == 0 { break }
-		l.oldest = next
-		l.oldestCursor = uint16(cursor)
+	// the writer picks up where the log ends, a torn write
+	// past that is cut off so it never passes for a record.
+	// If the segment cant be opened every write fails.
+	if !l.readOnly {
+		l.openSegment(seg, uint32(cursor))
+		l.removeAfter(seg)
+	} else {
+		l.Segment, l.Offset = seg, uint32(cursor)
+	}
+	l.Lsn = lsn
 
-		if err := l.db.NewFreePage(page); err != nil { return }
+	// whatever these touched has to be put back
+	losers := make([]uint64, 0, len(pending))
+	for trxId, acts := range pending {
+		l.pendingTrxs[trxId] = acts
+		l.trxStarts[trxId] = starts[trxId]
+		losers = append(losers, trxId)
 	}
+	slices.Sort(losers)
+	slices.Reverse(losers)
+	return losers
 }
 
-func (l *Logger) ReadAction(pageId uint64, c *int) (int32, *types.Action, types.LogFlag, error) {
-	p, err := pages.LoadPage(l.Fd, pageId, l.buff)
-	if err != nil { return 0, nil, 0, err }
-	cursor := *c
-
-	// read begin flag
-	if p.Body[cursor] != byte(types.TxnBegin) {
-		return 0, nil, 0, errors.New("Invalid begin flag")
+// Reads the record at cursor and checks it against its crc.
+// Returns the cursor the next record starts at.
+func (l *Logger) ReadAction(data []byte, cursor int) (
+	uint64, *types.Action, types.LogFlag, int, error,
+) {
+	if cursor >= len(data) { return 0, nil, 0, 0, errors.New("End of the log") }
+	gap := 0
+	switch data[cursor] {
+		case REC_WIDE:
+		case byte(types.TxnBegin): gap = NARROW_GAP
+		default: return 0, nil, 0, 0, errors.New("Invalid begin flag")
 	}
-	cursor++
-
-	// read trxID
-	trxId := int32(binary.LittleEndian.Uint32(p.Body[cursor:cursor+4]))
-	if trxId == 0 { return 0, nil, 0, errors.New("Invalid trxId") }
-	cursor += 4
+	if cursor + TRX_SIZE - gap > len(data) { return 0, nil, 0, 0, errors.New("End of the log") }
+	card := data[cursor:cursor+TRX_SIZE-gap]
+	trxId := binary.LittleEndian.Uint64(card[REC_TRX_OFF:])
+	if gap != 0 { trxId = uint64(binary.LittleEndian.Uint32(card[REC_TRX_OFF:])) }
+	if trxId == 0 { return 0, nil, 0, 0, errors.New("Invalid trxId") }
 
 	// read action body
 	action := &types.Action{}
-	action.SetRaw(p.Body[cursor:cursor+types.ACTION_SIZE])
-	cursor += types.ACTION_SIZE
+	raw := make([]byte, types.ACTION_SIZE)
+	copy(raw, card[REC_ACTION_OFF-gap:REC_COMMIT_OFF-gap])
+	action.SetRaw(raw)
+	action.Lsn = binary.LittleEndian.Uint64(card[REC_LSN_OFF-gap:])
 
 	// Check for invalid action
-	if err = action.Validate(); err != nil { return 0, nil, 0, err }
+	if err := action.Validate(); err != nil { return 0, nil, 0, 0, err }
 
-	// read the commit flag
-	commitFlag := types.LogFlag(p.Body[cursor])
-	cursor++
+	commitFlag := types.LogFlag(card[REC_COMMIT_OFF-gap])
+	cursor += len(card)
+	end := cursor + int(action.GetVLength())
+	if end > len(data) { return 0, nil, 0, 0, errors.New("Value cut short") }
 
-	// skip the length of the value
-	cursor += int(action.GetVLength())
+	crc := crc32.Checksum(card[:REC_CRC_OFF-gap], crcTable)
+	crc = crc32.Update(crc, crcTable, data[cursor:end])
+	if crc != binary.LittleEndian.Uint32(card[REC_CRC_OFF-gap:]) {
+		return 0, nil, 0, 0, errors.New("Record checksum mismatch")
+	}
+	action.Offset = uint32(cursor)
 
-	return trxId, action, commitFlag, nil
+	return trxId, action, commitFlag, end, nil
 }
 
-func (l *Logger) GetValue(a *types.Action) []byte {
-	var err error
-	page := l.Page
-	val := make([]byte, a.GetVLength())
-	read := 0
-	toGo := int(a.GetVLength())
-	cursor := int(a.Offset)
-
-	for read < toGo {
-		if cursor+toGo > len(page.Body) {
-			copyLen := len(page.Body) - cursor
-			copy(val[read:read+copyLen], page.Body[cursor:cursor+copyLen])
-			read += copyLen
-			toGo -= copyLen
-			page, err = pages.LoadPage(l.Fd, page.Next, l.buff)
+// A record as the log has it
+type LogRecord struct {
+	Segment uint32
+	Offset 	int // where its card starts in the segment
+	TrxId 	uint64
+	Flag 	types.LogFlag
+	Action 	*types.Action
+	Value 	[]byte
+	At 		int64 // when a commit was made, 0 for the rest
+}
+
+// Walks the log in dir from cursor in segment seg on and hands every record
+// to visit until it returns false. The log ends where recovery finds it ending,
+// only a first segment that cant be read is an error
+func WalkLog(vol prims.Volume, dir string, seg uint32, cursor int, visit func(r *LogRecord) bool) error {
+	l := &Logger{ vol: vol, Dir: dir, align: blockSize(vol) }
+	data, err := l.readSegment(seg)
+	if err != nil { return err }
+	cursor = min(cursor, len(data))
+	lsn := uint64(0)
+	for {
+		trxId, action, flag, next, err := l.ReadAction(data, cursor)
+		if err == nil && lsn != 0 && action.Lsn != lsn + 1 { err = errOutOfOrder }
+		if err != nil {
+			// the rest of a block a sync left is empty, or torn
+			if next, ok := l.nextBlock(cursor); ok {
+				if next < len(data) {
+					cursor = next
+					continue
+				}
+				cursor = len(data)
+			}
+			// only a segment read to its end carries on in the next
+			if cursor < len(data) { return nil }
+			more, err := l.readSegment(seg + 1)
 			if err != nil { return nil }
-			cursor = 0
-		} else {
-			copy(val[read:read+toGo], page.Body[cursor:cursor+toGo])
-			read += toGo
-			break
+			seg, data, cursor = seg + 1, more, 0
+			continue
+		}
+		lsn = action.Lsn
+		action.Segment = seg
+		r := &LogRecord{ Segment: seg, Offset: cursor, TrxId: trxId, Flag: flag, Action: action, Value: data[action.Offset:next] }
+		if flag == types.TxnCommit && action.GetOperation() == types.NONE { r.At = CommitTime(action, data) }
+		if !visit(r) { return nil }
+		cursor = next
+	}
+}
+
+// Reads the value of an action back out of the log,
+// only records that were written out can be read
+func (l *Logger) GetValue(a *types.Action) ([]byte, error) {
+	val := make([]byte, a.GetVLength())
+	if len(val) == 0 { return val, nil }
+	if l.reader == nil || l.readerSeg != a.Segment {
+		if l.reader != nil { l.reader.Close() }
+		file, err := l.vol.Open(l.SegmentPath(a.Segment), os.O_RDONLY)
+		if err != nil {
+			l.reader = nil
+			return nil, err
 		}
+		l.reader, l.readerSeg = file, a.Segment
+	}
+	n, err := l.reader.ReadAt(val, int64(a.Offset))
+	if n == len(val) { return val, nil }
+	if err == nil || errors.Is(err, io.EOF) { err = io.ErrUnexpectedEOF }
+	return nil, fmt.Errorf("Failed to read the value of lsn %d: %w", a.Lsn, err)
+}
+
+// The page a SNAPSHOT record carries, an image shorter
+// than a page was deflated
+func (l *Logger) PageImage(a *types.Action) ([]byte, error) {
+	val, err := l.GetValue(a)
+	if err != nil || len(val) == int(l.PageSize) { return val, err }
+	page := make([]byte, l.PageSize)
+	if err := pages.Inflate(page, val); err != nil {
+		return nil, fmt.Errorf("Page image of lsn %d doesnt inflate: %w", a.Lsn, err)
 	}
-	return val
+	return page, nil
+}
+
+// Writes the page image a SNAPSHOT record carries over the page,
+// for a page a crash tore in the middle of being written
+func (l *Logger) RepairPage(id uint64, a *types.Action) error {
+	val, err := l.PageImage(a)
+	if err != nil { return err }
+	return pages.WritePage(l.db.GetStore(), id, val)
 }
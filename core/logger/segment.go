@@ -0,0 +1,107 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"mydb/core/prims"
+)
+
+// Records are appended to segment files next to the database,
+// name.wal/000001, 000002 ... A record never spans two segments.
+// Once a segment passes SegmentSize the next one is started,
+// and a segment is deleted once a checkpoint no longer needs it.
+// Closed segments never change so they can be copied off as they are.
+var SegmentSize uint32 = 16 * 1024 * 1024
+
+func (l *Logger) SegmentPath(seg uint32) string { return SegmentPath(l.Dir, seg) }
+
+// The directory the log of the database at path goes in
+func LogDir(path string) string { return path + ".wal" }
+
+func SegmentPath(dir string, seg uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d", seg))
+}
+
+func blockSize(vol prims.Volume) uint32 {
+	if b, ok := vol.(prims.Blocked); ok { return uint32(b.BlockSize()) }
+	return 0
+}
+
+// Where the block after cursor starts, false for plain files
+func (l *Logger) nextBlock(cursor int) (int, bool) {
+	if l.align == 0 { return 0, false }
+	return (cursor / int(l.align) + 1) * int(l.align), true
+}
+
+// Opens a segment to append to at size, creating it if needed.
+// Anything past size is a torn tail and gets cut off.
+func (l *Logger) openSegment(seg uint32, size uint32) error {
+	file, err := l.vol.Open(l.SegmentPath(seg), os.O_RDWR | os.O_CREATE)
+	if err != nil { return err }
+	if err = file.Truncate(int64(size)); err != nil {
+		file.Close()
+		return err
+	}
+	if err = l.vol.SyncDir(l.Dir); err != nil {
+		file.Close()
+		return err
+	}
+	if l.seg != nil { l.seg.Close() }
+	l.seg = file
+	l.Segment, l.Offset, l.written = seg, size, size
+	return nil
+}
+
+// Starts the next segment, the current one is synced first
+// so the flushed lsn holds for everything before the new one
+func (l *Logger) rotate() error {
+	if err := l.sync(); err != nil { return err }
+	return l.openSegment(l.Segment + 1, 0)
+}
+
+// A block that wont decrypt reads as zeroes, the log goes on after it
+func (l *Logger) readSegment(seg uint32) ([]byte, error) {
+	file, err := l.vol.Open(l.SegmentPath(seg), os.O_RDONLY)
+	if err != nil { return nil, err }
+	defer file.Close()
+	data, err := prims.ReadAll(file)
+	if l.align == 0 || !errors.Is(err, prims.ErrAuth) { return data, err }
+	size, err := file.Size()
+	if err != nil { return nil, err }
+	data = make([]byte, size)
+	for at := 0; at < len(data); {
+		n, err := file.ReadAt(data[at:], int64(at))
+		at += n
+		if errors.Is(err, prims.ErrAuth) {
+			at += int(l.align)
+			continue
+		}
+		if err != nil { return nil, err }
+		if n == 0 { break }
+	}
+	return data, nil
+}
+
+// Deletes the segments from up to but not including to
+func (l *Logger) removeSegments(from, to uint32) error {
+	if l.reader != nil && l.readerSeg < to {
+		l.reader.Close()
+		l.reader = nil
+	}
+	for seg := from; seg < to; seg++ {
+		if l.Archive != "" {
+			if err := l.archive(seg); err != nil { return err }
+		}
+		err := l.vol.Remove(l.SegmentPath(seg))
+		if err != nil && !os.IsNotExist(err) { return err }
+	}
+	return l.vol.SyncDir(l.Dir)
+}
+
+// Segments after the end of the log were never synced to,
+// whatever is in them is not part of the log
+func (l *Logger) removeAfter(seg uint32) {
+	for seg++; l.vol.Remove(l.SegmentPath(seg)) == nil; seg++ {}
+}
@@ -1,23 +1,33 @@
 package logger
 
 import (
+	"encoding/binary"
+	"time"
+	"mydb/core/pages"
 	"mydb/core/types"
-	utils "mydb/utils"
 )
 
+// Ids only go up, also across restarts, so a higher id
+// always belongs to a transaction that began later.
+// 0 is no transaction and never handed out
+func (l *Logger) NextTrxId() uint64 {
+	id := l.lastTrx.Add(1)
+	if id == 0 { id = l.lastTrx.Add(1) }
+	return id
+}
+
 // Writes the value, and records offset.
 // The offset is stored in the action.
 // Transacton is derived and added to log table.
 // Optional commitcode is used for pending transactions.
 // If commitCode is not provided it defaults to at end of actions.
-func (l *Logger) NewTxn(as *[]*types.Action, vs *[]*[]byte, id int32, commitCode ...types.LogFlag) (uint64, error) {
+func (l *Logger) NewTxn(as *[]*types.Action, vs *[]*[]byte, id uint64, commitCode ...types.LogFlag) (uint64, error) {
 	if as == nil || len(*as) < 1 { return 0, nil }
-	if id == 0 { 
-		var err error 
-		id, err = utils.RandomInt32() 
-		if err != nil { return 0,err }
-	}
+	if id == 0 { id = l.NextTrxId() }
 	var err error
+	if _, ok := l.pendingTrxs[id]; !ok {
+		l.trxStarts[id] = Mark{Segment: l.Segment, Offset: l.Offset, Lsn: l.Lsn, bytes: l.ByteCount}
+	}
 
 	actions := *as
 	// Write the values to the logger
@@ -29,7 +39,15 @@ func (l *Logger) NewTxn(as *[]*types.Action, vs *[]*[]byte, id int32, commitCode
 			code = commitCode[0]
 		}
 
-		if actions[i].GetVType() == int8(types.NLBlob) {
+		vType := types.DataType(actions[i].GetVType())
+		if vType == types.NLBlob || vType == types.Page {
+			// page images are deflated when that makes them shorter
+			if l.Compress && actions[i].GetOperation() == types.SNAPSHOT && len(*v) == int(l.PageSize) {
+				if data := pages.Deflate(*v, len(*v)); data != nil {
+					if err := l.db.MarkCompressed(); err != nil { return 0, err }
+					v = &data
+				}
+			}
 			actions[i].SetVLength(uint16(len(*v)))
 		}
 		// write this value to a page that doesnt use bitmap
@@ -41,37 +59,70 @@ func (l *Logger) NewTxn(as *[]*types.Action, vs *[]*[]byte, id int32, commitCode
 	} else {
 		l.pendingTrxs[id] = *as
 	}
-	return l.NextLsn(), nil
+	// the lsn of the last record written
+	if len(*vs) == 0 { return l.Lsn, nil }
+	return actions[len(*vs)-1].Lsn, nil
 }
 
-func (l *Logger) CancelTxn(trxId int32) {
-	if trxId == 0 { return }
-	if _, ok := l.pendingTrxs[trxId]; ok {
-		delete(l.pendingTrxs, trxId)
+// Marks the transaction as cancelled,
+// returns its actions so the caller can put things back.
+func (l *Logger) CancelTxn(trxId uint64) []*types.Action {
+	if trxId == 0 { return nil }
+	acts, ok := l.pendingTrxs[trxId]
+	if ok {
+		l.forget(trxId)
 		axs := types.AtomicAx(types.CANCEL, types.Nil, 0)
 		value := make([]byte, 0)
 		l.ToWriter(axs, &value, trxId, types.TxnCancel)
 	}
+	return acts
 }
 
-func (l *Logger) CommitTxn(trxId int32) {
-	if trxId == 0 { return }
-	if _, ok := l.pendingTrxs[trxId]; ok {
-		axs, va := make([]*types.Action, 1), make([]*[]byte, 1)
-		axs[0] = types.AtomicAx(types.NONE, types.Nil, 0)
-		va[0] = &[]byte{}
-		l.NewTxn(&axs, &va,trxId, types.TxnCommit)
+// Writes the commit record and calls done once it is durable,
+// how durable depends on the mode. It may return before that
+func (l *Logger) CommitTxn(trxId uint64, done func(error)) {
+	if _, ok := l.pendingTrxs[trxId]; trxId == 0 || !ok {
+		done(nil)
+		return
 	}
+	axs, va := make([]*types.Action, 1), make([]*[]byte, 1)
+	// when it was made, a restore to a point in time goes by it
+	at := binary.LittleEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+	axs[0] = types.AtomicAx(types.NONE, types.NLBlob, 0, COMMIT_TIME_SIZE)
+	va[0] = &at
+	lsn, err := l.NewTxn(&axs, &va,trxId, types.TxnCommit)
+	l.forget(trxId)
+	if err != nil {
+		done(err)
+		return
+	}
+	l.WhenDurable(lsn, done)
 }
 
-func (l *Logger) GetActions(trxId int32) *[]*types.Action {
+func (l *Logger) GetActions(trxId uint64) *[]*types.Action {
 	if trxId == 0 { return nil }
 	axs, ok := l.pendingTrxs[trxId]
 	if !ok { return nil }
-	delete(l.pendingTrxs, trxId)
+	l.forget(trxId)
 	return &axs
 }
 
+func (l *Logger) forget(trxId uint64) {
+	delete(l.pendingTrxs, trxId)
+	delete(l.trxStarts, trxId)
+}
+
+// Logs that the transaction is done with the page, it goes back on the
+// free list when the commit is written and recovery does the same
+func (l *Logger) FreePage(trxId, pageId uint64) error {
+	axs := []*types.Action{types.AtomicAx(types.FREEPAGE, types.Page, pageId)}
+	_, err := l.NewTxn(&axs, &[]*[]byte{{}}, trxId)
+	return err
+}
+
+// Actions of a pending transaction, it stays pending
+func (l *Logger) PeekActions(trxId uint64) []*types.Action { return l.pendingTrxs[trxId] }
+
 func (l *Logger) SnapPageLike(p types.PageLike) error {
 	buff := p.ToBytes()
 	pid := p.GetId()
@@ -82,10 +133,9 @@ func (l *Logger) SnapPageLike(p types.PageLike) error {
 	coppy := make([]byte, len(buff))
 	copy(coppy, buff)
 
-	id, err := utils.RandomInt32()
-	if err != nil { return err }
-
-	l.NewTxn(&axs, &[]*[]byte{&coppy}, id)
-	l.CommitTxn(id)
-	return nil
+	id := l.NextTrxId()
+	if _, err := l.NewTxn(&axs, &[]*[]byte{&coppy}, id); err != nil { return err }
+	errc := make(chan error, 1)
+	l.CommitTxn(id, func(err error) { errc <- err })
+	return <-errc
 }
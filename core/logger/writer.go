@@ -2,13 +2,23 @@ package logger
 
 import (
 	"encoding/binary"
+	"hash/crc32"
+	"time"
+	"mydb/core/prims"
 	"mydb/core/types"
 )
 
 func (l *Logger) StartWriter() {
 	for r := range l.WriterIn {
 		if r == nil { break }
-		err := l.WriteTrx(r.action, r.value, r.id, r.commitCode)
+		var err error
+		if r.force {
+			// someone else's sync may already cover it
+			if r.lsn > l.FlushedLsn() { err = l.sync() }
+			r.done <- err
+			continue
+		}
+		err = l.WriteTrx(r.action, r.value, r.id, r.commitCode)
 		l.WriterOut <- err
 	}
 }
@@ -16,12 +26,15 @@ func (l *Logger) StartWriter() {
 type Record struct {
 	action *types.Action
 	value  *[]byte
-	id     int32
+	id     uint64
 	commitCode types.LogFlag
+	force bool // only sync the log
+	lsn uint64 // force, sync up to here
+	done chan error // force, answered here so any goroutine can force
 }
 
 func (l *Logger) ToWriter (
-	a *types.Action, v *[]byte, id int32, commitCode types.LogFlag,
+	a *types.Action, v *[]byte, id uint64, commitCode types.LogFlag,
 ) error {
 	r := &Record{action:a, value:v, id:id, commitCode: commitCode}
 	l.WriterIn <- r
@@ -29,61 +42,128 @@ func (l *Logger) ToWriter (
 	return err
 }
 
-func (l *Logger) WriteTrx (
-	a *types.Action, v *[]byte, id int32, commitCode types.LogFlag,
-) error {
-	var err error
-	var wrote uint32
-	pageSize := uint16(len(l.Page.Body))
+// Gets the log on disk at least up to lsn.
+// Pages call this before being written, the write-ahead rule.
+func (l *Logger) ForceLog(lsn uint64) error {
+	if lsn <= l.FlushedLsn() { return nil }
+	// a reader has no writer, all it replayed was read back
+	if l.readOnly { return prims.ErrReadOnly }
+	r := &Record{force: true, lsn: lsn, done: make(chan error, 1)}
+	l.WriterIn <- r
+	return <-r.done
+}
 
-	// MAKE sure the trx card can fit
-	if l.Offset + TRX_SIZE > pageSize {
-		l.Page, err = l.NewPage()
-		if err != nil { return err }
+// Calls done once the commit at lsn is as durable as the mode promises.
+// GROUP_COMMIT hands it to the group committer and returns at once,
+// the table goes on with the next message and one sync answers them all.
+// SYNC_COMMIT forces the log itself, forces that queue up behind
+// another sync are already covered by it and return without their own.
+func (l *Logger) WhenDurable(lsn uint64, done func(error)) {
+	switch l.Durability.Mode {
+		case types.NO_SYNC:
+			done(nil)
+		case types.GROUP_COMMIT:
+			l.groupIn <- &waiter{lsn: lsn, done: done}
+		default:
+			done(l.ForceLog(lsn))
 	}
-	aPage := l.Page
-	aCursor := l.Offset
-	l.Offset += TRX_SIZE
-	a.Offset = l.Offset
-	a.PageId = l.Page.PageId
+}
+
+type waiter struct {
+	lsn  uint64
+	done func(error)
+}
 
-	// write the value first to ensure recovery works
-	for _, b := range *v {
-		if l.Offset >= pageSize {
-			l.Page, err = l.NewPage()
-			if err != nil { return err }
+// Collects committers until the window closes or the group is full,
+// then one sync covers all of them
+func (l *Logger) groupCommit() {
+	for w := range l.groupIn {
+		group := []*waiter{w}
+		timer := time.NewTimer(l.Durability.Window)
+	collect:
+		for len(group) < l.Durability.GroupSize {
+			select {
+				case w, ok := <-l.groupIn:
+					if !ok { break collect }
+					group = append(group, w)
+				case <-timer.C:
+					break collect
+			}
 		}
-		l.Page.Body[l.Offset] = b
-		l.Offset++
-		wrote++
+		timer.Stop()
+
+		var lsn uint64
+		for _, w := range group { lsn = max(lsn, w.lsn) }
+		err := l.ForceLog(lsn)
+		for _, w := range group { w.done(err) }
 	}
+}
 
-	// write begin flag
-	aPage.Body[aCursor] = byte(types.TxnBegin)
-	aCursor++
-	wrote++
+// Only called by the writer
+func (l *Logger) sync() error {
+	if l.syncErr != nil { return l.syncErr }
+	if l.recoverErr != nil { return l.recoverErr }
+	if err := l.writeOut(); err != nil { return err }
+	if err := l.seg.Sync(); err != nil {
+		l.syncErr = err
+		return err
+	}
+	l.flushedLsn.Store(l.Lsn)
+	// a torn rewrite of the block could take the synced records with it
+	if next, ok := l.nextBlock(int(l.Offset) - 1); ok && len(l.buff) == 0 && l.Offset > 0 {
+		gap := uint32(next) - l.Offset
+		l.Offset, l.written, l.ByteCount = l.Offset + gap, l.written + gap, l.ByteCount + gap
+	}
+	return nil
+}
 
-	// write the transaction id
-	binary.LittleEndian.PutUint32(aPage.Body[aCursor:], uint32(id))
-	wrote += 4
-	aCursor += 4
+// Hands the buffered records to the segment, no fsync
+func (l *Logger) writeOut() error {
+	if len(l.buff) == 0 { return nil }
+	n, err := l.seg.WriteAt(l.buff, int64(l.written))
+	if err != nil { return err }
+	// a short write leaves the rest for the next one
+	l.written += uint32(n)
+	l.buff = append(l.buff[:0], l.buff[n:]...)
+	return nil
+}
 
-	// write the action
-	for _, b := range a.GetRaw() {
-		aPage.Body[aCursor] = b
-		aCursor++
-		wrote++
+// Every record gets the next lsn, recovery checks that
+// each one it reads follows the one before.
+func (l *Logger) WriteTrx (
+	a *types.Action, v *[]byte, id uint64, commitCode types.LogFlag,
+) error {
+	if l.recoverErr != nil { return l.recoverErr }
+	// records never span segments, a full one is closed off first
+	if l.Offset >= SegmentSize {
+		if err := l.rotate(); err != nil { return err }
 	}
+	a.Lsn = l.NextLsn()
+
+	// the card, the crc covers it and the value so a torn record
+	// or one left from an older use of the file never checks out
+	start := len(l.buff)
+	l.buff = append(l.buff, make([]byte, TRX_SIZE)...)
+	card := l.buff[start:]
+	card[REC_BEGIN_OFF] = REC_WIDE
+	binary.LittleEndian.PutUint64(card[REC_TRX_OFF:], id)
+	binary.LittleEndian.PutUint64(card[REC_LSN_OFF:], a.Lsn)
+	copy(card[REC_ACTION_OFF:REC_COMMIT_OFF], a.GetRaw())
+	card[REC_COMMIT_OFF] = byte(commitCode)
+	crc := crc32.Update(crc32.Checksum(card[:REC_CRC_OFF], crcTable), crcTable, *v)
+	binary.LittleEndian.PutUint32(card[REC_CRC_OFF:], crc)
 
-	// write the commit commitCode
-	aPage.Body[aCursor] = byte(commitCode)
-	aCursor++
-	wrote++
+	// the value follows the card
+	l.buff = append(l.buff, *v...)
+	a.Segment, a.Offset = l.Segment, l.Offset + TRX_SIZE
+	size := uint32(TRX_SIZE + len(*v))
+	l.Offset += size
+	l.ByteCount += size
 
-	// update byte count
-	l.ByteCount += wrote
-	if int(l.ByteCount) >= LogThreshold {
-		go l.TruncateLogs()
+	// a finished transaction is written out, the commit
+	// waits for the sync its durability mode asks for
+	if commitCode == types.TxnCommit || commitCode == types.TxnCancel {
+		return l.writeOut()
 	}
 	return nil
 }
@@ -34,11 +34,13 @@ func (p *Page)ReleaseSlot(pid *PageId) {
 	}
 }
 
+// Whole bytes of bitmap, each bit a slot, and no more
+// than a PageId can tell apart
 func (p *Page)GetSlotCapacity() uint8 {
-	switch PageType(p.PageType) {
-	case FILE_FIXED: return uint8((PAGE_SIZE-PAGE_HEADER_LENGTH)/72)
-	default: return 0
-	}
+	size := int(p.GetSlotSize())
+	if size == 0 { return 0 }
+	slots := len(p.Body) * 8 / (size*8 + 1) &^ 7
+	return uint8(min(slots, 248))
 }
 func (p *Page)GetSlotSize() uint8 {
 	switch PageType(p.PageType) {
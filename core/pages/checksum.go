@@ -0,0 +1,53 @@
+package pages
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"mydb/core/prims"
+)
+
+// Every page carries a crc of itself in the common header,
+// stamped when it is flushed and checked when it is read back
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type CorruptPageError struct {
+	Id 		uint64
+	Type 	PageType // what the header claims, it may be garbage too
+}
+
+func (e *CorruptPageError) Error() string {
+	return fmt.Sprintf("Page %d (%s) failed its checksum", e.Id, e.Type)
+}
+
+func checksum(buff []byte) uint32 {
+	crc := crc32.Checksum(buff[:CHECKSUM_OFF], crcTable)
+	return crc32.Update(crc, crcTable, buff[CHECKSUM_OFF+4:])
+}
+
+// Stamps buff right before it goes to disk
+func SetChecksum(buff []byte) {
+	binary.LittleEndian.PutUint32(buff[CHECKSUM_OFF:], checksum(buff))
+}
+
+// A page that was never written is all zeroes and passes
+func VerifyChecksum(id uint64, buff []byte) error {
+	if binary.LittleEndian.Uint32(buff[CHECKSUM_OFF:]) == checksum(buff) { return nil }
+	for _, b := range buff {
+		if b != 0 { return &CorruptPageError{Id: id, Type: PageType(buff[PAGETYPE_OFF])} }
+	}
+	return nil
+}
+
+// Reads page id into buff, which is one page long, and checks it.
+// Past the end of the file a page reads as zeroes
+func ReadPage(store prims.Storage, id uint64, buff []byte) error {
+	n, err := store.ReadAt(buff, int64(id) * int64(len(buff)))
+	// a block that wont decrypt is as bad as a wrong checksum
+	if errors.Is(err, prims.ErrAuth) { return &CorruptPageError{Id: id, Type: PageType(buff[PAGETYPE_OFF])} }
+	if err != nil { return err }
+	clear(buff[n:])
+	if buff[PAGETYPE_OFF] & COMPRESSED != 0 { uncompressPage(buff) }
+	return VerifyChecksum(id, buff)
+}
@@ -0,0 +1,120 @@
+package pages
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"sync"
+	"mydb/core/prims"
+)
+
+// COMPRESSED PAGES
+// A page of a type that compresses well keeps its header as it is, with
+// COMPRESSED set on the type, and the rest of it deflated behind the length.
+// Only the part in use is written, the disk space of the rest is given
+// back, so the page takes less of the disk but stays where it was in the file.
+// The checksum is of the page before it was compressed.
+//	PAGE_HEADER_LENGTH		length of what follows, uint16
+//	+2						the deflated body
+const (
+	COMPRESSED 			= 0x80 // on the page type
+	COMPRESSED_LEN_OFF 	= PAGE_HEADER_LENGTH
+	COMPRESSED_OFF 		= COMPRESSED_LEN_OFF + 2
+	// the least the disk gives back, smaller pages are never compressed
+	COMPRESS_UNIT 		= 4096
+)
+
+// The types worth compressing. Leaves repeat the start of their keys,
+// every FTYPE/FTIME/FID entry starts with the same uid
+func Compressible(t PageType) bool {
+	switch t {
+		case IDX_LEAF: return true
+	}
+	return false
+}
+
+// A store the compressible pages are written to compressed,
+// pages already compressed are read back from any store
+type Compressing struct {
+	prims.Storage
+	// runs before a page is written compressed, nil for none
+	Mark func() error
+}
+
+func Compress(st prims.Storage) *Compressing { return &Compressing{ Storage: st } }
+
+var (
+	writers = sync.Pool{ New: func() any { w, _ := flate.NewWriter(nil, flate.BestSpeed); return w } }
+	readers = sync.Pool{ New: func() any { return flate.NewReader(nil) } }
+)
+
+// Deflates data, nil if it doesnt get below limit
+func Deflate(data []byte, limit int) []byte {
+	var out bytes.Buffer
+	w := writers.Get().(*flate.Writer)
+	defer writers.Put(w)
+	w.Reset(&out)
+	if _, err := w.Write(data); err != nil { return nil }
+	if err := w.Close(); err != nil || out.Len() >= limit { return nil }
+	return out.Bytes()
+}
+
+// Inflates data into buff, which it has to fill exactly
+func Inflate(buff, data []byte) error {
+	r := readers.Get().(io.ReadCloser)
+	defer readers.Put(r)
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(data), nil); err != nil { return err }
+	if _, err := io.ReadFull(r, buff); err != nil { return err }
+	if n, _ := r.Read(make([]byte, 1)); n != 0 { return io.ErrUnexpectedEOF }
+	return nil
+}
+
+// Stamps buff with its checksum and writes it as page id,
+// compressed if the store asks for it and it saves room
+func WritePage(store prims.Storage, id uint64, buff []byte) error {
+	SetChecksum(buff)
+	off := int64(id) * int64(len(buff))
+	if c, ok := store.(*Compressing); ok && len(buff) > COMPRESS_UNIT && Compressible(PageType(buff[PAGETYPE_OFF])) {
+		if used, packed := compressPage(buff); used > 0 {
+			if c.Mark != nil {
+				if err := c.Mark(); err != nil { return err }
+			}
+			n, err := c.Storage.WriteAt(packed[:used], off)
+			if err != nil { return err }
+			if n < used { return io.ErrShortWrite }
+			// what is left of the old page is never read
+			if p, ok := c.Storage.(prims.Puncher); ok { p.Punch(off + int64(used), int64(len(buff) - used)) }
+			return nil
+		}
+	}
+	n, err := store.WriteAt(buff, off)
+	if err != nil { return err }
+	if n < len(buff) { return io.ErrShortWrite }
+	return nil
+}
+
+// Returns the page compressed and how much of it to write,
+// 0 if it doesnt free a unit of the disk
+func compressPage(buff []byte) (int, []byte) {
+	data := Deflate(buff[PAGE_HEADER_LENGTH:], len(buff) - COMPRESS_UNIT - int(COMPRESSED_OFF))
+	if data == nil { return 0, nil }
+	packed := make([]byte, len(buff))
+	copy(packed, buff[:PAGE_HEADER_LENGTH])
+	packed[PAGETYPE_OFF] |= COMPRESSED
+	binary.LittleEndian.PutUint16(packed[COMPRESSED_LEN_OFF:], uint16(len(data)))
+	copy(packed[COMPRESSED_OFF:], data)
+	used := int(COMPRESSED_OFF) + len(data)
+	return (used + COMPRESS_UNIT - 1) / COMPRESS_UNIT * COMPRESS_UNIT, packed
+}
+
+// Puts a compressed page in buff back as it was, anything that
+// doesnt inflate is left for the checksum to catch
+func uncompressPage(buff []byte) {
+	buff[PAGETYPE_OFF] &^= COMPRESSED
+	size := int(binary.LittleEndian.Uint16(buff[COMPRESSED_LEN_OFF:]))
+	if int(COMPRESSED_OFF) + size > len(buff) { return }
+	data := make([]byte, size)
+	copy(data, buff[COMPRESSED_OFF:])
+	Inflate(buff[PAGE_HEADER_LENGTH:], data)
+}
@@ -0,0 +1,68 @@
+package pages
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+	"mydb/core/prims"
+)
+
+// A page of type t whose body repeats the same entry, like a leaf does
+func testPage(t PageType, size int) []byte {
+	buff := make([]byte, size)
+	buff[PAGETYPE_OFF] = byte(t)
+	for i := int(PAGE_HEADER_LENGTH); i < size; i++ { buff[i] = "ABCABC123123ABC1"[i % 16] }
+	return buff
+}
+
+func Test_CompressPage(t *testing.T) {
+	const SIZE = 16384
+	mem := prims.NewMemory()
+	st := Compress(mem)
+	raw := func(id uint64) []byte {
+		buff := make([]byte, SIZE)
+		if _, err := mem.ReadAt(buff, int64(id) * SIZE); err != nil { t.Fatalf("Failed to read page %d: %v", id, err) }
+		return buff
+	}
+	read := func(id uint64) []byte {
+		buff := make([]byte, SIZE)
+		if err := ReadPage(mem, id, buff); err != nil { t.Fatalf("Failed to read page %d: %v", id, err) }
+		return buff
+	}
+
+	// the whole old page is there, what the compressed one leaves of it is never read
+	noise := make([]byte, SIZE)
+	rand.New(rand.NewSource(1)).Read(noise)
+	noise[PAGETYPE_OFF] = byte(IDX_LEAF)
+	if err := WritePage(st, 1, bytes.Clone(noise)); err != nil { t.Fatalf("Failed to write: %v", err) }
+	if raw(1)[PAGETYPE_OFF] & COMPRESSED != 0 { t.Fatalf("Page that doesnt deflate was compressed") }
+	leaf := testPage(IDX_LEAF, SIZE)
+	if err := WritePage(st, 1, leaf); err != nil { t.Fatalf("Failed to write: %v", err) }
+	if raw(1)[PAGETYPE_OFF] != byte(IDX_LEAF) | COMPRESSED { t.Fatalf("Leaf was written as type %x", raw(1)[PAGETYPE_OFF]) }
+	if !bytes.Equal(read(1), leaf) { t.Fatalf("Leaf read back other bytes") }
+
+	// other types, and pages that cant give back a unit, are written as they are
+	for _, buff := range [][]byte{ testPage(IDX_NODE, SIZE), testPage(IDX_LEAF, COMPRESS_UNIT) } {
+		if err := WritePage(st, 2, buff); err != nil { t.Fatalf("Failed to write: %v", err) }
+		got := make([]byte, len(buff))
+		if _, err := mem.ReadAt(got, 2 * int64(len(buff))); err != nil || !bytes.Equal(got, buff) { t.Fatalf("Page of %d bytes was changed on disk, err %v", len(buff), err) }
+	}
+
+	// a deflated body that is off fails the checksum
+	if _, err := mem.WriteAt([]byte{ 0xFF }, SIZE + int64(COMPRESSED_OFF) + 10); err != nil { t.Fatalf("Failed to write: %v", err) }
+	var corrupt *CorruptPageError
+	if err := ReadPage(mem, 1, make([]byte, SIZE)); !errors.As(err, &corrupt) || corrupt.Type != IDX_LEAF { t.Fatalf("Read a broken compressed page, err %v", err) }
+}
+
+func Test_Deflate(t *testing.T) {
+	data := testPage(IDX_LEAF, 4096)
+	packed := Deflate(data, len(data))
+	if packed == nil { t.Fatalf("Repeating data didnt deflate") }
+	if Deflate(data, len(packed)) != nil { t.Fatalf("Deflated past its limit") }
+	got := make([]byte, len(data))
+	if err := Inflate(got, packed); err != nil || !bytes.Equal(got, data) { t.Fatalf("Inflated other bytes, err %v", err) }
+	// it has to fill the buffer exactly
+	if err := Inflate(make([]byte, len(data) + 1), packed); err == nil { t.Fatalf("Inflated into a longer buffer") }
+	if err := Inflate(make([]byte, len(data) - 1), packed); err == nil { t.Fatalf("Inflated into a shorter buffer") }
+}
@@ -7,19 +7,33 @@ import (
 	"mydb/core/prims"
 )
 
+// Every page starts with { type, id, lsn, checksum } at the same offsets,
+// so the log can stamp and compare LSNs without knowing the page type.
 const (
-	PAGE_HEADER_LENGTH uint16 = 1 + 4 + 2 + 2 + 4 + 8 + 1
+	PAGE_HEADER_LENGTH uint16 = 1 + 8 + 8 + 4 + 8 + 8
 	PAGETYPE_OFF = 0
 	PAGEID_OFF = 1
-	NEXT_OFF = 9
-	PREV_OFF = 17
-	LSN_OFF = 25
-	PAGE_SIZE uint16 = 4096
-	PAGE_BODY_SIZE = PAGE_SIZE - PAGE_HEADER_LENGTH
+	LSN_OFF = 9
+	CHECKSUM_OFF = 17
+	NEXT_OFF = 21
+	PREV_OFF = 29
 )
 
+// A database picks its page size when it is created, everything
+// here takes it from the length of the buffer a page sits on
+const (
+	DEFAULT_PAGE_SIZE uint16 = 4096
+	MIN_PAGE_SIZE uint16 = 4096
+	MAX_PAGE_SIZE uint16 = 32768
+)
+
+// Powers of two from MIN_PAGE_SIZE to MAX_PAGE_SIZE
+func ValidPageSize(size int) bool {
+	return size >= int(MIN_PAGE_SIZE) && size <= int(MAX_PAGE_SIZE) && size & (size-1) == 0
+}
+
 type Page struct {
-	fd         	int
+	store      	prims.Storage
 	isDirty		bool
 	Lsn			uint64
 	TupleLen	uint8
@@ -39,6 +53,8 @@ type Page struct {
 }
 func (p *Page) GetId() uint64 { return p.PageId }
 func (p *Page) GetType() PageType { return PageType(p.PageType) }
+func (p *Page) GetLsn() uint64 { return p.Lsn }
+func (p *Page) SetLsn(lsn uint64) { p.Lsn = lsn }
 
 func (p *Page) IsDirty() bool { return p.isDirty }
 func (p *Page) SetIsDirty(is bool) { p.isDirty = is }
@@ -64,10 +80,10 @@ func (p *Page) ToBytes() []byte {
 
 func (p *Page) WriteToBuffer(buff []byte) {
 	buff[PAGETYPE_OFF] = byte(p.PageType)
-	binary.LittleEndian.PutUint32(buff[PAGEID_OFF:], uint32(p.PageId))
-	binary.LittleEndian.PutUint32(buff[NEXT_OFF:], uint32(p.Next))
-	binary.LittleEndian.PutUint32(buff[PREV_OFF:], uint32(p.Prev))
-	binary.LittleEndian.PutUint64(buff[LSN_OFF:], uint64(p.Lsn))
+	binary.LittleEndian.PutUint64(buff[PAGEID_OFF:], p.PageId)
+	binary.LittleEndian.PutUint64(buff[LSN_OFF:], p.Lsn)
+	binary.LittleEndian.PutUint64(buff[NEXT_OFF:], p.Next)
+	binary.LittleEndian.PutUint64(buff[PREV_OFF:], p.Prev)
 	copy(buff[PAGE_HEADER_LENGTH:], p.Body)
 }
 
@@ -84,40 +100,45 @@ func (p *Page) FromBytes(buff []byte) error {
 		return syscall.EINVAL // invalid page size
 	}
 	p.PageType = uint8(buff[PAGETYPE_OFF])
+	p.PageId = binary.LittleEndian.Uint64(buff[PAGEID_OFF:])
+	p.Lsn = binary.LittleEndian.Uint64(buff[LSN_OFF:])
 	p.Next = binary.LittleEndian.Uint64(buff[NEXT_OFF:])
 	p.Prev = binary.LittleEndian.Uint64(buff[PREV_OFF:])
-	p.Lsn = binary.LittleEndian.Uint64(buff[LSN_OFF:])
 	p.Body = buff[PAGE_HEADER_LENGTH:]
-	p.lock = &sync.RWMutex{}
+	// keep the lock when re-reading a page that is already shared
+	if p.lock == nil { p.lock = &sync.RWMutex{} }
 	p.Cursor = 0
 	p.fullBuffer = buff
 
 	return nil
 }
 
-func LoadPage(fd int, id uint64, buff []byte) (*Page, error) {
+func LoadPage(store prims.Storage, id uint64, buff []byte) (*Page, error) {
 	page := new(Page)
-	// MMAP the entire node/page
-	offset := int64(id) * int64(PAGE_SIZE)
-	page.fd = fd
-	page.PageId = id
+	page.store = store
 
-	_, err := prims.Read(fd, buff, offset)
-	if err != nil { return nil, err }
+	if err := ReadPage(store, id, buff); err != nil { return nil, err }
 
 	page.FromBytes(buff)
+	page.PageId = id
 
 	// set the done function to unmap the LoadPage
 	return page, nil
 }
 
+// Creates an empty page of pageType on top of buff
+func NewPage(store prims.Storage, id uint64, pageType PageType, buff []byte) *Page {
+	clear(buff)
+	page := new(Page)
+	page.store = store
+	page.FromBytes(buff)
+	page.PageId = id
+	page.PageType = uint8(pageType)
+	return page
+}
+
 func (p *Page) Flush(buff []byte) error { 
-	offset := p.PageId * uint64(PAGE_SIZE)
-	n, err := prims.Write(p.fd, buff, int64(offset))
-	if n < int(PAGE_SIZE) {
-		panic("didnt write it all")
-	}
-	if err != nil { return err }
+	if err := WritePage(p.store, p.PageId, buff); err != nil { return err }
 	p.isDirty = false
 	return nil
 }
@@ -148,11 +169,16 @@ func (p *Page) GetVarRow(pid *PageId) []byte {
 }
 
 func (p *Page) GetFixRow(pid *PageId) []byte {
+	cursor := p.GetFixRowOffset(pid)
+	slice := p.Body[cursor:cursor+uint16(p.GetSlotSize())]
+	return slice
+}
+
+// Offset of the fixed slot within the body
+func (p *Page) GetFixRowOffset(pid *PageId) uint16 {
 	bitmapsize := p.GetSlotCapacity() / 8
 	slotSize := uint16(p.GetSlotSize())
-	cursor := uint16(bitmapsize) + uint16(pid.InPID) * slotSize
-	slice := p.Body[cursor:cursor+slotSize]
-	return slice
+	return uint16(bitmapsize) + uint16(pid.InPID) * slotSize
 }
 
 // func InitMappings(fd int, id uint64, pageType PageType, zeroBuff []byte) {
@@ -165,10 +191,3 @@ func (p *Page) GetFixRow(pid *PageId) []byte {
 // // 		panic("wrong length")
 // // 	}
 // }
-//
-func ReadNext(fd int, id uint64) uint64 {
-	buff := make([]byte, 8)
-	offset := int64(id * uint64(PAGE_SIZE) + NEXT_OFF)
-	prims.Read(fd, buff, offset)
-	return binary.LittleEndian.Uint64(buff)
-}
@@ -20,6 +20,9 @@ const (
 
 	// LOGGER PAGE
 	LOGGER_PAGE
+
+	// DATABASE META, page 0 and its copy
+	META_PAGE
 )
 
 func (p PageType) String() string {
@@ -39,6 +42,8 @@ func (p PageType) String() string {
 	case FID_IDX: return "FID_IDX"
 
 	case LOGGER_PAGE: return "LOGGER_PAGE"
+
+	case META_PAGE: return "META_PAGE"
 	}
 	return "UNKNOWN_PAGE_TYPE"
 }
@@ -0,0 +1,331 @@
+package prims
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ENCRYPTION AT REST
+// Files are cut into blocks of BLOCK_SIZE, each sealed on its own with
+// AES-GCM under the key its id names. The id of the file and the index
+// of the block are the additional data so a block cant be moved to another
+// place in the file or into another file, the data file and the log alike.
+// Pages are whole blocks, the log tail is the only thing written in part.
+//	0	key id, 0 for a block never written, it reads as zeroes
+//	4	nonce
+//	16	the sealed block and its tag
+const (
+	BLOCK_SIZE 		= 4096
+	BLOCK_KEY_OFF 	= 0
+	BLOCK_NONCE_OFF = 4
+	BLOCK_DATA_OFF 	= 16
+	BLOCK_TAG_SIZE 	= 16
+	SEALED_SIZE 	= BLOCK_DATA_OFF + BLOCK_SIZE + BLOCK_TAG_SIZE
+)
+
+// FILE HEADER, before the first block. The id is random and made with the
+// file, it goes along when the file is renamed.
+// Files sealed before there was a header start with a block, their key
+// ids are small so they never read as the magic. They keep only the index
+// as the additional data and are read and written as they are
+//	0	magic
+//	8	file id
+const (
+	FILE_MAGIC_OFF 		= 0
+	FILE_ID_OFF 		= 8
+	FILE_ID_SIZE 		= 16
+	FILE_HEADER_SIZE 	= 32
+)
+
+var FILE_MAGIC = []byte("MYGOENC\x01")
+
+var (
+	ErrAuth 	= errors.New("Block failed to decrypt, it was torn or the key is wrong")
+	ErrNoKey 	= errors.New("Key not found")
+)
+
+// A volume whose files are written a block at a time. Writing part of
+// a block rewrites all of it, so a torn write can lose what was there
+type Blocked interface {
+	BlockSize() int
+}
+
+// Where the keys come from. Ids are never 0 and never reused. Rotating
+// makes a new key current, blocks sealed with the old ones still need
+// them until they are written again. Current is asked on every write
+type KeyProvider interface {
+	Current() (uint32, []byte, error)
+	Key(id uint32) ([]byte, error)
+}
+
+// One key that never changes, it has id 1
+type StaticKey []byte
+
+func (k StaticKey) Current() (uint32, []byte, error) { return 1, k, nil }
+
+func (k StaticKey) Key(id uint32) ([]byte, error) {
+	if id != 1 { return nil, fmt.Errorf("%w: %d", ErrNoKey, id) }
+	return k, nil
+}
+
+// Keys by id, the newest one is current
+type KeyRing struct {
+	current uint32
+	keys 	map[uint32][]byte
+	mux 	*sync.RWMutex
+}
+
+func NewKeyRing() *KeyRing {
+	return &KeyRing{ keys: make(map[uint32][]byte), mux: &sync.RWMutex{} }
+}
+
+// Puts back a key that was rotated out, blocks may still be sealed with it
+func (r *KeyRing) Add(id uint32, key []byte) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.keys[id] = key
+	if id > r.current { r.current = id }
+}
+
+// Makes key the one new blocks are sealed with, returns its id
+func (r *KeyRing) Rotate(key []byte) uint32 {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.current++
+	r.keys[r.current] = key
+	return r.current
+}
+
+func (r *KeyRing) Current() (uint32, []byte, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	if r.current == 0 { return 0, nil, ErrNoKey }
+	return r.current, r.keys[r.current], nil
+}
+
+func (r *KeyRing) Key(id uint32) ([]byte, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	key, ok := r.keys[id]
+	if !ok { return nil, fmt.Errorf("%w: %d", ErrNoKey, id) }
+	return key, nil
+}
+
+// Encrypts every file of the volume it wraps
+type Encrypted struct {
+	Volume
+	Keys 	KeyProvider
+	aeads 	map[uint32]cipher.AEAD
+	mux 	*sync.Mutex
+}
+
+func Encrypt(v Volume, keys KeyProvider) *Encrypted {
+	return &Encrypted{ Volume: v, Keys: keys, aeads: make(map[uint32]cipher.AEAD), mux: &sync.Mutex{} }
+}
+
+func (e *Encrypted) BlockSize() int { return BLOCK_SIZE }
+
+func (e *Encrypted) Open(path string, flag int) (Storage, error) {
+	st, err := e.Volume.Open(path, flag)
+	if err != nil { return nil, err }
+	return &EncryptedFile{ e: e, st: st, mux: &sync.Mutex{} }, nil
+}
+
+func (e *Encrypted) aead(id uint32) (cipher.AEAD, error) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if a, ok := e.aeads[id]; ok { return a, nil }
+	key, err := e.Keys.Key(id)
+	if err != nil { return nil, err }
+	block, err := aes.NewCipher(key)
+	if err != nil { return nil, err }
+	a, err := cipher.NewGCM(block)
+	if err != nil { return nil, err }
+	e.aeads[id] = a
+	return a, nil
+}
+
+func blockData(file []byte, block int64) []byte {
+	return binary.LittleEndian.AppendUint64(append([]byte(nil), file...), uint64(block))
+}
+
+// Seals the plain block in sealed[BLOCK_DATA_OFF:] in place
+func (e *Encrypted) seal(sealed []byte, file []byte, block int64) error {
+	id, _, err := e.Keys.Current()
+	if err != nil { return err }
+	a, err := e.aead(id)
+	if err != nil { return err }
+	binary.LittleEndian.PutUint32(sealed[BLOCK_KEY_OFF:], id)
+	nonce := sealed[BLOCK_NONCE_OFF:BLOCK_DATA_OFF]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil { return err }
+	a.Seal(sealed[BLOCK_DATA_OFF:BLOCK_DATA_OFF], nonce, sealed[BLOCK_DATA_OFF:BLOCK_DATA_OFF+BLOCK_SIZE], blockData(file, block))
+	return nil
+}
+
+// Opens sealed in place, the plain block is left in sealed[BLOCK_DATA_OFF:]
+func (e *Encrypted) unseal(sealed []byte, file []byte, block int64) error {
+	id := binary.LittleEndian.Uint32(sealed[BLOCK_KEY_OFF:])
+	if id == 0 {
+		// never written, unless it was torn on the way
+		for _, b := range sealed {
+			if b != 0 { return ErrAuth }
+		}
+		return nil
+	}
+	a, err := e.aead(id)
+	if err != nil { return err }
+	_, err = a.Open(sealed[BLOCK_DATA_OFF:BLOCK_DATA_OFF], sealed[BLOCK_NONCE_OFF:BLOCK_DATA_OFF], sealed[BLOCK_DATA_OFF:], blockData(file, block))
+	if err != nil { return ErrAuth }
+	return nil
+}
+
+// Offsets and sizes are those of the plain file, it is as long
+// as the blocks it has
+type EncryptedFile struct {
+	e 		*Encrypted
+	st 		Storage
+	id 		[]byte // nil for a file from before the header
+	base 	int64 // where the first block starts
+	loaded 	bool // false until the file has a header or blocks
+	mux 	*sync.Mutex
+}
+
+// Reads the header once the file has one. Anything shorter than a block
+// without a whole header was never written past its header, or torn
+// while it was, it is empty
+func (f *EncryptedFile) load() error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.loaded { return nil }
+	hdr := make([]byte, FILE_HEADER_SIZE)
+	n, err := f.st.ReadAt(hdr, 0)
+	if err != nil && !errors.Is(err, io.EOF) { return err }
+	if n == len(hdr) && bytes.Equal(hdr[FILE_MAGIC_OFF:FILE_MAGIC_OFF+len(FILE_MAGIC)], FILE_MAGIC) {
+		f.id, f.base, f.loaded = hdr[FILE_ID_OFF:FILE_ID_OFF+FILE_ID_SIZE], FILE_HEADER_SIZE, true
+		return nil
+	}
+	size, err := f.st.Size()
+	if err != nil { return err }
+	f.loaded = size >= SEALED_SIZE
+	return nil
+}
+
+// Gives an empty file its header before the first block goes in.
+// It is synced on its own so no block is ever on disk without it
+func (f *EncryptedFile) create() error {
+	if err := f.load(); err != nil { return err }
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.loaded { return nil }
+	hdr := make([]byte, FILE_HEADER_SIZE)
+	copy(hdr[FILE_MAGIC_OFF:], FILE_MAGIC)
+	if _, err := io.ReadFull(rand.Reader, hdr[FILE_ID_OFF:FILE_ID_OFF+FILE_ID_SIZE]); err != nil { return err }
+	if err := f.st.Truncate(0); err != nil { return err }
+	n, err := f.st.WriteAt(hdr, 0)
+	if err != nil { return err }
+	if n < len(hdr) { return io.ErrShortWrite }
+	if err := f.st.Sync(); err != nil { return err }
+	f.id, f.base, f.loaded = hdr[FILE_ID_OFF:FILE_ID_OFF+FILE_ID_SIZE], FILE_HEADER_SIZE, true
+	return nil
+}
+
+func plain(sealed []byte, i int) []byte {
+	return sealed[i*SEALED_SIZE+BLOCK_DATA_OFF:i*SEALED_SIZE+BLOCK_DATA_OFF+BLOCK_SIZE]
+}
+
+// Reads the blocks from first on into sealed and opens them.
+// Returns how many there were, a block that fails ends the read with ErrAuth.
+// The blocks read whole before the store gave an error are still opened,
+// the end of the file is not an error
+func (f *EncryptedFile) readBlocks(sealed []byte, first int64) (int, error) {
+	n, err := f.st.ReadAt(sealed, f.base + first * SEALED_SIZE)
+	if errors.Is(err, io.EOF) { err = nil }
+	blocks := n / SEALED_SIZE
+	for i := range blocks {
+		if err := f.e.unseal(sealed[i*SEALED_SIZE:(i+1)*SEALED_SIZE], f.id, first + int64(i)); err != nil { return i, err }
+	}
+	return blocks, err
+}
+
+func (f *EncryptedFile) ReadAt(buff []byte, offset int64) (int, error) {
+	if len(buff) == 0 { return 0, nil }
+	if err := f.load(); err != nil || !f.loaded { return 0, err }
+	first, last := offset / BLOCK_SIZE, (offset + int64(len(buff)) - 1) / BLOCK_SIZE
+	sealed := make([]byte, (last - first + 1) * SEALED_SIZE)
+	blocks, err := f.readBlocks(sealed, first)
+	n, in := 0, int(offset % BLOCK_SIZE)
+	for i := range blocks {
+		n += copy(buff[n:], plain(sealed, i)[in:])
+		in = 0
+	}
+	return n, err
+}
+
+// A block written in part is read first, past the end it starts as zeroes
+func (f *EncryptedFile) WriteAt(buff []byte, offset int64) (int, error) {
+	if len(buff) == 0 { return 0, nil }
+	if err := f.create(); err != nil { return 0, err }
+	first, last := offset / BLOCK_SIZE, (offset + int64(len(buff)) - 1) / BLOCK_SIZE
+	count := int(last - first + 1)
+	sealed := make([]byte, count * SEALED_SIZE)
+	in, end := int(offset % BLOCK_SIZE), int((offset + int64(len(buff))) % BLOCK_SIZE)
+	if in != 0 {
+		if _, err := f.readBlocks(sealed[:SEALED_SIZE], first); err != nil { return 0, err }
+	}
+	if end != 0 && (last != first || in == 0) {
+		i := count - 1
+		if _, err := f.readBlocks(sealed[i*SEALED_SIZE:], last); err != nil { return 0, err }
+	}
+	n := 0
+	for i := range count {
+		n += copy(plain(sealed, i)[in:], buff[n:])
+		in = 0
+		if err := f.e.seal(sealed[i*SEALED_SIZE:(i+1)*SEALED_SIZE], f.id, first + int64(i)); err != nil { return 0, err }
+	}
+	m, err := f.st.WriteAt(sealed, f.base + first * SEALED_SIZE)
+	if err != nil { return 0, err }
+	if m < len(sealed) { return 0, io.ErrShortWrite }
+	return len(buff), nil
+}
+
+// Cutting into a block rewrites it with zeroes past size.
+// The header stays
+func (f *EncryptedFile) Truncate(size int64) error {
+	if err := f.load(); err != nil { return err }
+	if size == 0 && !f.loaded { return f.st.Truncate(0) }
+	if err := f.create(); err != nil { return err }
+	blocks := (size + BLOCK_SIZE - 1) / BLOCK_SIZE
+	had, err := f.Size()
+	if err != nil { return err }
+	if err := f.st.Truncate(f.base + blocks * SEALED_SIZE); err != nil { return err }
+	if size % BLOCK_SIZE == 0 || size >= had { return nil }
+	_, err = f.WriteAt(make([]byte, BLOCK_SIZE - size % BLOCK_SIZE), size)
+	return err
+}
+
+func (f *EncryptedFile) Size() (int64, error) {
+	if err := f.load(); err != nil || !f.loaded { return 0, err }
+	size, err := f.st.Size()
+	if err != nil { return 0, err }
+	return max(size - f.base, 0) / SEALED_SIZE * BLOCK_SIZE, nil
+}
+
+// Only whole blocks are given back, they read as never written
+func (f *EncryptedFile) Punch(offset, length int64) error {
+	p, ok := f.st.(Puncher)
+	first, end := (offset + BLOCK_SIZE - 1) / BLOCK_SIZE, (offset + length) / BLOCK_SIZE
+	if !ok || end <= first { return nil }
+	if err := f.load(); err != nil || !f.loaded { return err }
+	return p.Punch(f.base + first * SEALED_SIZE, (end - first) * SEALED_SIZE)
+}
+
+func (f *EncryptedFile) Sync() error { return f.st.Sync() }
+func (f *EncryptedFile) Lock(shared bool) error { return f.st.Lock(shared) }
+func (f *EncryptedFile) Close() error { return f.st.Close() }
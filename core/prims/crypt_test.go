@@ -0,0 +1,178 @@
+package prims
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func testKey(b byte) []byte { return bytes.Repeat([]byte{b}, 32) }
+
+func openFile(t *testing.T, v Volume, path string) Storage {
+	t.Helper()
+	st, err := v.Open(path, os.O_RDWR | os.O_CREATE)
+	if err != nil { t.Fatalf("Failed to open %s: %v", path, err) }
+	return st
+}
+
+// n bytes that differ from their neighbours, starting at seed
+func pattern(n int, seed byte) []byte {
+	buff := make([]byte, n)
+	for i := range buff { buff[i] = byte(i * 7) + seed }
+	return buff
+}
+
+func Test_CryptRotation(t *testing.T) {
+	mem := NewMemVolume()
+	ring := NewKeyRing()
+	ring.Add(1, testKey(1))
+	st := openFile(t, Encrypt(mem, ring), "rotate")
+	if _, err := st.WriteAt(pattern(BLOCK_SIZE, 1), 0); err != nil { t.Fatalf("Failed to write: %v", err) }
+	ring.Rotate(testKey(2))
+	if _, err := st.WriteAt(pattern(BLOCK_SIZE, 2), BLOCK_SIZE); err != nil { t.Fatalf("Failed to write: %v", err) }
+
+	// each block names its own key, both read
+	buff := make([]byte, 2 * BLOCK_SIZE)
+	if n, err := st.ReadAt(buff, 0); err != nil || n != len(buff) { t.Fatalf("Read %d bytes, err %v", n, err) }
+	if !bytes.Equal(buff, append(pattern(BLOCK_SIZE, 1), pattern(BLOCK_SIZE, 2)...)) { t.Fatalf("Read back other bytes") }
+
+	// without the old key only the new block reads
+	newer := NewKeyRing()
+	newer.Add(2, testKey(2))
+	old := openFile(t, Encrypt(mem, newer), "rotate")
+	if _, err := old.ReadAt(buff[:BLOCK_SIZE], BLOCK_SIZE); err != nil { t.Fatalf("Failed to read the new block: %v", err) }
+	if _, err := old.ReadAt(buff[:BLOCK_SIZE], 0); !errors.Is(err, ErrNoKey) { t.Fatalf("Read a block without its key, err %v", err) }
+
+	// written again it is sealed with the current key
+	if _, err := st.WriteAt(pattern(BLOCK_SIZE, 1), 0); err != nil { t.Fatalf("Failed to write: %v", err) }
+	if _, err := old.ReadAt(buff[:BLOCK_SIZE], 0); err != nil { t.Fatalf("Rewritten block still needs the old key: %v", err) }
+	if !bytes.Equal(buff[:BLOCK_SIZE], pattern(BLOCK_SIZE, 1)) { t.Fatalf("Read back other bytes") }
+}
+
+func Test_CryptTampering(t *testing.T) {
+	mem := NewMemVolume()
+	enc := Encrypt(mem, StaticKey(testKey(1)))
+	for _, path := range []string{"data", "wal"} {
+		st := openFile(t, enc, path)
+		if _, err := st.WriteAt(pattern(3 * BLOCK_SIZE, 5), 0); err != nil { t.Fatalf("Failed to write %s: %v", path, err) }
+	}
+	sealed := func(path string, block int) []byte {
+		data := mem.files[path].data
+		off := FILE_HEADER_SIZE + block * SEALED_SIZE
+		return data[off:off + SEALED_SIZE]
+	}
+	read := func(path string, block int) error {
+		_, err := openFile(t, enc, path).ReadAt(make([]byte, BLOCK_SIZE), int64(block) * BLOCK_SIZE)
+		return err
+	}
+	for block := range 3 {
+		if err := read("data", block); err != nil { t.Fatalf("Failed to read block %d: %v", block, err) }
+	}
+
+	// a flipped bit anywhere past the key id
+	for _, at := range []int{BLOCK_NONCE_OFF, BLOCK_DATA_OFF, BLOCK_DATA_OFF + 100, SEALED_SIZE - 1} {
+		sealed("data", 0)[at] ^= 1
+		if err := read("data", 0); !errors.Is(err, ErrAuth) { t.Fatalf("Read a block flipped at %d, err %v", at, err) }
+		sealed("data", 0)[at] ^= 1
+	}
+
+	// moved within the file
+	keep := append([]byte(nil), sealed("data", 1)...)
+	copy(sealed("data", 1), sealed("data", 2))
+	if err := read("data", 1); !errors.Is(err, ErrAuth) { t.Fatalf("Read a block moved in the file, err %v", err) }
+	copy(sealed("data", 1), keep)
+
+	// moved to the same place in another file, the log is written with the same keys
+	copy(sealed("data", 2), sealed("wal", 2))
+	if err := read("data", 2); !errors.Is(err, ErrAuth) { t.Fatalf("Read a block from another file, err %v", err) }
+
+	// the id goes with a renamed file
+	if err := enc.Rename("wal", "wal.moved"); err != nil { t.Fatalf("Failed to rename: %v", err) }
+	if err := read("wal.moved", 2); err != nil { t.Fatalf("Failed to read a renamed file: %v", err) }
+}
+
+func Test_CryptPartialWrite(t *testing.T) {
+	st := openFile(t, Encrypt(NewMemVolume(), StaticKey(testKey(1))), "partial")
+	want := make([]byte, 3 * BLOCK_SIZE)
+
+	// across a block boundary into a file that has nothing yet
+	write := func(off int, buff []byte) {
+		if _, err := st.WriteAt(buff, int64(off)); err != nil { t.Fatalf("Failed to write at %d: %v", off, err) }
+		copy(want[off:], buff)
+	}
+	write(BLOCK_SIZE - 100, pattern(300, 1))
+	if size, err := st.Size(); err != nil || size != 2 * BLOCK_SIZE { t.Fatalf("Size %d, err %v", size, err) }
+	// inside a block that has data around it, and at the start of the next
+	write(BLOCK_SIZE + 500, pattern(10, 2))
+	write(2 * BLOCK_SIZE, pattern(1, 3))
+
+	got := make([]byte, len(want))
+	if n, err := st.ReadAt(got, 0); err != nil || n != len(want) { t.Fatalf("Read %d bytes, err %v", n, err) }
+	if !bytes.Equal(got, want) { t.Fatalf("Read back other bytes") }
+
+	// cut in the middle of a block, the rest of it reads as zeroes
+	if err := st.Truncate(BLOCK_SIZE + 100); err != nil { t.Fatalf("Failed to truncate: %v", err) }
+	clear(want[BLOCK_SIZE + 100:])
+	if n, err := st.ReadAt(got, 0); err != nil || n != 2 * BLOCK_SIZE { t.Fatalf("Read %d bytes, err %v", n, err) }
+	if !bytes.Equal(got[:2 * BLOCK_SIZE], want[:2 * BLOCK_SIZE]) { t.Fatalf("Truncate kept other bytes") }
+
+	// the header survives cutting the file to nothing
+	if err := st.Truncate(0); err != nil { t.Fatalf("Failed to truncate: %v", err) }
+	write(10, pattern(10, 4))
+	if n, err := st.ReadAt(got[:20], 0); err != nil || n != 20 || !bytes.Equal(got[10:20], pattern(10, 4)) { t.Fatalf("Read %d bytes after truncate, err %v", n, err) }
+}
+
+// Hands back io.EOF along with what it read, like os.File does
+type eofStorage struct { *Memory }
+
+func (s eofStorage) ReadAt(buff []byte, offset int64) (int, error) {
+	n, err := s.Memory.ReadAt(buff, offset)
+	if err == nil && n < len(buff) { err = io.EOF }
+	return n, err
+}
+
+type eofVolume struct { *MemVolume }
+
+func (v eofVolume) Open(path string, flag int) (Storage, error) {
+	st, err := v.MemVolume.Open(path, flag)
+	if err != nil { return nil, err }
+	return eofStorage{ st.(*Memory) }, nil
+}
+
+func Test_CryptShortRead(t *testing.T) {
+	st := openFile(t, Encrypt(eofVolume{ NewMemVolume() }, StaticKey(testKey(1))), "eof")
+	if _, err := st.WriteAt(pattern(BLOCK_SIZE + 10, 1), 0); err != nil { t.Fatalf("Failed to write: %v", err) }
+
+	// the blocks there are read, the end of the file is no error
+	got := make([]byte, 4 * BLOCK_SIZE)
+	n, err := st.ReadAt(got, 0)
+	if err != nil || n != 2 * BLOCK_SIZE { t.Fatalf("Read %d bytes, err %v", n, err) }
+	if !bytes.Equal(got[:BLOCK_SIZE + 10], pattern(BLOCK_SIZE + 10, 1)) { t.Fatalf("Read back other bytes") }
+	// a write into the last block reads it first
+	if _, err := st.WriteAt(pattern(5, 9), BLOCK_SIZE + 10); err != nil { t.Fatalf("Failed to write: %v", err) }
+	if _, err := st.ReadAt(got[:BLOCK_SIZE + 15], 0); err != nil { t.Fatalf("Failed to read: %v", err) }
+	if !bytes.Equal(got[:BLOCK_SIZE + 15], append(pattern(BLOCK_SIZE + 10, 1), pattern(5, 9)...)) { t.Fatalf("Write lost the block it went into") }
+}
+
+// Files sealed before the header still read and take writes
+func Test_CryptNoHeader(t *testing.T) {
+	mem := NewMemVolume()
+	enc := Encrypt(mem, StaticKey(testKey(1)))
+	sealed := make([]byte, 2 * SEALED_SIZE)
+	for i := range 2 {
+		copy(plain(sealed, i), pattern(BLOCK_SIZE, byte(i)))
+		if err := enc.seal(sealed[i*SEALED_SIZE:(i+1)*SEALED_SIZE], nil, int64(i)); err != nil { t.Fatalf("Failed to seal: %v", err) }
+	}
+	raw := openFile(t, mem, "old")
+	if _, err := raw.WriteAt(sealed, 0); err != nil { t.Fatalf("Failed to write: %v", err) }
+
+	st := openFile(t, enc, "old")
+	got := make([]byte, 2 * BLOCK_SIZE)
+	if n, err := st.ReadAt(got, 0); err != nil || n != len(got) { t.Fatalf("Read %d bytes, err %v", n, err) }
+	if !bytes.Equal(got, append(pattern(BLOCK_SIZE, 0), pattern(BLOCK_SIZE, 1)...)) { t.Fatalf("Read back other bytes") }
+	if _, err := st.WriteAt(pattern(10, 7), BLOCK_SIZE); err != nil { t.Fatalf("Failed to write: %v", err) }
+	if size, _ := raw.Size(); size != 2 * SEALED_SIZE { t.Fatalf("File without a header grew one, %d bytes", size) }
+	if _, err := openFile(t, enc, "old").ReadAt(got[:10], BLOCK_SIZE); err != nil || !bytes.Equal(got[:10], pattern(10, 7)) { t.Fatalf("Failed to read the write back: %v", err) }
+}
@@ -0,0 +1,267 @@
+package prims
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// A disk that fails on purpose, for testing what survives.
+// Writes land in memory at once but only become durable with a sync.
+// After a crash every call fails until Restart hands over what
+// the disk would hold when the power comes back.
+// Creating, renaming and removing files is durable right away.
+type FaultVolume struct {
+	Faults
+	files 	map[string]*faultData
+	bad 	map[string][][2]int64 // ranges that always fail, [off, end)
+	writes 	int
+	syncs 	int
+	crashed bool
+	rand 	*rand.Rand
+	mux 	*sync.Mutex
+}
+
+type Faults struct {
+	CrashAt 		int // the power goes during this write, counting from 1, 0 never
+	FailAt 			int // this write returns EIO and changes nothing
+	KeepUnsynced 	bool // a crash keeps a random part of the unsynced writes, in any order
+	Tear 			bool // the write the power went during lands cut short
+	Seed 			int64
+}
+
+const SECTOR_SIZE = 512 // the most a torn write is sure to get right
+
+var ErrCrashed = errors.New("Storage lost power")
+
+type faultData struct {
+	durable *Memory
+	live 	*Memory
+	pending []faultWrite // since the last sync, in order
+}
+
+type faultWrite struct {
+	off 	int64
+	data 	[]byte
+	resize 	bool // a truncate to off
+	torn 	bool // the power went during it
+}
+
+func NewFaultVolume(f Faults) *FaultVolume {
+	return &FaultVolume{
+		Faults: f,
+		files: make(map[string]*faultData),
+		bad: make(map[string][][2]int64),
+		rand: rand.New(rand.NewSource(f.Seed)),
+		mux: &sync.Mutex{},
+	}
+}
+
+// Writes so far, across every file
+func (v *FaultVolume) Writes() int {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	return v.writes
+}
+
+// Syncs so far, across every file
+func (v *FaultVolume) Syncs() int {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	return v.syncs
+}
+
+func (v *FaultVolume) Crashed() bool {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	return v.crashed
+}
+
+// Pulls the plug, nothing written after this counts
+func (v *FaultVolume) Crash() {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	v.crashed = true
+}
+
+// Reads and writes touching [off, off+length) of path return EIO
+func (v *FaultVolume) FailRange(path string, off, length int64) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	v.bad[path] = append(v.bad[path], [2]int64{off, off + length})
+}
+
+// The disk after the power comes back, with the faults of f.
+// What was synced is there, what was not is gone
+// unless KeepUnsynced let some of it through.
+func (v *FaultVolume) Restart(f Faults) *FaultVolume {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	v.crashed = true
+	next := NewFaultVolume(f)
+	for path, fd := range v.files {
+		data := append([]byte(nil), fd.durable.data...)
+		kept := fd.pending
+		if v.KeepUnsynced {
+			kept = nil
+			for _, w := range fd.pending {
+				if v.rand.Intn(2) == 0 { kept = append(kept, w) }
+			}
+			v.rand.Shuffle(len(kept), func(i, j int) { kept[i], kept[j] = kept[j], kept[i] })
+		} else {
+			// only the torn write is left, it was the last
+			kept = nil
+			if n := len(fd.pending); n > 0 && fd.pending[n-1].torn { kept = fd.pending[n-1:] }
+		}
+		durable := &Memory{ data: data, mux: &sync.RWMutex{} }
+		for _, w := range kept { w.apply(durable) }
+		live := &Memory{ data: append([]byte(nil), durable.data...), mux: &sync.RWMutex{} }
+		next.files[path] = &faultData{ durable: durable, live: live }
+	}
+	// the old disk is gone
+	v.files = nil
+	return next
+}
+
+func (w faultWrite) apply(m *Memory) {
+	if w.resize {
+		m.Truncate(w.off)
+		return
+	}
+	m.WriteAt(w.data, w.off)
+}
+
+func (v *FaultVolume) Open(path string, flag int) (Storage, error) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	if v.crashed { return nil, ErrCrashed }
+	fd, ok := v.files[path]
+	if !ok {
+		if flag & os.O_CREATE == 0 { return nil, &os.PathError{ Op: "open", Path: path, Err: os.ErrNotExist } }
+		fd = &faultData{ durable: NewMemory(), live: NewMemory() }
+		v.files[path] = fd
+	}
+	return readOnly(&FaultFile{ v: v, path: path }, flag), nil
+}
+
+func (v *FaultVolume) Remove(path string) error {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	if v.crashed { return ErrCrashed }
+	if _, ok := v.files[path]; !ok { return &os.PathError{ Op: "remove", Path: path, Err: os.ErrNotExist } }
+	delete(v.files, path)
+	return nil
+}
+
+func (v *FaultVolume) Rename(oldPath, newPath string) error {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	if v.crashed { return ErrCrashed }
+	fd, ok := v.files[oldPath]
+	if !ok { return &os.LinkError{ Op: "rename", Old: oldPath, New: newPath, Err: os.ErrNotExist } }
+	v.files[newPath] = fd
+	delete(v.files, oldPath)
+	return nil
+}
+
+func (v *FaultVolume) Mkdir(dir string) error { return v.alive() }
+func (v *FaultVolume) SyncDir(dir string) error { return v.alive() }
+
+func (v *FaultVolume) alive() error {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	if v.crashed { return ErrCrashed }
+	return nil
+}
+
+// Goes through the volume every time so nothing is kept of a disk that is gone
+type FaultFile struct {
+	v 		*FaultVolume
+	path 	string
+}
+
+// Under the lock of the volume
+func (f *FaultFile) data() (*faultData, error) {
+	if f.v.crashed { return nil, ErrCrashed }
+	fd, ok := f.v.files[f.path]
+	if !ok { return nil, ErrClosed }
+	return fd, nil
+}
+
+func (f *FaultFile) failsAt(off, length int64) bool {
+	for _, r := range f.v.bad[f.path] {
+		if off < r[1] && off + length > r[0] { return true }
+	}
+	return false
+}
+
+func (f *FaultFile) eio(op string) error { return &os.PathError{ Op: op, Path: f.path, Err: syscall.EIO } }
+
+func (f *FaultFile) ReadAt(buff []byte, offset int64) (int, error) {
+	f.v.mux.Lock()
+	defer f.v.mux.Unlock()
+	fd, err := f.data()
+	if err != nil { return 0, err }
+	if f.failsAt(offset, int64(len(buff))) { return 0, f.eio("read") }
+	return fd.live.ReadAt(buff, offset)
+}
+
+func (f *FaultFile) WriteAt(buff []byte, offset int64) (int, error) {
+	w := faultWrite{ off: offset, data: append([]byte(nil), buff...) }
+	if err := f.write(w); err != nil { return 0, err }
+	return len(buff), nil
+}
+
+func (f *FaultFile) Truncate(size int64) error {
+	return f.write(faultWrite{ off: size, resize: true })
+}
+
+// Counts the write and decides what happens to it
+func (f *FaultFile) write(w faultWrite) error {
+	v := f.v
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	fd, err := f.data()
+	if err != nil { return err }
+	v.writes++
+	if v.writes == v.CrashAt {
+		v.crashed = true
+		if v.Tear && !w.resize && len(w.data) > 0 {
+			// the first few sectors made it
+			sectors := (len(w.data) + SECTOR_SIZE - 1) / SECTOR_SIZE
+			w.data, w.torn = w.data[:v.rand.Intn(sectors) * SECTOR_SIZE], true
+			fd.pending = append(fd.pending, w)
+		}
+		return ErrCrashed
+	}
+	if v.writes == v.FailAt || (!w.resize && f.failsAt(w.off, int64(len(w.data)))) { return f.eio("write") }
+	w.apply(fd.live)
+	fd.pending = append(fd.pending, w)
+	return nil
+}
+
+func (f *FaultFile) Sync() error {
+	f.v.mux.Lock()
+	defer f.v.mux.Unlock()
+	fd, err := f.data()
+	if err != nil { return err }
+	f.v.syncs++
+	for _, w := range fd.pending { w.apply(fd.durable) }
+	fd.pending = fd.pending[:0]
+	return nil
+}
+
+func (f *FaultFile) Size() (int64, error) {
+	f.v.mux.Lock()
+	defer f.v.mux.Unlock()
+	fd, err := f.data()
+	if err != nil { return 0, err }
+	return fd.live.Size()
+}
+
+func (f *FaultFile) Lock(shared bool) error { return nil }
+
+// The data stays in the volume for the next Open
+func (f *FaultFile) Close() error { return nil }
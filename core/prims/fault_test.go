@@ -0,0 +1,69 @@
+package prims
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// What path holds on v, nil if it isnt there
+func contents(t *testing.T, v Volume, path string) []byte {
+	t.Helper()
+	st, err := v.Open(path, os.O_RDONLY)
+	if errors.Is(err, os.ErrNotExist) { return nil }
+	if err != nil { t.Fatalf("Failed to open %s: %v", path, err) }
+	data, err := ReadAll(st)
+	if err != nil { t.Fatalf("Failed to read %s: %v", path, err) }
+	return data
+}
+
+func Test_FaultSync(t *testing.T) {
+	v := NewFaultVolume(Faults{})
+	st := openFile(t, v, "data")
+	if _, err := st.WriteAt([]byte("synced"), 0); err != nil { t.Fatalf("Failed to write: %v", err) }
+	if err := st.Sync(); err != nil { t.Fatalf("Failed to sync: %v", err) }
+	if _, err := st.WriteAt([]byte("lost"), 6); err != nil { t.Fatalf("Failed to write: %v", err) }
+	if err := st.Truncate(2); err != nil { t.Fatalf("Failed to truncate: %v", err) }
+	openFile(t, v, "created")
+	if err := v.Rename("created", "renamed"); err != nil { t.Fatalf("Failed to rename: %v", err) }
+	if v.Writes() != 3 || v.Syncs() != 1 { t.Fatalf("Counted %d writes and %d syncs", v.Writes(), v.Syncs()) }
+
+	// only the synced write is left, files are there as soon as they are made
+	v.Crash()
+	if _, err := st.WriteAt([]byte("x"), 0); !errors.Is(err, ErrCrashed) { t.Fatalf("Wrote after the crash, err %v", err) }
+	if _, err := v.Open("data", os.O_RDONLY); !errors.Is(err, ErrCrashed) { t.Fatalf("Opened after the crash, err %v", err) }
+	next := v.Restart(Faults{})
+	if got := contents(t, next, "data"); string(got) != "synced" { t.Fatalf("Disk came back with %q", got) }
+	if contents(t, next, "created") != nil { t.Fatalf("Renamed file kept its old name") }
+	if _, err := next.Open("renamed", os.O_RDONLY); err != nil { t.Fatalf("Renamed file is gone: %v", err) }
+}
+
+func Test_FaultWrites(t *testing.T) {
+	// the second write fails and changes nothing
+	v := NewFaultVolume(Faults{ FailAt: 2 })
+	st := openFile(t, v, "data")
+	if _, err := st.WriteAt([]byte("aaaa"), 0); err != nil { t.Fatalf("Failed to write: %v", err) }
+	if _, err := st.WriteAt([]byte("bb"), 0); !errors.Is(err, syscall.EIO) { t.Fatalf("Write past FailAt returned %v", err) }
+	if got := contents(t, v, "data"); string(got) != "aaaa" { t.Fatalf("Failed write left %q", got) }
+
+	// a bad range fails reads and writes touching it, not the ones beside it
+	v.FailRange("data", 2, 1)
+	if _, err := st.ReadAt(make([]byte, 2), 1); !errors.Is(err, syscall.EIO) { t.Fatalf("Read a bad range, err %v", err) }
+	if _, err := st.WriteAt([]byte("c"), 2); !errors.Is(err, syscall.EIO) { t.Fatalf("Wrote a bad range, err %v", err) }
+	if _, err := st.WriteAt([]byte("cc"), 0); err != nil { t.Fatalf("Failed to write beside a bad range: %v", err) }
+
+	// the power goes during the third write, the sectors before the tear made it
+	old := bytes.Repeat([]byte{ 1 }, 4 * SECTOR_SIZE)
+	v = NewFaultVolume(Faults{ CrashAt: 3, Tear: true, Seed: 3 })
+	st = openFile(t, v, "data")
+	if _, err := st.WriteAt(old, 0); err != nil { t.Fatalf("Failed to write: %v", err) }
+	if err := st.Sync(); err != nil { t.Fatalf("Failed to sync: %v", err) }
+	if _, err := st.WriteAt([]byte("gone"), 0); err != nil { t.Fatalf("Failed to write: %v", err) }
+	if _, err := st.WriteAt(bytes.Repeat([]byte{ 2 }, len(old)), 0); !errors.Is(err, ErrCrashed) { t.Fatalf("Write the power went in returned %v", err) }
+	got := contents(t, v.Restart(Faults{}), "data")
+	torn := bytes.IndexByte(got, 1)
+	if len(got) != len(old) || torn % SECTOR_SIZE != 0 { t.Fatalf("Torn at %d of %d bytes", torn, len(got)) }
+	if !bytes.Equal(got[:torn], bytes.Repeat([]byte{ 2 }, torn)) || !bytes.Equal(got[torn:], old[torn:]) { t.Fatalf("Torn write left other bytes") }
+}
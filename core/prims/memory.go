@@ -0,0 +1,102 @@
+package prims
+
+import (
+	"os"
+	"sync"
+)
+
+// Keeps every file in memory, nothing survives the process.
+// A file stays in the volume after Close so it can be opened again.
+type MemVolume struct {
+	files 	map[string]*Memory
+	mux 	*sync.Mutex
+}
+
+func NewMemVolume() *MemVolume {
+	return &MemVolume{ files: make(map[string]*Memory), mux: &sync.Mutex{} }
+}
+
+func (v *MemVolume) Open(path string, flag int) (Storage, error) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	m, ok := v.files[path]
+	if !ok {
+		if flag & os.O_CREATE == 0 { return nil, &os.PathError{ Op: "open", Path: path, Err: os.ErrNotExist } }
+		m = NewMemory()
+		v.files[path] = m
+	}
+	return readOnly(m, flag), nil
+}
+
+func (v *MemVolume) Remove(path string) error {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	if _, ok := v.files[path]; !ok { return &os.PathError{ Op: "remove", Path: path, Err: os.ErrNotExist } }
+	delete(v.files, path)
+	return nil
+}
+
+func (v *MemVolume) Rename(oldPath, newPath string) error {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	m, ok := v.files[oldPath]
+	if !ok { return &os.LinkError{ Op: "rename", Old: oldPath, New: newPath, Err: os.ErrNotExist } }
+	v.files[newPath] = m
+	delete(v.files, oldPath)
+	return nil
+}
+
+func (v *MemVolume) Mkdir(dir string) error { return nil }
+func (v *MemVolume) SyncDir(dir string) error { return nil }
+
+type Memory struct {
+	data 	[]byte
+	mux 	*sync.RWMutex
+}
+
+func NewMemory() *Memory { return &Memory{ mux: &sync.RWMutex{} } }
+
+func (m *Memory) ReadAt(buff []byte, offset int64) (int, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	if offset >= int64(len(m.data)) { return 0, nil }
+	return copy(buff, m.data[offset:]), nil
+}
+
+func (m *Memory) WriteAt(buff []byte, offset int64) (int, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if end := offset + int64(len(buff)); end > int64(len(m.data)) { m.resize(end) }
+	return copy(m.data[offset:], buff), nil
+}
+
+func (m *Memory) Truncate(size int64) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.resize(size)
+	return nil
+}
+
+// grows with zeroes like a sparse file
+func (m *Memory) resize(size int64) {
+	if size <= int64(cap(m.data)) {
+		old := len(m.data)
+		m.data = m.data[:size]
+		if int(size) > old { clear(m.data[old:]) }
+		return
+	}
+	data := make([]byte, size, max(size, int64(cap(m.data)) * 2))
+	copy(data, m.data)
+	m.data = data
+}
+
+func (m *Memory) Size() (int64, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	return int64(len(m.data)), nil
+}
+
+func (m *Memory) Sync() error { return nil }
+// nothing outside the process can see it
+func (m *Memory) Lock(shared bool) error { return nil }
+func (m *Memory) Close() error { return nil }
@@ -0,0 +1,80 @@
+package prims
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrUnaligned = errors.New("Write doesnt cover whole blocks")
+
+// Keeps what is written in memory on top of a store that is only read,
+// in whole blocks. A reader replays the log of a writer at work into one
+// since it cant write the file, nothing of it ever reaches the disk.
+type Overlay struct {
+	st 		Storage
+	block 	int64
+	blocks 	map[int64][]byte // by offset
+	mux 	*sync.RWMutex
+}
+
+func NewOverlay(st Storage, block int) *Overlay {
+	return &Overlay{ st: st, block: int64(block), blocks: make(map[int64][]byte), mux: &sync.RWMutex{} }
+}
+
+// The store underneath with the blocks written so far over it
+func (o *Overlay) ReadAt(buff []byte, offset int64) (int, error) {
+	n, err := o.st.ReadAt(buff, offset)
+	o.mux.RLock()
+	defer o.mux.RUnlock()
+	end := offset + int64(len(buff))
+	covered := true
+	for at := offset - offset % o.block; at < end; at += o.block {
+		b, ok := o.blocks[at]
+		if !ok {
+			covered = false
+			continue
+		}
+		lo, hi := max(at, offset), min(at + o.block, end)
+		copy(buff[lo-offset:hi-offset], b[lo-at:hi-at])
+		n = max(n, int(hi - offset))
+	}
+	// what the store couldnt read is written over
+	if covered { err = nil }
+	return n, err
+}
+
+func (o *Overlay) WriteAt(buff []byte, offset int64) (int, error) {
+	if offset % o.block != 0 || int64(len(buff)) % o.block != 0 { return 0, ErrUnaligned }
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	for at := int64(0); at < int64(len(buff)); at += o.block {
+		b, ok := o.blocks[offset + at]
+		if !ok {
+			b = make([]byte, o.block)
+			o.blocks[offset + at] = b
+		}
+		copy(b, buff[at:])
+	}
+	return len(buff), nil
+}
+
+func (o *Overlay) Size() (int64, error) {
+	size, err := o.st.Size()
+	if err != nil { return 0, err }
+	o.mux.RLock()
+	defer o.mux.RUnlock()
+	for at := range o.blocks { size = max(size, at + o.block) }
+	return size, nil
+}
+
+// there is nothing on disk to sync
+func (o *Overlay) Sync() error { return nil }
+func (o *Overlay) Truncate(size int64) error { return ErrReadOnly }
+func (o *Overlay) Lock(shared bool) error { return o.st.Lock(shared) }
+
+func (o *Overlay) Close() error {
+	o.mux.Lock()
+	o.blocks = nil
+	o.mux.Unlock()
+	return o.st.Close()
+}
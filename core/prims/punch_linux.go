@@ -0,0 +1,11 @@
+package prims
+
+import "syscall"
+
+const PUNCH_HOLE = 0x01 | 0x02 // FALLOC_FL_KEEP_SIZE | FALLOC_FL_PUNCH_HOLE
+
+// Other systems keep the space
+func (f *File) Punch(offset, length int64) error {
+	if f.fd < 0 { return ErrClosed }
+	return syscall.Fallocate(f.fd, PUNCH_HOLE, offset, length)
+}
@@ -0,0 +1,137 @@
+package prims
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Where the bytes of a database file live. Reads past the end
+// come back short without an error, like pread.
+type Storage interface {
+	ReadAt(buff []byte, offset int64) (int, error)
+	WriteAt(buff []byte, offset int64) (int, error)
+	Sync() error
+	Truncate(size int64) error
+	Size() (int64, error)
+	// takes an advisory lock on the file until it is closed, shared ones
+	// get along with each other. ErrLocked at once if someone else has
+	// one in the way. The lock belongs to this open of the file, another
+	// open of it is locked out even in the same process
+	Lock(shared bool) error
+	Close() error
+}
+
+// Opens the files a database is made of, the log segments
+// live in a directory next to the main file
+type Volume interface {
+	// flag is O_RDONLY or O_RDWR, with O_CREATE to make a missing file,
+	// otherwise that is os.ErrNotExist
+	Open(path string, flag int) (Storage, error)
+	Remove(path string) error
+	// puts a file in place of whatever newPath was, in one step
+	Rename(oldPath, newPath string) error
+	Mkdir(dir string) error
+	// gets files created and removed in dir to survive a crash
+	SyncDir(dir string) error
+}
+
+// A store that can give back the disk space under part of a file,
+// what the part reads as after is undefined
+type Puncher interface {
+	Punch(offset, length int64) error
+}
+
+var (
+	ErrClosed 	= errors.New("File not open")
+	ErrLocked 	= errors.New("File is locked by another open of it")
+	ErrReadOnly = errors.New("File is open read only")
+)
+
+// Reads the whole of st
+func ReadAll(st Storage) ([]byte, error) {
+	size, err := st.Size()
+	if err != nil { return nil, err }
+	data := make([]byte, size)
+	n, err := st.ReadAt(data, 0)
+	return data[:n], err
+}
+
+// OS FILES
+type OS struct{}
+
+func (OS) Open(path string, flag int) (Storage, error) {
+	file, err := os.OpenFile(path, flag, 0644)
+	if err != nil { return nil, err }
+	return &File{ file: file, fd: int(file.Fd()) }, nil
+}
+
+func (OS) Remove(path string) error { return os.Remove(path) }
+func (OS) Rename(oldPath, newPath string) error { return os.Rename(oldPath, newPath) }
+func (OS) Mkdir(dir string) error { return os.MkdirAll(dir, 0755) }
+
+func (OS) SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil { return err }
+	defer d.Close()
+	return d.Sync()
+}
+
+type File struct {
+	file 	*os.File
+	fd 		int
+}
+
+func (f *File) ReadAt(buff []byte, offset int64) (int, error) {
+	if f.fd < 0 { return 0, ErrClosed }
+	return syscall.Pread(f.fd, buff, offset)
+}
+
+func (f *File) WriteAt(buff []byte, offset int64) (int, error) {
+	if f.fd < 0 { return 0, ErrClosed }
+	return syscall.Pwrite(f.fd, buff, offset)
+}
+
+func (f *File) Sync() error {
+	if f.fd < 0 { return ErrClosed }
+	return syscall.Fsync(f.fd)
+}
+
+func (f *File) Truncate(size int64) error {
+	if f.fd < 0 { return ErrClosed }
+	return syscall.Ftruncate(f.fd, size)
+}
+
+func (f *File) Size() (int64, error) {
+	if f.fd < 0 { return 0, ErrClosed }
+	info, err := f.file.Stat()
+	if err != nil { return 0, err }
+	return info.Size(), nil
+}
+
+func (f *File) Lock(shared bool) error {
+	if f.fd < 0 { return ErrClosed }
+	how := syscall.LOCK_EX
+	if shared { how = syscall.LOCK_SH }
+	err := syscall.Flock(f.fd, how | syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK { return ErrLocked }
+	return err
+}
+
+func (f *File) Close() error {
+	if f.fd < 0 { return nil }
+	f.fd = -1
+	return f.file.Close()
+}
+
+// Turns away anything that writes, for volumes that dont have the OS to
+func readOnly(st Storage, flag int) Storage {
+	if flag & (os.O_WRONLY | os.O_RDWR) != 0 { return st }
+	return &readOnlyStore{ st }
+}
+
+type readOnlyStore struct{ Storage }
+
+func (readOnlyStore) WriteAt(buff []byte, offset int64) (int, error) { return 0, ErrReadOnly }
+func (readOnlyStore) Truncate(size int64) error { return ErrReadOnly }
+func (readOnlyStore) Sync() error { return ErrReadOnly }
@@ -1,34 +1,77 @@
 package table
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"sync"
+	"time"
 	"mydb/core/cache"
+	"mydb/core/engine"
 	"mydb/core/fsm"
 	"mydb/core/indexes"
 	"mydb/core/logger"
 	"mydb/core/pages"
+	"mydb/core/prims"
 	"mydb/core/types"
+	"mydb/utils"
 )
 
+const (
+	// byte runs closer than a record card are logged as one action
+	DIFF_GAP = logger.TRX_SIZE
+	// reads of a page a reader finds torn before it believes it
+	TORN_RETRIES = 5
+	// pages a checkpoint writes between two messages
+	CHECKPOINT_STEP = 64
+)
+
+var (
+	ErrBackupTooLong = errors.New("Backup held on to more log than the backup log limit")
+	ErrFailed = errors.New("Table failed to cancel a transaction, open the database again to recover it")
+)
+
+// What START_BACKUP sends back, LOG_END and END_BACKUP take the id
+type BackupStart struct {
+	Id 		uint64
+	Start 	logger.Mark
+}
+
 type BaseTable struct {
 	Code 	  	types.TableCode
-	Fd 			int
+	Store 		prims.Storage
 	db 			types.DatabaseI
+	Options 	types.Options
 	Logger 		*logger.Logger
 	FSM 		*fsm.FSM
 	Cache 		*cache.Cache
 	Index 		*indexes.Idx
+	MetaPage 	*pages.Page
 	Columns 	map[string]Column
 	RowPool		*sync.Pool
+	// running, checkpoints wait for the ones still true. One that
+	// held the log past BackupLogLimit is let go and fails
+	backups 	map[uint64]bool
+	lastBackup 	uint64
+	ckpt 		*checkpointRun // under way, nil between checkpoints
+	failed 		error // set by a cancel that couldnt put its pages back
+}
+
+// A checkpoint written out a few pages at a time between messages
+type checkpointRun struct {
+	mark 	logger.Mark
+	dirty 	[]uint64 // pages dirty at the mark not written yet
 }
 
 func (t *BaseTable) GetCode() types.TableCode { return t.Code }
-func (t *BaseTable) GetFd() int { return t.Fd }
-func (t *BaseTable) SetFd(fd int) { t.Fd = fd }
+func (t *BaseTable) GetStore() prims.Storage { return t.Store }
+func (t *BaseTable) SetStore(store prims.Storage) { t.Store = store }
 func (t *BaseTable) GetColumns() map[string]Column { return t.Columns }
 func (t *BaseTable) SetColumns(columns map[string]Column) { t.Columns = columns }
 func (t *BaseTable) GetDatabase() types.DatabaseI { return t.db }
 func (t *BaseTable) SetDatabase(db types.DatabaseI) { t.db = db }
+func (t *BaseTable) GetOptions() types.Options { return t.Options }
+func (t *BaseTable) SetOptions(opts types.Options) { t.Options = opts }
 
 func (t *BaseTable) GetCache() *cache.Cache { return t.Cache }
 func (t *BaseTable) SetCache(cache *cache.Cache) { t.Cache = cache }
@@ -39,6 +82,9 @@ func (t *BaseTable) SetFSM(fsm *fsm.FSM) { t.FSM = fsm }
 func (t *BaseTable) GetLogger() *logger.Logger { return t.Logger }
 func (t *BaseTable) SetLogger(logger *logger.Logger) { t.Logger = logger }
 
+func (t *BaseTable) GetMetaPage() *pages.Page { return t.MetaPage }
+func (t *BaseTable) SetMetaPage(p *pages.Page) { t.MetaPage = p }
+
 func (t *BaseTable) GetRow() any { return t.RowPool.Get() }
 func (t *BaseTable) PutRow(row any) { t.RowPool.Put(row) }
 
@@ -47,12 +93,311 @@ func (t *BaseTable) GetPage(pid *pages.PageId) (types.PageLike, error) {
 	if !ok {
 		var err error
 		buff := t.Cache.GetBuffer()
-		p, err = pages.LoadPage(t.db.GetFd(), pid.PID,	buff)
-		if err != nil { return nil, err }
+		p, err = pages.LoadPage(t.Store, pid.PID,	buff)
+		// a reader can catch the writer halfway through the page
+		var corrupt *pages.CorruptPageError
+		for try := 0; t.Options.ReadOnly && errors.As(err, &corrupt) && try < TORN_RETRIES; try++ {
+			time.Sleep(time.Millisecond)
+			p, err = pages.LoadPage(t.Store, pid.PID, buff)
+		}
+		if err != nil {
+			t.Cache.PutBuffer(buff)
+			return nil, err
+		}
 
 		t.Cache.Set(p)
 	}
 	return p, nil
 }
 
+// Loads any page by id for the logger, the meta page is never in the cache
+func (t *BaseTable) GetPageLike(id uint64) (types.PageLike, error) {
+	if id == 0 { return t.MetaPage, nil }
+	return t.GetPage(pages.NewPageId(id))
+}
+
+// Starts a transaction, from here on every page
+// the table touches keeps its before image.
+func (t *BaseTable) BeginTxn() (uint64, error) {
+	if t.failed != nil { return 0, t.failed }
+	trxId := t.Logger.NextTrxId()
+	t.Cache.BeginTracking()
+	t.Cache.Track(t.MetaPage)
+	return trxId, nil
+}
+
+// Logs the bytes every touched page changed by, then the commit.
+// Every change is followed by its before image so an unfinished
+// commit can be undone. The pages get the lsn of their last record
+// so recovery can tell whether they already hold it.
+// The first change to a page since the checkpoint logs all of it,
+// a write of the page torn by a crash is put back from that.
+// done gets the outcome once the commit is durable, which can be after
+// the table has moved on to the next message
+func (t *BaseTable) CommitTxn(trxId uint64, done func(error)) {
+	snaps := t.Cache.EndTracking()
+	defer t.Cache.PutSnapshots(snaps)
+
+	axs := make([]*types.Action, 0, len(snaps)*2)
+	vals := make([]*[]byte, 0, len(snaps)*2)
+	changed := make([]types.PageLike, 0, len(snaps))
+	for id, snap := range snaps {
+		after := snap.P.ToBytes()
+		ranges := utils.DiffRanges(snap.Before, after, DIFF_GAP)
+		if len(ranges) == 0 { continue }
+
+		base := id * uint64(t.Options.PageSize)
+		// the meta page has its copy instead
+		whole := id != 0 && binary.LittleEndian.Uint64(snap.Before[pages.LSN_OFF:]) <= t.db.GetCheckpoint()
+		if whole {
+			val := make([]byte, len(after))
+			copy(val, after)
+			axs = append(axs, types.AtomicAx(types.SNAPSHOT, types.Page, id, uint16(len(val))))
+			vals = append(vals, &val)
+		}
+		for _, r := range ranges {
+			dest := base + uint64(r[0])
+			if !whole {
+				val := make([]byte, r[1]-r[0])
+				copy(val, after[r[0]:r[1]])
+				axs = append(axs, types.UpdateAx(types.NLBlob, dest, uint16(len(val))))
+				vals = append(vals, &val)
+			}
+			undo := make([]byte, r[1]-r[0])
+			copy(undo, snap.Before[r[0]:r[1]])
+			axs = append(axs, types.AtomicAx(types.UNDO, types.NLBlob, dest, uint16(len(undo))))
+			vals = append(vals, &undo)
+		}
+		changed = append(changed, snap.P)
+	}
+
+	lsn, err := t.Logger.NewTxn(&axs, &vals, trxId)
+	if err != nil {
+		done(err)
+		return
+	}
+	for _, p := range changed {
+		p.SetLsn(lsn)
+		p.SetIsDirty(true)
+	}
+	// pages it freed can only be handed out once nothing of it is undone
+	freed := make([]uint64, 0)
+	for _, a := range t.Logger.PeekActions(trxId) {
+		if a.GetOperation() == types.FREEPAGE { freed = append(freed, uint64(a.GetDest())) }
+	}
+	t.Logger.CommitTxn(trxId, done)
+	for _, id := range freed { t.db.NewFreePage(id) }
+}
+
+// Drops the transaction and puts every page it touched back.
+// The before images are what was committed so they go straight to disk,
+// the cached copies are dropped and get read again.
+// The cancel is only logged once every page is back, one that cant
+// be put back fails the table
+func (t *BaseTable) CancelTxn(trxId uint64) error {
+	snaps := t.Cache.EndTracking()
+	defer t.Cache.PutSnapshots(snaps)
+
+	for id, snap := range snaps {
+		if err := t.restore(id, snap); err != nil { return t.fail(err, snaps) }
+	}
+	axs := t.Logger.CancelTxn(trxId)
+
+	// give back the pages it claimed
+	for _, a := range axs {
+		if a.GetOperation() != types.NEWPAGE { continue }
+		if err := t.db.NewFreePage(uint64(a.GetDest())); err != nil { return err }
+	}
+	return nil
+}
+
+// Puts the before image of page id back
+func (t *BaseTable) restore(id uint64, snap *cache.Snapshot) error {
+	if id == 0 {
+		// the meta page is shared, restore it in place
+		buff := t.MetaPage.ToBytes()
+		copy(buff, snap.Before)
+		return t.MetaPage.FromBytes(buff)
+	}
+	// the before image is only as old as the log on disk
+	lsn := binary.LittleEndian.Uint64(snap.Before[pages.LSN_OFF:])
+	if err := t.Logger.ForceLog(lsn); err != nil { return err }
+	if err := snap.P.Flush(snap.Before); err != nil { return err }
+	t.Cache.Drop(id)
+	return nil
+}
+
+// The pages of a transaction that couldnt be cancelled hold changes
+// the log has no record of. They are dropped without being written
+// and the table takes no more writes and writes nothing out, the log
+// still has the transaction open and the next start undoes it
+func (t *BaseTable) fail(err error, snaps map[uint64]*cache.Snapshot) error {
+	for id := range snaps {
+		if id != 0 { t.Cache.Drop(id) }
+	}
+	t.ckpt = nil
+	t.failed = fmt.Errorf("%w: %w", ErrFailed, err)
+	return t.failed
+}
+
+// Replays a committed transaction handed over by the logger
+func (t *BaseTable) Recover(axs *[]*types.Action, outPut chan any) {
+	outPut <- engine.ExecuteActions(t.Logger, *axs)
+}
 
+// Undoes a transaction the crash cut off, then logs it as cancelled
+// so a later recovery leaves it alone
+func (t *BaseTable) Rollback(trxId uint64, outPut chan any) {
+	axs := t.Logger.PeekActions(trxId)
+	if err := engine.UndoActions(t.Logger, axs); err != nil {
+		outPut <- err
+		return
+	}
+	for _, a := range axs {
+		if a.GetOperation() != types.NEWPAGE { continue }
+		// what the undo left in the cache must not land on a reused page
+		id := uint64(a.GetDest())
+		t.Cache.Drop(id)
+		if err := t.db.NewFreePage(id); err != nil {
+			outPut <- err
+			return
+		}
+	}
+	t.Logger.CancelTxn(trxId)
+	outPut <- nil
+}
+
+// Leaves everything on disk, the last thing Run does.
+// A transaction left open still gets its pages out, recovery undoes it
+func (t *BaseTable) Close() error {
+	err := t.failed
+	if err == nil { err = t.Checkpoint() }
+	if err == nil && !t.Options.ReadOnly { err = t.Cache.FlushAll() }
+	// the writer stops either way, recovery finds what didnt get out
+	return errors.Join(err, t.Logger.Close())
+}
+
+// A long log is slow to recover, called by Run between messages.
+// Only starts the checkpoint, CheckpointStep writes it out.
+// Backups that keep the log from being cut past the limit are given up on
+func (t *BaseTable) CheckpointIfLong() {
+	if t.Logger.ByteCount <= t.Options.LogThreshold { return }
+	if t.Logger.ByteCount > t.Options.BackupLogLimit {
+		for id := range t.backups { t.backups[id] = false }
+	}
+	t.BeginCheckpoint()
+}
+
+// A backup is copying the file and the log, they must stay a pair
+func (t *BaseTable) backingUp() bool {
+	for _, held := range t.backups {
+		if held { return true }
+	}
+	return false
+}
+
+// Marks the log and takes note of the pages dirty then. Once those are
+// written the log before the mark is no longer needed for recovery.
+// Transactions go on in between, what they change after the mark is
+// in the log after it
+func (t *BaseTable) BeginCheckpoint() {
+	if t.Options.ReadOnly || t.failed != nil { return } // nothing to write out
+	if t.backingUp() { return } // the file and log being copied must stay a pair
+	if t.ckpt != nil { return }
+	mark, ok := t.Logger.Mark()
+	if !ok { return }
+	t.ckpt = &checkpointRun{ mark: mark, dirty: t.Cache.DirtyPages() }
+}
+
+// Writes the next few pages of the checkpoint under way, Run calls it
+// whenever no message is waiting. False once there is nothing left to do.
+// A failed checkpoint leaves the last one in place
+func (t *BaseTable) CheckpointStep() bool {
+	if t.ckpt == nil || t.backingUp() { return false }
+	// held pages wait for the next message to end the transaction
+	done, held, err := t.checkpointStep(CHECKPOINT_STEP)
+	return !done && !held && err == nil
+}
+
+// held is true when only pages the running transaction has are left
+func (t *BaseTable) checkpointStep(n int) (done, held bool, err error) {
+	run := t.ckpt
+	batch := run.dirty[:min(n, len(run.dirty))]
+	kept, err := t.Cache.FlushPages(batch)
+	if err != nil {
+		t.ckpt = nil
+		return true, false, err
+	}
+	// they come around again after the rest
+	run.dirty = append(run.dirty[len(batch):], kept...)
+	if len(run.dirty) > 0 { return false, len(kept) == len(run.dirty), nil }
+
+	t.ckpt = nil
+	return true, false, t.finishCheckpoint(run.mark)
+}
+
+// Everything dirty at the mark is written, moves the start of the log up
+// to it, or to the oldest transaction still open
+func (t *BaseTable) finishCheckpoint(mark logger.Mark) error {
+	oldest, err := t.Logger.Checkpoint(mark)
+	if err != nil { return err }
+	// the free list trunks have to be on disk before the header points at them
+	if err = t.db.SetCheckpoint(mark.Lsn); err != nil { return err }
+	if err = t.Store.Sync(); err != nil { return err }
+
+	// the meta page holds the new start of the log and the header,
+	// once it is on disk the old segments can go
+	if err = t.db.WriteMeta(); err != nil { return err }
+	return t.Logger.FreeBefore(oldest, t.Logger.Start().Segment)
+}
+
+// Checkpoints from a fresh mark and waits until it is done,
+// a checkpoint under way is started over.
+// Runs on the table between transactions, other tables keep going.
+func (t *BaseTable) Checkpoint() error {
+	if t.failed != nil { return t.failed }
+	if t.backingUp() { return nil }
+	t.ckpt = nil
+	t.BeginCheckpoint()
+	for t.ckpt != nil {
+		done, held, err := t.checkpointStep(len(t.ckpt.dirty))
+		if err != nil { return err }
+		// the running transaction has to finish first, Run goes on with it
+		if !done && held { return nil }
+	}
+	return nil
+}
+
+// Checkpoints so the backup needs less of the log, then holds further
+// checkpoints off until EndBackup. The file and the log from the mark
+// sent back on stay a pair recovery can start from
+func (t *BaseTable) StartBackup(outPut chan any) {
+	if err := t.Checkpoint(); err != nil {
+		outPut <- err
+		return
+	}
+	if t.backups == nil { t.backups = make(map[uint64]bool) }
+	t.lastBackup++
+	t.backups[t.lastBackup] = true
+	outPut <- BackupStart{ Id: t.lastBackup, Start: t.Logger.Start() }
+}
+
+// The end of the log, synced. A backup checkpoints went on
+// without has no pair to end
+func (t *BaseTable) LogEnd(id uint64, outPut chan any) {
+	if !t.backups[id] {
+		outPut <- ErrBackupTooLong
+		return
+	}
+	end, err := t.Logger.End()
+	if err != nil {
+		outPut <- err
+		return
+	}
+	outPut <- end
+}
+
+func (t *BaseTable) EndBackup(id uint64, outPut chan any) {
+	delete(t.backups, id)
+	outPut <- nil
+}
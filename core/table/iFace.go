@@ -1,23 +1,30 @@
 package table
 
 import (
+	"fmt"
 	"mydb/core/cache"
 	"mydb/core/fsm"
 	"mydb/core/logger"
 	"mydb/core/pages"
+	"mydb/core/prims"
 	"mydb/core/types"
 )
 
-func StartTable[T Table](t T, d types.DatabaseI, metaPage *pages.Page) (chan *types.DbMessage, error){
-	t.SetFd(d.GetFd())
+func StartTable[T Table](
+	t T, d types.DatabaseI, metaPage *pages.Page, opts types.Options,
+) (chan *types.DbMessage, error){
+	t.SetStore(d.GetStore())
 	t.SetDatabase(d)
-	t.SetCache(cache.NewCache(t.GetFd()))
+	t.SetOptions(opts)
+	t.SetCache(cache.NewCache(t.GetStore(), uint16(opts.PageSize), opts.CacheSize, opts.CacheMin, opts.SweepInterval))
+	t.SetMetaPage(metaPage)
 
-	logger, err := logger.StartLogger(d, metaPage, 
-		func (id uint64) (types.PageLike, error) {return t.GetPage(pages.NewPageId(id))},
-	)
+	logger, err := logger.StartLogger(d, metaPage, t.GetPageLike, opts.Durability, opts.ReadOnly)
 	if err != nil { return nil, err }
+	logger.Archive = opts.Archive
+	logger.Compress = opts.Compress
 	t.SetLogger(logger)
+	t.GetCache().ForceLog = logger.ForceLog
 
 	t.SetFSM(fsm.NewFSM(d, logger, t.GetCache(), metaPage))
 	metaPage.Cursor += 4 // only has one root
@@ -25,21 +32,60 @@ func StartTable[T Table](t T, d types.DatabaseI, metaPage *pages.Page) (chan *ty
 	t.SetIndexAndColumns(metaPage)
 
 	chanl := make(chan *types.DbMessage)
-	go t.Run(chanl)
+	done := make(chan struct{})
+	go func() {
+		t.Run(chanl)
+		close(done)
+	}()
+
+	if err = Recover(t, chanl); err != nil {
+		// the table stops without writing anything out,
+		// the next open recovers from the same log
+		close(chanl)
+		<-done
+		t.GetLogger().Close()
+		return nil, fmt.Errorf("Failed to recover: %w", err)
+	}
 	return chanl, nil
 }
 
+// Feeds the committed transactions the logger finds to the table,
+// then the unfinished ones to be undone.
+// Once the log is done the recovered pages are flushed out of the cache
+func Recover[T Table](t T, in chan *types.DbMessage) error {
+	var err error
+	send := func(code types.TableCode, m any) {
+		if err != nil { return } // keep draining so the logger can finish
+		msg := &types.DbMessage{ Code: code, Msg: m, Output: make(chan any, 1) }
+		in <- msg
+		if res, ok := (<-msg.Output).(error); ok { err = res }
+	}
+	for axs := range t.GetLogger().RecoverChan { send(types.RECOVERY, axs) }
+	for trxId := range t.GetLogger().UndoChan { send(types.ROLLBACK, trxId) }
+
+	if err == nil { err = t.GetLogger().RecoveryErr() }
+	if err != nil { return err }
+	return t.GetCache().Purge()
+}
+
 
 type Table interface {
-	GetFd() int
-	SetFd(int)
+	GetStore() prims.Storage
+	SetStore(prims.Storage)
 	GetCode() types.TableCode
 
 	GetPage(*pages.PageId) (types.PageLike, error)
+	GetPageLike(uint64) (types.PageLike, error)
+
+	GetMetaPage() *pages.Page
+	SetMetaPage(*pages.Page)
 
 	GetDatabase() types.DatabaseI
 	SetDatabase(types.DatabaseI)
 
+	GetOptions() types.Options
+	SetOptions(types.Options)
+
 	GetCache() *cache.Cache
 	SetCache(*cache.Cache)
 
@@ -17,8 +17,10 @@ const (
 )
 
 type Action struct {
-	Offset uint16
-	PageId uint64
+	// where the value sits in the log, and the lsn of the record
+	Segment uint32
+	Offset uint32
+	Lsn uint64
 	body []byte
 }
 
@@ -75,14 +77,25 @@ func (a *Action) Validate() error {
 	if a.body == nil || len(a.body) != ACTION_SIZE {
 		return errors.New("Invalid action")
 	}
-	if a.GetOperation() < 0 || a.GetOperation() > 3 {
+	if a.GetOperation() < 0 || a.GetOperation() > FREEPAGE {
 		return errors.New("Invalid operation")
 	}
-	if a.GetDest() < 0 || a.GetDest() == 0 {
+	if a.GetDest() < 0 {
 		return errors.New("Invalid dest")
 	}
-	if a.GetVLength() == 0 {
-		return errors.New("Invalid vLength")
+	if a.GetVType() < int8(Int64) || a.GetVType() > int8(FileRowPadding) {
+		return errors.New("Invalid vType")
 	}
 	return nil
 }
+
+// Page id the action writes to, pages are addressed by id
+// and everything else by its byte offset in the file
+func (a *Action) GetPageId(pageSize uint16) (uint64, bool) {
+	switch a.GetOperation() {
+	case INSERT, UPDATE, DELETE, NEWPAGE, SNAPSHOT, UNDO:
+	default: return 0, false
+	}
+	if DataType(a.GetVType()) == Page { return uint64(a.GetDest()), true }
+	return uint64(a.GetDest()) / uint64(pageSize), true
+}
@@ -3,12 +3,16 @@ package types
 import (
 	"encoding/binary"
 	"errors"
+	"time"
 	"mydb/core/pages"
+	"mydb/core/prims"
 )
 
 type CacheI interface {
 	Get(uint64) (PageLike, bool)
 	Set(PageLike)
+	// Set for a page that was just claimed
+	SetNew(PageLike)
 	GetBuffer() []byte
 	PutBuffer([]byte)
 }
@@ -17,13 +21,34 @@ type DatabaseI interface {
 	Start(string) error
 	Close() error
 	ClaimFreePage(pages.PageType) (uint64, error)
-	NewFreePage(PageLike) error
-	GetFd() int
+	// the page goes on the free list
+	NewFreePage(uint64) error
+	// Recovery found the page in use, it must not be claimed again
+	MarkClaimed(uint64)
+	// Lsn recovery redoes from, kept in the header by checkpoints
+	GetCheckpoint() uint64
+	// also writes out the free list, sync before the meta page goes out
+	SetCheckpoint(uint64) error
+	// writes the meta page and its copy, synced
+	WriteMeta() error
+	// flags the file before the first compressed page or image goes out
+	MarkCompressed() error
+	GetStore() prims.Storage
+	// fixed when the file is created
+	GetPageSize() uint16
+	// holds the file and its log
+	GetVolume() prims.Volume
+	// the log goes next to the file at this path
+	GetPath() string
+	// a read only open shares the file with a writer at work
+	HasWriter() bool
 }
 
 type PageLike interface {
 	GetId() uint64
 	GetType() pages.PageType
+	GetLsn() uint64
+	SetLsn(uint64)
 	ToBytes() []byte
 	FromBytes([]byte) error
 	Flush([]byte) error
@@ -39,6 +64,39 @@ type PageLike interface {
 	ToggleInUse()
 }
 
+// When a commit counts as done
+type SyncMode int8
+
+const (
+	SYNC_COMMIT SyncMode = iota // every commit syncs the log
+	GROUP_COMMIT // commits in a window share one sync
+	NO_SYNC // the log is written but the OS decides when it hits the disk
+)
+
+type Durability struct {
+	Mode 		SyncMode
+	Window 		time.Duration // GROUP_COMMIT, longest a commit waits for others
+	GroupSize 	int // GROUP_COMMIT, a full group syncs without waiting
+}
+
+// Settings a database runs with, zero values get the defaults
+type Options struct {
+	PageSize 		int // 4K to 32K, only for a new file, the file keeps its own
+	CacheSize 		int // pages each table keeps in memory
+	CacheMin 		int // a full cache is emptied down to this
+	SweepInterval 	int // cache hits between sweeps for unused pages, negative never sweeps
+	LogThreshold 	uint32 // bytes of log that start a checkpoint
+	BackupLogLimit 	uint32 // bytes of log a running backup may hold on to, past it the backup fails
+	GrowthStep 		uint64 // pages the file grows by when nothing is free
+	BasePath 		string // where the file table keeps the blobs
+	Durability 		Durability
+	Volume 			prims.Volume // where the file and its log live, the OS by default
+	ReadOnly 		bool // shares the file with other readers and a writer, changes nothing
+	Archive 		string // log segments a checkpoint is done with are copied here first
+	Keys 			prims.KeyProvider // encrypts the file and its log, nil leaves them plain
+	Compress 		bool // index leaves and the page images in the log, needs pages over 4K
+}
+
 type DataType int8
 
 const (
@@ -111,6 +169,12 @@ const (
 	// META TABLE
 	TERMINATE
 	RECOVERY
+	ROLLBACK
+	RUN_CHECKPOINT
+	START_BACKUP
+	LOG_END
+	END_BACKUP
+	BEGIN_CHECKPOINT
 )
 
 
@@ -133,8 +197,12 @@ const(
 
 	NEWPAGE
 	SNAPSHOT
+	UNDO // before image of the UPDATE right ahead of it
 	CANCEL
+	CHECKPOINT // value is the lsn recovery redoes from
 	NONE
+	// after NONE so the codes older logs use stay put
+	FREEPAGE // the page goes back on the free list once the transaction commits
 )
 
 type LogFlag int8
@@ -145,3 +213,58 @@ const (
 	TxnCommit 	LogFlag = 122
 	TxnCancel 	LogFlag = 123
 )
+
+func (t DataType) String() string {
+	switch t {
+	case Int64: return "Int64"
+	case Int32: return "Int32"
+	case Int16: return "Int16"
+	case Int8: return "Int8"
+	case Float: return "Float"
+	case Bool: return "Bool"
+	case Time: return "Time"
+	case UUID: return "UUID"
+	case Hash: return "Hash"
+	case Nil: return "Nil"
+	case Page: return "Page"
+	case String: return "String"
+	case Blob: return "Blob"
+	case NLBlob: return "NLBlob"
+	case ChainBlob: return "ChainBlob"
+	case FileRowPadding: return "FileRowPadding"
+	}
+	return "UNKNOWN_TYPE"
+}
+
+func (op OpCode) String() string {
+	switch op {
+	case INSERT: return "INSERT"
+	case DELETE: return "DELETE"
+	case UPDATE: return "UPDATE"
+	case GET_VAR_SPACE: return "GET_VAR_SPACE"
+	case PUT_VAR_SPACE: return "PUT_VAR_SPACE"
+	case GET_FIX_SPACE: return "GET_FIX_SPACE"
+	case PUT_FIX_SPACE: return "PUT_FIX_SPACE"
+	case IDX_INSERT: return "IDX_INSERT"
+	case IDX_DELETE: return "IDX_DELETE"
+	case IDX_UPDATE: return "IDX_UPDATE"
+	case NEWPAGE: return "NEWPAGE"
+	case SNAPSHOT: return "SNAPSHOT"
+	case UNDO: return "UNDO"
+	case CANCEL: return "CANCEL"
+	case CHECKPOINT: return "CHECKPOINT"
+	case NONE: return "NONE"
+	case FREEPAGE: return "FREEPAGE"
+	}
+	return "UNKNOWN_OP"
+}
+
+func (f LogFlag) String() string {
+	switch f {
+	case TxnBegin: return "BEGIN"
+	case TxnPending: return "PENDING"
+	case TxnCommit: return "COMMIT"
+	case TxnCancel: return "CANCEL"
+	}
+	return "UNKNOWN_FLAG"
+}
@@ -0,0 +1,376 @@
+package database
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"mydb/core/logger"
+	"mydb/core/pages"
+	"mydb/core/prims"
+	"mydb/core/table"
+	"mydb/core/types"
+)
+
+// A backup is a tar stream, what it is comes first, then the file as it was
+// read and the log from the checkpoint before the read to where it was once
+// the read was done. Pages written while they were being read are put back
+// whole by recovery, the first change to a page after a checkpoint logs all of it.
+//
+// An incremental backup has the pages changed since the checkpoint of the one
+// before instead of the file, those are the pages with a higher lsn. The rest
+// is as that backup had it, nothing changed them since its checkpoint.
+// The meta page and the free list trunks have no lsn worth going by, they
+// are always in it.
+//
+// The stream is plain even for an encrypted database, a restore encrypts
+// it again with the keys it is given.
+const (
+	BACKUP_INFO  = "backup"
+	BACKUP_FILE  = "data"
+	BACKUP_PAGES = "pages/" // followed by the first page id of a run
+	BACKUP_LOG   = "wal/"   // followed by the segment number
+
+	COPY_CHUNK = 256 * 1024
+	READ_TRIES = 10 // for a block being written as it is read
+)
+
+// BACKUP INFO, little endian
+const (
+	BACKUP_PAGE_SIZE_OFF = 0
+	BACKUP_SINCE_OFF     = 8  // an incremental backup has the pages changed after this
+	BACKUP_START_OFF     = 16 // the checkpoint it was read under
+	BACKUP_LSN_OFF       = 24 // the log in it goes up to here
+	BACKUP_SIZE_OFF      = 32 // of the file
+	BACKUP_TIME_OFF      = 40 // unix nanoseconds, once the end of the log was known
+	BACKUP_FULL_OFF      = 48
+
+	BACKUP_INFO_SIZE = 56
+)
+
+var (
+	ErrNotBackup     = errors.New("Not a My-Go-DB backup")
+	ErrBackupChain   = errors.New("Incremental backup doesnt follow the one before it")
+	ErrExists        = errors.New("Database file already exists")
+	ErrBackupTooLong = table.ErrBackupTooLong
+)
+
+type BackupInfo struct {
+	PageSize 	uint32
+	Full 		bool
+	Since 		uint64
+	// pages at or below it have not changed since the backup was taken,
+	// the next incremental backup goes from here
+	Start 		uint64
+	Lsn 		uint64
+	Size 		int64
+	Time 		time.Time // every commit in it was made before
+}
+
+func BackupInfoFromBytes(buff []byte) BackupInfo {
+	return BackupInfo{
+		PageSize: binary.LittleEndian.Uint32(buff[BACKUP_PAGE_SIZE_OFF:]),
+		Full: buff[BACKUP_FULL_OFF] == 1,
+		Since: binary.LittleEndian.Uint64(buff[BACKUP_SINCE_OFF:]),
+		Start: binary.LittleEndian.Uint64(buff[BACKUP_START_OFF:]),
+		Lsn: binary.LittleEndian.Uint64(buff[BACKUP_LSN_OFF:]),
+		Size: int64(binary.LittleEndian.Uint64(buff[BACKUP_SIZE_OFF:])),
+		Time: time.Unix(0, int64(binary.LittleEndian.Uint64(buff[BACKUP_TIME_OFF:]))),
+	}
+}
+
+func (b BackupInfo) ToBytes() []byte {
+	buff := make([]byte, BACKUP_INFO_SIZE)
+	binary.LittleEndian.PutUint32(buff[BACKUP_PAGE_SIZE_OFF:], b.PageSize)
+	if b.Full { buff[BACKUP_FULL_OFF] = 1 }
+	binary.LittleEndian.PutUint64(buff[BACKUP_SINCE_OFF:], b.Since)
+	binary.LittleEndian.PutUint64(buff[BACKUP_START_OFF:], b.Start)
+	binary.LittleEndian.PutUint64(buff[BACKUP_LSN_OFF:], b.Lsn)
+	binary.LittleEndian.PutUint64(buff[BACKUP_SIZE_OFF:], uint64(b.Size))
+	binary.LittleEndian.PutUint64(buff[BACKUP_TIME_OFF:], uint64(b.Time.UnixNano()))
+	return buff
+}
+
+// Copies the whole database to w while it keeps taking reads and writes.
+// Checkpoints wait until the copy is done, so does Close. A copy that
+// holds on to more than Options.BackupLogLimit of log fails with
+// ErrBackupTooLong and checkpoints go on
+func (d *Database) Backup(w io.Writer) (BackupInfo, error) {
+	return d.backup(w, BackupInfo{ Full: true })
+}
+
+// Copies what changed since the backup whose Start is since,
+// Restore puts it over that one
+func (d *Database) BackupSince(w io.Writer, since uint64) (BackupInfo, error) {
+	return d.backup(w, BackupInfo{ Since: since })
+}
+
+func (d *Database) backup(w io.Writer, info BackupInfo) (BackupInfo, error) {
+	d.mux.RLock()
+	defer d.mux.RUnlock()
+	if d.fileTableIn == nil { return info, ErrClosed }
+
+	res := d.call(&types.DbMessage{ Code: types.START_BACKUP, Output: make(chan any, 1) })
+	if err, ok := res.(error); ok { return info, err }
+	run := res.(table.BackupStart)
+	start := run.Start
+	defer d.call(&types.DbMessage{ Code: types.END_BACKUP, Msg: run.Id, Output: make(chan any, 1) })
+
+	// nothing writes the meta page or its copy until the backup ends
+	size, err := d.Store.Size()
+	if err != nil { return info, err }
+	info.PageSize, info.Start = d.PageSize, start.Lsn
+	info.Size = size - size % int64(d.PageSize)
+
+	tw := tar.NewWriter(w)
+	if err = writeInfo(tw, info); err != nil { return info, err }
+	if info.Full {
+		err = backupStore(tw, BACKUP_FILE, d.Store, info.Size, false)
+	} else {
+		err = d.backupPages(tw, info.Since, info.Size)
+	}
+	if err != nil { return info, err }
+
+	// every page read is in the log by now, the write-ahead rule
+	res = d.call(&types.DbMessage{ Code: types.LOG_END, Msg: run.Id, Output: make(chan any, 1) })
+	if err, ok := res.(error); ok { return info, err }
+	end := res.(logger.Mark)
+	info.Lsn, info.Time = end.Lsn, time.Now().Round(0)
+	if err = d.backupLog(tw, start.Segment, end); err != nil { return info, err }
+	// again now that the end of the log is known, the last one counts
+	if err = writeInfo(tw, info); err != nil { return info, err }
+	return info, tw.Close()
+}
+
+func writeInfo(tw *tar.Writer, info BackupInfo) error {
+	buff := info.ToBytes()
+	hdr := &tar.Header{ Name: BACKUP_INFO, Mode: 0644, Size: int64(len(buff)), ModTime: time.Now() }
+	if err := tw.WriteHeader(hdr); err != nil { return err }
+	_, err := tw.Write(buff)
+	return err
+}
+
+// Runs of pages newer than since, a chunk at a time
+func (d *Database) backupPages(tw *tar.Writer, since uint64, size int64) error {
+	pageSize := int64(d.PageSize)
+	buff := make([]byte, max(COPY_CHUNK - COPY_CHUNK % pageSize, pageSize))
+	for off := int64(0); off < size; {
+		chunk := buff[:min(int64(len(buff)), size - off)]
+		if err := readFull(d.Store, chunk, off, false); err != nil { return err }
+		first := off / pageSize
+		for i := int64(0); i < int64(len(chunk)) / pageSize; {
+			if !pageChanged(chunk[i * pageSize:(i + 1) * pageSize], since) {
+				i++
+				continue
+			}
+			j := i + 1
+			for j < int64(len(chunk)) / pageSize && pageChanged(chunk[j * pageSize:(j + 1) * pageSize], since) { j++ }
+			name := BACKUP_PAGES + strconv.FormatInt(first + i, 10)
+			hdr := &tar.Header{ Name: name, Mode: 0644, Size: (j - i) * pageSize, ModTime: time.Now() }
+			if err := tw.WriteHeader(hdr); err != nil { return err }
+			if _, err := tw.Write(chunk[i * pageSize:j * pageSize]); err != nil { return err }
+			i = j
+		}
+		off += int64(len(chunk))
+	}
+	return nil
+}
+
+// A page torn by a write while it was read is newer than since either way,
+// or still has its image in the log
+func pageChanged(page []byte, since uint64) bool {
+	switch pages.PageType(page[pages.PAGETYPE_OFF]) {
+		case pages.META_PAGE, pages.FREE_PAGE: return true
+	}
+	return binary.LittleEndian.Uint64(page[pages.LSN_OFF:]) > since
+}
+
+// Segments from up to end, closed segments never change
+func (d *Database) backupLog(tw *tar.Writer, from uint32, end logger.Mark) error {
+	if from == 0 { return nil } // nothing was ever logged
+	dir := logger.LogDir(d.FilePath)
+	for seg := from; seg <= end.Segment; seg++ {
+		file, err := d.Options.Volume.Open(logger.SegmentPath(dir, seg), os.O_RDONLY)
+		if err != nil { return err }
+		size := int64(end.Offset)
+		if seg < end.Segment { size, err = file.Size() }
+		if err == nil {
+			err = backupStore(tw, BACKUP_LOG + filepath.Base(logger.SegmentPath(dir, seg)), file, size, true)
+		}
+		file.Close()
+		if err != nil { return err }
+	}
+	return nil
+}
+
+// The first size bytes of st go in as name, a store shorter than that is an error
+func backupStore(tw *tar.Writer, name string, st prims.Storage, size int64, gaps bool) error {
+	hdr := &tar.Header{ Name: name, Mode: 0644, Size: size, ModTime: time.Now() }
+	if err := tw.WriteHeader(hdr); err != nil { return err }
+	buff := make([]byte, min(COPY_CHUNK, size))
+	for off := int64(0); off < size; {
+		chunk := buff[:min(int64(len(buff)), size - off)]
+		if err := readFull(st, chunk, off, gaps); err != nil { return err }
+		if _, err := tw.Write(chunk); err != nil { return err }
+		off += int64(len(chunk))
+	}
+	return nil
+}
+
+// A block of an encrypted file fails to decrypt while it is being written,
+// it is read again. One that keeps failing was torn by a crash, with gaps it
+// goes in as zeroes, the log reads past those
+func readFull(st prims.Storage, buff []byte, off int64, gaps bool) error {
+	tries := 0
+	for n := 0; n < len(buff); {
+		m, err := st.ReadAt(buff[n:], off + int64(n))
+		n += m
+		if m > 0 { tries = 0 }
+		if errors.Is(err, prims.ErrAuth) {
+			if tries++; tries < READ_TRIES {
+				time.Sleep(time.Millisecond)
+				continue
+			}
+			if !gaps { return err }
+			bad := min(len(buff) - n, prims.BLOCK_SIZE - int((off + int64(n)) % prims.BLOCK_SIZE))
+			clear(buff[n:n+bad])
+			n, tries = n + bad, 0
+			continue
+		}
+		if err != nil { return err }
+		if m == 0 { return io.ErrUnexpectedEOF }
+	}
+	return nil
+}
+
+// What the backup in r is, the stream is read to its end
+func ReadBackupInfo(r io.Reader) (BackupInfo, error) {
+	var info BackupInfo
+	tr := tar.NewReader(r)
+	found := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF { break }
+		if err != nil { return info, fmt.Errorf("%w: %v", ErrNotBackup, err) }
+		if hdr.Name != BACKUP_INFO { continue }
+		if info, err = readInfo(tr); err != nil { return info, err }
+		found = true
+	}
+	if !found { return info, ErrNotBackup }
+	return info, nil
+}
+
+func readInfo(r io.Reader) (BackupInfo, error) {
+	buff := make([]byte, BACKUP_INFO_SIZE)
+	if _, err := io.ReadFull(r, buff); err != nil { return BackupInfo{}, fmt.Errorf("%w: %v", ErrNotBackup, err) }
+	return BackupInfoFromBytes(buff), nil
+}
+
+// Unpacks a full backup and then the incremental ones taken after it,
+// in order, into a new database at path and opens it with opts.
+// Recovery brings it up to where the last backup ended.
+// An existing file is never written over
+func Restore(r io.Reader, path string, opts Options, incrementals ...io.Reader) (*Database, error) {
+	return restore(nil, r, path, opts, incrementals)
+}
+
+func restore(to *PointInTime, r io.Reader, path string, opts Options, incrementals []io.Reader) (*Database, error) {
+	if path == MEMORY { return nil, errors.New("Cant restore into :memory:, it starts out empty") }
+	// written the way the database reads it, encrypted if it has keys
+	full, err := withDefaults(opts)
+	if err != nil { return nil, err }
+	vol := full.Volume
+	if st, err := vol.Open(path, os.O_RDONLY); err == nil {
+		st.Close()
+		return nil, fmt.Errorf("%w: %s", ErrExists, path)
+	}
+	rs := &restorer{ vol: vol, path: path, dir: logger.LogDir(path) }
+	if err := vol.Mkdir(rs.dir); err != nil { return nil, err }
+
+	if err := rs.unpack(r, true); err != nil { return nil, err }
+	for _, r := range incrementals {
+		if err := rs.unpack(r, false); err != nil { return nil, err }
+	}
+	if to != nil {
+		if err := rs.cutAt(*to); err != nil { return nil, err }
+	}
+	if err := vol.SyncDir(rs.dir); err != nil { return nil, err }
+	if err := vol.SyncDir(filepath.Dir(path)); err != nil { return nil, err }
+
+	opts.Volume = vol
+	return Open(path, opts)
+}
+
+// Puts one backup of a chain over what the ones before it left
+type restorer struct {
+	vol 	prims.Volume
+	path 	string
+	dir 	string
+	info 	BackupInfo // of the last one unpacked
+	segs 	[]string // the log it brought
+	first 	uint32 // its first segment, 0 for none
+}
+
+func (rs *restorer) unpack(r io.Reader, full bool) error {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != BACKUP_INFO { return ErrNotBackup }
+	info, err := readInfo(tr)
+	if err != nil { return err }
+	if info.Full != full || !pages.ValidPageSize(int(info.PageSize)) { return ErrNotBackup }
+	if !full && (info.Since != rs.info.Start || info.PageSize != rs.info.PageSize) {
+		return fmt.Errorf("%w: it goes from %d, not %d", ErrBackupChain, info.Since, rs.info.Start)
+	}
+
+	// the log of the one before is replaced whole
+	for _, seg := range rs.segs { rs.vol.Remove(seg) }
+	rs.segs, rs.first = nil, 0
+	data, err := rs.vol.Open(rs.path, os.O_RDWR | os.O_CREATE)
+	if err != nil { return err }
+	defer data.Close()
+	if err = data.Truncate(info.Size); err != nil { return err }
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF { break }
+		if err != nil { return fmt.Errorf("%w: %v", ErrNotBackup, err) }
+
+		switch {
+			case hdr.Name == BACKUP_INFO:
+				if info, err = readInfo(tr); err != nil { return err }
+			case hdr.Name == BACKUP_FILE && full:
+				if _, err = io.Copy(io.NewOffsetWriter(data, 0), tr); err != nil { return err }
+			case strings.HasPrefix(hdr.Name, BACKUP_PAGES) && !full:
+				id, err := strconv.ParseUint(strings.TrimPrefix(hdr.Name, BACKUP_PAGES), 10, 64)
+				off := int64(id) * int64(info.PageSize)
+				if err != nil || off + hdr.Size > info.Size { return fmt.Errorf("%w: %s", ErrNotBackup, hdr.Name) }
+				if _, err = io.Copy(io.NewOffsetWriter(data, off), tr); err != nil { return err }
+			case strings.HasPrefix(hdr.Name, BACKUP_LOG):
+				seg, err := strconv.ParseUint(strings.TrimPrefix(hdr.Name, BACKUP_LOG), 10, 32)
+				if err != nil || seg == 0 { return fmt.Errorf("%w: %s", ErrNotBackup, hdr.Name) }
+				dest := logger.SegmentPath(rs.dir, uint32(seg))
+				if err = restoreFile(rs.vol, dest, tr); err != nil { return err }
+				rs.segs = append(rs.segs, dest)
+				if rs.first == 0 { rs.first = uint32(seg) }
+			default:
+				return fmt.Errorf("%w: %s", ErrNotBackup, hdr.Name)
+		}
+	}
+	rs.info = info
+	return data.Sync()
+}
+
+func restoreFile(vol prims.Volume, path string, r io.Reader) error {
+	st, err := vol.Open(path, os.O_RDWR | os.O_CREATE)
+	if err != nil { return err }
+	defer st.Close()
+	if err = st.Truncate(0); err != nil { return err }
+	if _, err = io.Copy(io.NewOffsetWriter(st, 0), r); err != nil { return err }
+	return st.Sync()
+}
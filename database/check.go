@@ -0,0 +1,433 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+	"slices"
+	"mydb/core/fsm"
+	"mydb/core/indexes"
+	"mydb/core/logger"
+	"mydb/core/pages"
+	"mydb/core/types"
+	"mydb/fileT"
+)
+
+// What the checker found wrong and where
+type Violation struct {
+	Page 	uint64
+	Problem string
+}
+
+func (v Violation) String() string { return fmt.Sprintf("page %d: %s", v.Page, v.Problem) }
+
+type CheckReport struct {
+	Pages 		uint64 // in the file
+	Used 		uint64 // the last id handed out, the rest was never claimed
+	Reached 	int // pages something points at
+	Violations 	[]Violation // by page
+	// what the log holds past the checkpoint, only CheckAsIs looks
+	Pending 	LsnRange
+}
+
+// Lsns from and to, both included. Empty when From is 0
+type LsnRange struct {
+	From 	uint64
+	To 		uint64
+}
+
+func (r *CheckReport) Ok() bool { return len(r.Violations) == 0 }
+
+// Checks the whole file at path, opened read only so nothing changes under it.
+// Next to a writer it checks what was committed when it opened, a checkpoint
+// the writer takes meanwhile can show up as problems that go away on the next run.
+// A file that needs recovery is refused, open it for writing once first
+// or look at it with CheckAsIs
+func Check(path string, opts Options) (*CheckReport, error) {
+	opts.ReadOnly = true
+	d, err := Open(path, opts)
+	if err != nil { return nil, err }
+	defer d.Close()
+	// the free list the replay left is only in memory,
+	// written out it lands there too
+	if d.hasWriter {
+		if err = d.writeFreeList(); err != nil { return nil, err }
+	}
+	return d.check()
+}
+
+// Checks the file at path as it is on disk without replaying its log,
+// for a copy that was never recovered. What the log would still replay is
+// reported as Pending, anything that fixes shows up as problems until then
+func CheckAsIs(path string, opts Options) (*CheckReport, error) {
+	in, err := Inspect(path, opts)
+	if err != nil { return nil, err }
+	defer in.Close()
+	report, err := in.d.check()
+	if err != nil { return nil, err }
+	report.Pending, err = in.d.pending()
+	return report, err
+}
+
+// The records of the log past the checkpoint, committed or not
+func (d *Database) pending() (LsnRange, error) {
+	var r LsnRange
+	state := d.metaPage.Body[HEADER_SIZE:]
+	seg := binary.LittleEndian.Uint32(state[logger.LOG_OLDEST_OFF:])
+	cursor := binary.LittleEndian.Uint32(state[logger.LOG_OLDEST_CUR_OFF:])
+	if seg == 0 { return r, nil } // no log yet
+	err := logger.WalkLog(d.Options.Volume, logger.LogDir(d.FilePath), seg, int(cursor), func(rec *logger.LogRecord) bool {
+		lsn := rec.Action.Lsn
+		if lsn <= d.CheckpointLsn || rec.Action.GetOperation() == types.CHECKPOINT { return true }
+		if r.From == 0 { r.From = lsn }
+		r.To = lsn
+		return true
+	})
+	if os.IsNotExist(err) { return r, nil }
+	return r, err
+}
+
+// A B-tree and how its keys are ordered
+type treeSpec struct {
+	schema 		pages.PageType
+	keySize 	int
+	entrySize 	int
+	// the part of a key that orders it, without the dirty byte
+	order 		func(key []byte) []byte
+	strict 		bool // no two keys alike
+}
+
+var checkedTrees = []treeSpec{
+	// the slot count of an entry changes in place, only the size orders them
+	{ pages.FSM, fsm.FSM_KEY_SIZE, fsm.FSM_ENTRY_SIZE, func(k []byte) []byte { return k[:fsm.COUNT_OFFSET] }, false },
+	{ pages.FTYPE_IDX, fileT.FTYPE_KEY_SIZE, fileT.FTYPE_ENTRY_SIZE, clean, true },
+	{ pages.FTIME_IDX, fileT.FTIME_KEY_SIZE, fileT.FTIME_ENTRY_SIZE, clean, true },
+	{ pages.FID_IDX, fileT.FID_KEY_SIZE, fileT.FID_ENTRY_SIZE, clean, true },
+}
+
+func clean(key []byte) []byte { return key[:len(key)-1] }
+
+// The roots sit on the meta page the way StartTable lays it out,
+// the free space map first and the file table right after it
+func treeRoot(metaPage *pages.Page, schema pages.PageType) uint64 {
+	base := HEADER_SIZE + logger.LOG_STATE_SIZE
+	if schema != pages.FSM { base += 4 }
+	off := base + int(indexes.SchemaToOrderedInt(schema)) * 8
+	return binary.LittleEndian.Uint64(metaPage.Body[off:])
+}
+
+// Owns the data pages, they are shared
+const DATA_OWNER = "rows"
+
+type checker struct {
+	d 		*Database
+	report 	*CheckReport
+	owner 	map[uint64]string // what reached each page
+	data 	map[uint64]*pages.Page // data pages by id, read once
+	rows 	[][]byte // row locations the indexes hold
+	fsm 	[][]byte // entries of the free space map
+}
+
+func (d *Database) check() (*CheckReport, error) {
+	c := &checker{
+		d: d,
+		report: &CheckReport{ Pages: d.Max, Used: d.Total },
+		owner: make(map[uint64]string),
+		data: make(map[uint64]*pages.Page),
+	}
+	c.owner[0] = "the meta page"
+	if d.Mirror != 0 { c.reach(d.Mirror, "the meta page copy") }
+
+	for _, t := range checkedTrees {
+		root := treeRoot(d.metaPage, t.schema)
+		if root == 0 { continue } // nothing was ever put in it
+		if err := c.tree(t, root); err != nil { return nil, err }
+	}
+	if err := c.freeList(); err != nil { return nil, err }
+	if err := c.spaceMap(); err != nil { return nil, err }
+	if err := c.rowsExist(); err != nil { return nil, err }
+
+	c.report.Reached = len(c.owner)
+	for id := uint64(1); id <= d.Total; id++ {
+		if _, ok := c.owner[id]; !ok { c.fail(id, "in use and nothing points at it") }
+	}
+	slices.SortStableFunc(c.report.Violations, func(a, b Violation) int {
+		switch {
+			case a.Page < b.Page: return -1
+			case a.Page > b.Page: return 1
+		}
+		return 0
+	})
+	return c.report, nil
+}
+
+func (c *checker) fail(id uint64, format string, args ...any) {
+	c.report.Violations = append(c.report.Violations, Violation{ id, fmt.Sprintf(format, args...) })
+}
+
+// Claims page id for what, false if it cant be read or is claimed already
+func (c *checker) reach(id uint64, what string) bool {
+	if id == 0 || id > c.d.Total {
+		c.fail(id, "%s points past the pages in use", what)
+		return false
+	}
+	if prev, ok := c.owner[id]; ok {
+		c.fail(id, "reached twice, from %s and from %s", prev, what)
+		return false
+	}
+	c.owner[id] = what
+	return true
+}
+
+// Data pages are shared by their rows and their free space map entry,
+// anything else reaching them is reaching them twice
+func (c *checker) reachData(id uint64, what string) {
+	if prev, ok := c.owner[id]; ok && prev == DATA_OWNER { return }
+	if c.reach(id, what) { c.owner[id] = DATA_OWNER }
+}
+
+// Page id in a buffer of its own, nil if it is corrupt
+func (c *checker) read(id uint64) ([]byte, error) {
+	buff := make([]byte, c.d.PageSize)
+	err := pages.ReadPage(c.d.Store, id, buff)
+	var corrupt *pages.CorruptPageError
+	if errors.As(err, &corrupt) {
+		c.fail(id, "%v", err)
+		return nil, nil
+	}
+	return buff, err
+}
+
+// Walks the tree from root, every leaf is checked against the
+// separators above it and the leaves have to link up in order
+func (c *checker) tree(t treeSpec, root uint64) error {
+	if !c.reach(root, t.schema.String() + " root") { return nil }
+	var leaves []*indexes.BTreeLeaf
+	if err := c.item(t, root, nil, nil, &leaves); err != nil { return err }
+
+	for i, leaf := range leaves {
+		var prev, next uint64
+		if i > 0 { prev = leaves[i-1].Id }
+		if i+1 < len(leaves) { next = leaves[i+1].Id }
+		if leaf.Prev != prev { c.fail(leaf.Id, "%s leaf Prev is %d, the leaf before it is %d", t.schema, leaf.Prev, prev) }
+		if leaf.Next != next { c.fail(leaf.Id, "%s leaf Next is %d, the leaf after it is %d", t.schema, leaf.Next, next) }
+	}
+	return nil
+}
+
+// Checks the node or leaf at id, its keys have to be above lo and
+// at most hi, nil for no bound
+func (c *checker) item(t treeSpec, id uint64, lo, hi []byte, leaves *[]*indexes.BTreeLeaf) error {
+	buff, err := c.read(id)
+	if buff == nil { return err }
+	keySize := int(binary.LittleEndian.Uint16(buff[indexes.KEY_SIZE_OFFSET:]))
+	entrySize := int(binary.LittleEndian.Uint16(buff[indexes.ENTRY_SIZE_OFFSET:]))
+	if keySize != t.keySize || entrySize != t.entrySize {
+		c.fail(id, "%s page has keys of %d and entries of %d bytes, not %d and %d", t.schema, keySize, entrySize, t.keySize, t.entrySize)
+		return nil
+	}
+	n := int(binary.LittleEndian.Uint16(buff[indexes.N_OFFSET:]))
+
+	switch pages.PageType(buff[pages.PAGETYPE_OFF]) {
+		case pages.IDX_LEAF:
+			leaf := new(indexes.BTreeLeaf)
+			leaf.FromBytes(buff)
+			leaf.Id = id
+			*leaves = append(*leaves, leaf)
+			c.leaf(t, leaf, lo, hi)
+		case pages.IDX_NODE:
+			max := (len(buff) - indexes.BNODE_HEADER_LENGTH - indexes.CHILD_SIZE) / t.entrySize
+			if n > max {
+				c.fail(id, "%s node has %d keys, it holds %d", t.schema, n, max)
+				if indexes.BNODE_HEADER_LENGTH + n * (keySize + indexes.CHILD_SIZE) + indexes.CHILD_SIZE > len(buff) { return nil }
+			}
+			node := new(indexes.BTreeNode)
+			node.FromBytes(buff)
+			for i, key := range node.Keys {
+				c.bounds(t, id, "separator", i, key, lo, hi)
+				if i > 0 && !c.ordered(t, node.Keys[i-1], key) {
+					c.fail(id, "%s node key %d is out of order", t.schema, i)
+				}
+			}
+			for i, child := range node.Children {
+				if !c.reach(child, fmt.Sprintf("%s node %d", t.schema, id)) { continue }
+				clo, chi := lo, hi
+				if i > 0 { clo = node.Keys[i-1] }
+				if i < n { chi = node.Keys[i] }
+				if err := c.item(t, child, clo, chi, leaves); err != nil { return err }
+			}
+		default:
+			c.fail(id, "%s tree reaches a %s", t.schema, pages.PageType(buff[pages.PAGETYPE_OFF]))
+	}
+	return nil
+}
+
+func (c *checker) leaf(t treeSpec, leaf *indexes.BTreeLeaf, lo, hi []byte) {
+	max := len(leaf.Body) / t.entrySize
+	count := int(leaf.N + leaf.Dirty)
+	if count > max {
+		c.fail(leaf.Id, "%s leaf has %d entries and %d dirty, it holds %d", t.schema, leaf.N, leaf.Dirty, max)
+		count = max
+	}
+	dirty := 0
+	var prev []byte
+	for i := range count {
+		entry := leaf.Body[i*t.entrySize:(i+1)*t.entrySize]
+		key := entry[:t.keySize]
+		if key[t.keySize-1] == indexes.IS_DIRTY {
+			dirty++
+		} else if t.schema == pages.FSM {
+			c.fsm = append(c.fsm, entry)
+		} else {
+			c.rows = append(c.rows, entry[t.keySize:])
+		}
+		c.bounds(t, leaf.Id, "entry", i, key, lo, hi)
+		if prev != nil && !c.ordered(t, prev, key) { c.fail(leaf.Id, "%s leaf entry %d is out of order", t.schema, i) }
+		prev = key
+	}
+	if dirty != int(leaf.Dirty) { c.fail(leaf.Id, "%s leaf counts %d dirty entries, %d are marked", t.schema, leaf.Dirty, dirty) }
+}
+
+// Whether b may follow a in the tree. A deleted entry stays where
+// it was, the same key can come back next to it
+func (c *checker) ordered(t treeSpec, a, b []byte) bool {
+	res := bytes.Compare(t.order(a), t.order(b))
+	strict := t.strict && a[len(a)-1] != indexes.IS_DIRTY && b[len(b)-1] != indexes.IS_DIRTY
+	return res < 0 || (res == 0 && !strict)
+}
+
+// Searches go left on an equal key, a separator is the last key on its left
+func (c *checker) bounds(t treeSpec, id uint64, what string, i int, key, lo, hi []byte) {
+	if lo != nil && !c.ordered(t, lo, key) {
+		c.fail(id, "%s %s %d is not above the separator before it", t.schema, what, i)
+	}
+	if hi != nil && bytes.Compare(t.order(key), t.order(hi)) > 0 {
+		c.fail(id, "%s %s %d is above the separator after it", t.schema, what, i)
+	}
+}
+
+// Follows the trunks, every id on them has to be a page no one else has
+func (c *checker) freeList() error {
+	trunks := map[uint64]bool{}
+	var count uint64
+	for id := c.d.FreeTrunk; id != 0; {
+		if trunks[id] {
+			c.fail(id, "free list goes around, trunk %d comes up again", id)
+			break
+		}
+		trunks[id] = true
+		if !c.reach(id, "the free list") { break }
+		buff, err := c.read(id)
+		if buff == nil { return err }
+		page := &pages.Page{}
+		page.FromBytes(buff)
+		if page.GetType() != pages.FREE_PAGE {
+			c.fail(id, "free list trunk is a %s", page.GetType())
+			break
+		}
+		n := int(binary.LittleEndian.Uint32(page.Body[TRUNK_COUNT_OFF:]))
+		if n > c.d.trunkCap() {
+			c.fail(id, "free list trunk holds %d ids, it has room for %d", n, c.d.trunkCap())
+			n = c.d.trunkCap()
+		}
+		count += uint64(n) + 1
+		for i := range n {
+			free := binary.LittleEndian.Uint64(page.Body[TRUNK_IDS_OFF + i*8:])
+			if free == 0 || free > c.d.Total {
+				c.fail(id, "free list has page %d, pages only go up to %d", free, c.d.Total)
+				continue
+			}
+			c.reach(free, fmt.Sprintf("free list trunk %d", id))
+		}
+		id = page.Next
+	}
+	if count != c.d.FreeCount { c.fail(0, "free list has %d pages, the header says %d", count, c.d.FreeCount) }
+	return nil
+}
+
+// Data pages by id, nil if it couldnt be read
+func (c *checker) dataPage(id uint64) (*pages.Page, error) {
+	if p, ok := c.data[id]; ok { return p, nil }
+	var p *pages.Page
+	if id != 0 && id <= c.d.Total {
+		buff, err := c.read(id)
+		if err != nil { return nil, err }
+		if buff != nil {
+			p = &pages.Page{}
+			p.FromBytes(buff)
+		}
+	}
+	c.data[id] = p
+	return p, nil
+}
+
+func freeSlots(p *pages.Page) int {
+	capacity := int(p.GetSlotCapacity())
+	free := capacity
+	for _, b := range p.Body[:capacity/8] { free -= bits.OnesCount8(b) }
+	return free
+}
+
+// Every clean entry of the free space map is a data page of the type and
+// slot size it says. Freeing a slot can add a second entry for a page,
+// together they may never promise more slots than its bitmap has free
+func (c *checker) spaceMap() error {
+	promised := map[uint64]int{}
+	var order []uint64
+	for _, entry := range c.fsm {
+		id := binary.LittleEndian.Uint64(entry[fsm.FSM_KEY_SIZE:])
+		c.reachData(id, "the free space map")
+		if c.owner[id] != DATA_OWNER { continue }
+		p, err := c.dataPage(id)
+		if err != nil { return err }
+		if p == nil { continue }
+		want := pages.VAR_PAGE
+		if entry[0] == 1 { want = pages.FILE_FIXED }
+		if p.GetType() != want {
+			c.fail(id, "free space map has it as a %s, it is a %s", want, p.GetType())
+			continue
+		}
+		if want != pages.FILE_FIXED { continue }
+		size := binary.LittleEndian.Uint16(entry[fsm.SIZE_OFFSET:])
+		if size != uint16(p.GetSlotSize()) {
+			c.fail(id, "free space map has slots of %d bytes, the page has %d", size, p.GetSlotSize())
+		}
+		if _, ok := promised[id]; !ok { order = append(order, id) }
+		promised[id] += int(entry[fsm.COUNT_OFFSET]) - 1
+	}
+	// the counts can fall behind the bitmap, not run ahead of it
+	for _, id := range order {
+		if free := freeSlots(c.data[id]); free < promised[id] {
+			c.fail(id, "free space map promises %d free slots, the bitmap has %d", promised[id], free)
+		}
+	}
+	return nil
+}
+
+// Every row an index points at is a taken slot of a FILE_FIXED page
+func (c *checker) rowsExist() error {
+	for _, loc := range c.rows {
+		slot := int(loc[7])
+		id := binary.LittleEndian.Uint64(append(slices.Clone(loc[:7]), 0))
+		if id == 0 || id > c.d.Total {
+			c.fail(id, "an index points at a row past the pages in use")
+			continue
+		}
+		c.reachData(id, "an index")
+		p, err := c.dataPage(id)
+		if err != nil { return err }
+		switch {
+			case p == nil:
+			case p.GetType() != pages.FILE_FIXED:
+				c.fail(id, "an index points at row %d of a %s", slot, p.GetType())
+			case slot >= int(p.GetSlotCapacity()):
+				c.fail(id, "an index points at row %d, the page has %d", slot, p.GetSlotCapacity())
+			case p.Body[slot/8] & (1 << (slot%8)) == 0:
+				c.fail(id, "an index points at row %d, its slot is free", slot)
+		}
+	}
+	return nil
+}
@@ -3,10 +3,14 @@ package database
 import (
 	"encoding/binary"
 	"errors"
-	"io"
+	"fmt"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 	"mydb/core/pages"
+	"mydb/core/prims"
 	"mydb/core/table"
 	"mydb/core/types"
 	"mydb/fileT"
@@ -14,101 +18,301 @@ import (
 
 type Database struct {
 	*DBHeader
+	Superblock
 	FilePath 	string
-	File 		*os.File
-	Fd 			int
+	Store 		prims.Storage
+	// set before Start, Open checks them
+	Options 	Options
 
+	// a writer holds name.lock as long as it is open, a reader only
+	// looks whether someone does
+	lockFile 	prims.Storage
+	hasWriter 	bool
+	metaPage 	*pages.Page
+	fileTable 	*fileT.FileTable
 	fileTableIn chan *types.DbMessage
+	stop 		chan struct{} // closed by Close
+	// held by every message on its way through a table,
+	// Close takes it whole so nothing is left in flight
+	mux 		sync.RWMutex
 }
 const (
-	TOTAL_PAGES_OFF = 0
-	NEXT_FREE_OFF   = 4
-	LAST_FREE_OFF   = 8
+	TOTAL_PAGES_OFF = 0  // highest page id handed out
+	MAX_PAGES_OFF   = 8  // pages the file has room for
+	FREE_TRUNK_OFF  = 16 // first trunk of the free list, 0 when empty
+	FREE_COUNT_OFF  = 24 // pages on the free list, trunks included
+	CHECKPOINT_OFF  = 32 // lsn recovery redoes from
 
-	HEADER_SIZE     = 16 // Total size of the header in bytes
+	HEADER_SIZE     = 40 // Total size of the header in bytes
+
+	CHECKPOINT_INTERVAL = 30 * time.Second
+
+	// a file path that keeps the database in memory, gone once it is closed
+	MEMORY = ":memory:"
+)
+
+var (
+	ErrClosed 	= errors.New("Database is closed")
+	ErrInUse 	= errors.New("Database is already open for writing")
+	ErrReadOnly = errors.New("Database is open read only")
+	ErrFailed 	= table.ErrFailed
 )
 
+// Sits at the start of the meta page body, every field is little endian.
+// It is only written at a checkpoint, recovery brings it up to date.
 type DBHeader struct { 
 	Total uint64
 	Max uint64
-	Next uint64
-	Last uint64
+	FreeTrunk uint64
+	FreeCount uint64
+	CheckpointLsn uint64
 	lock *sync.Mutex
-	zeroBuff 	[]byte
+
+	free 	[]uint64
+	isFree 	map[uint64]bool
 }
 
 func DBHeaderFromBytes(buff []byte) *DBHeader {
 	dbh := &DBHeader{ 
-		Total: binary.LittleEndian.Uint64(buff[:]),
-		Next:binary.LittleEndian.Uint64(buff[NEXT_FREE_OFF:]) , 
-		Last:binary.LittleEndian.Uint64(buff[LAST_FREE_OFF:]),
+		Total: binary.LittleEndian.Uint64(buff[TOTAL_PAGES_OFF:]),
+		Max: binary.LittleEndian.Uint64(buff[MAX_PAGES_OFF:]),
+		FreeTrunk: binary.LittleEndian.Uint64(buff[FREE_TRUNK_OFF:]),
+		FreeCount: binary.LittleEndian.Uint64(buff[FREE_COUNT_OFF:]),
+		CheckpointLsn: binary.LittleEndian.Uint64(buff[CHECKPOINT_OFF:]),
 		lock: &sync.Mutex{},
-		zeroBuff: make([]byte, pages.PAGE_SIZE),
+		isFree: map[uint64]bool{},
 	}
 	return dbh
 }
 
-func (d *Database) GetFd() int { return d.Fd }
+func (h *DBHeader) ToBytes(buff []byte) {
+	binary.LittleEndian.PutUint64(buff[TOTAL_PAGES_OFF:], h.Total)
+	binary.LittleEndian.PutUint64(buff[MAX_PAGES_OFF:], h.Max)
+	binary.LittleEndian.PutUint64(buff[FREE_TRUNK_OFF:], h.FreeTrunk)
+	binary.LittleEndian.PutUint64(buff[FREE_COUNT_OFF:], h.FreeCount)
+	binary.LittleEndian.PutUint64(buff[CHECKPOINT_OFF:], h.CheckpointLsn)
+}
+
+func (d *Database) GetStore() prims.Storage { return d.Store }
+func (d *Database) GetVolume() prims.Volume { return d.Options.Volume }
+func (d *Database) GetPageSize() uint16 { return uint16(d.Options.PageSize) }
+func (d *Database) GetPath() string { return d.FilePath }
+func (d *Database) HasWriter() bool { return d.hasWriter }
+
+// The file a writer locks to keep other writers out
+func LockPath(path string) string { return path + ".lock" }
+
 func (d *Database) Start(filePath string) error {
 	d.FilePath = filePath
 	if len(d.FilePath) < 1 { return errors.New("File path not set") }
+	if d.FilePath == MEMORY {
+		// every database gets its own, there is no disk to sync to
+		d.Options.Volume = prims.NewMemVolume()
+		d.Options.Durability = types.Durability{ Mode: types.NO_SYNC }
+	}
+	opts, err := withDefaults(d.Options)
+	if err != nil { return err }
+	d.Options = opts
 
-	file, err := os.OpenFile(d.FilePath, os.O_RDWR|os.O_APPEND, 0644)
-	if err != nil { 
-		if os.IsNotExist(err) {
-			// Create the file if it does not exist
-			file, err = os.Create(d.FilePath)
-			if err != nil {
-				return errors.New("Failed to create database file: " + err.Error())
-			}
-		} else {
-			return errors.New("Failed to open database file: " + err.Error())
-		}
+	flag := os.O_RDWR | os.O_CREATE
+	if d.Options.ReadOnly { flag = os.O_RDONLY }
+	store, err := d.Options.Volume.Open(d.FilePath, flag)
+	if err != nil { return errors.New("Failed to open database file: " + err.Error()) }
+	if d.Options.Compress {
+		c := pages.Compress(store)
+		c.Mark = d.MarkCompressed
+		store = c
 	}
-	d.File = file
-	d.Fd = int(file.Fd())
+	d.Store = store
 
 	defer func() {if err != nil { d.Close() }}()
 
-	size, err := file.Seek(0, io.SeekEnd)
-	if size < int64(pages.PAGE_SIZE) || err != nil { 
+	// one writer and any number of readers share the file,
+	// the writer keeps the others out with name.lock
+	if d.Options.ReadOnly {
+		d.hasWriter = writerAtWork(d.Options.Volume, d.FilePath)
+	} else if err = d.lockWriter(); err != nil {
+		return err
+	}
+	if err = store.Lock(true); err != nil {
+		if errors.Is(err, prims.ErrLocked) { err = fmt.Errorf("%w: %s", ErrInUse, d.FilePath) }
+		return err
+	}
+
+	version, err := d.findMeta()
+	if err != nil { return err }
+	if d.Options.ReadOnly && version < FORMAT_VERSION {
+		err = errors.New("Database has to be opened for writing once to create or upgrade it")
+		return err
+	}
+	// the file decides, asking for another size is a mistake
+	if d.Options.PageSize != 0 && d.Options.PageSize != int(d.PageSize) {
+		err = fmt.Errorf("Database file uses %d byte pages, not %d", d.PageSize, d.Options.PageSize)
+		return err
+	}
+	d.Options.PageSize = int(d.PageSize)
+	pageSize := int64(d.PageSize)
+
+	size, err := store.Size()
+	if size < pageSize || err != nil { 
 		if err != nil {
-			return errors.New("Failed to seek to end of database file: " + err.Error())
+			return errors.New("Failed to size database file: " + err.Error())
 		}
 		// If we reach here, it means the file is empty or not initialized
 
-		err = file.Truncate(int64(pages.PAGE_SIZE))
+		err = store.Truncate(pageSize)
 		if err != nil { return errors.New("Failed to truncate database file: " + err.Error()) }
+		size = pageSize
+	}
+	// what a reader replays of the log a writer is still adding to
+	// is kept in memory
+	if d.hasWriter {
+		store = prims.NewOverlay(store, int(pageSize))
+		d.Store = store
 	}
-	buff := make([]byte, pages.PAGE_SIZE)
-	metaPage, err := pages.LoadPage(d.Fd, 0, buff)
+	buff := make([]byte, pageSize)
+	metaPage, err := pages.LoadPage(store, 0, buff)
 	if err != nil { return err }
 
 	d.DBHeader = DBHeaderFromBytes(metaPage.Body[:HEADER_SIZE])
+	// never grow the file into pages that are already there
+	if d.Max > uint64(size / pageSize) {
+		err = errors.New("Database file is shorter than its header says")
+		return err
+	}
+	d.Max = uint64(size / pageSize)
+	if err = d.readFreeList(); err != nil { return err }
 	metaPage.Cursor = HEADER_SIZE
+	d.metaPage = metaPage
+	if version < FORMAT_VERSION {
+		if err = d.upgrade(version); err != nil { return err }
+	}
 
 	// FILES TABLE
-	ft := &fileT.FileTable{BaseTable:new(table.BaseTable)}
-	d.fileTableIn, err = table.StartTable(ft, d, metaPage)
+	d.fileTable = &fileT.FileTable{BaseTable:new(table.BaseTable)}
+	d.fileTableIn, err = table.StartTable(d.fileTable, d, metaPage, d.Options)
 	if err != nil { return err }
 
+	d.stop = make(chan struct{})
+	if !d.Options.ReadOnly { go d.runCheckpoints(d.stop) }
+
 	return nil
 }
 
+// Turns new messages away and waits for the ones in flight, then every
+// table checkpoints, flushes its cache and closes its log before it stops.
+// The meta page with the log state and the file are synced last.
+// Safe to call from anywhere and more than once
 func (d *Database) Close() error {
-	// Seek to start
-	_, err := d.File.Seek(0, 0)
-	if err != nil { return err }
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.stop != nil {
+		close(d.stop)
+		d.stop = nil
+	}
+	var err error
+	if d.fileTableIn != nil {
+		msg := &types.DbMessage{ Code: types.TERMINATE, Output: make(chan any, 1) }
+		d.fileTableIn <- msg
+		err, _ = (<-msg.Output).(error)
+		d.fileTableIn = nil
+		if err == nil && !d.Options.ReadOnly { err = d.WriteMeta() }
+	}
 
-	// Write the header
-	err = binary.Write(d.File, types.Direction, d.DBHeader)
-	if err != nil { return err }
+	if d.Store != nil {
+		if cerr := d.Store.Close(); err == nil { err = cerr }
+		d.Store = nil
+	}
+	// only once the file is done with can the next writer come in
+	if d.lockFile != nil {
+		d.lockFile.Close()
+		d.lockFile = nil
+	}
+	return err
+}
 
-	if d.File != nil {
-		d.File.Close()
-		d.File = nil
-		d.Fd = -1
+// Takes name.lock for the life of the database, ErrInUse if another
+// writer has it. The file is left behind on close, removing it would
+// let two writers lock two different files
+func (d *Database) lockWriter() error {
+	file, err := d.Options.Volume.Open(LockPath(d.FilePath), os.O_RDWR | os.O_CREATE)
+	if err != nil { return errors.New("Failed to open lock file: " + err.Error()) }
+	if err = file.Lock(false); err != nil {
+		file.Close()
+		if errors.Is(err, prims.ErrLocked) { err = fmt.Errorf("%w: %s", ErrInUse, d.FilePath) }
+		return err
 	}
+	d.lockFile = file
 	return nil
 }
 
+// Whether a writer has the database at path open. The shared lock taken
+// to find out is let go at once, a writer starting in that moment
+// gets ErrInUse
+func writerAtWork(vol prims.Volume, path string) bool {
+	file, err := vol.Open(LockPath(path), os.O_RDONLY)
+	if err != nil { return false } // never opened for writing
+	defer file.Close()
+	return errors.Is(file.Lock(true), prims.ErrLocked)
+}
+
+// Closes the database on the first of sigs, SIGINT and SIGTERM when none
+// are given. What Close returned comes out of the channel
+func (d *Database) CloseOnSignal(sigs ...os.Signal) <-chan error {
+	if len(sigs) == 0 { sigs = []os.Signal{ syscall.SIGINT, syscall.SIGTERM } }
+	out := make(chan error, 1)
+	d.mux.RLock()
+	stop := d.stop
+	d.mux.RUnlock()
+	// closed already, a nil stop would never fire
+	if stop == nil {
+		out <- ErrClosed
+		return out
+	}
+	in := make(chan os.Signal, 1)
+	signal.Notify(in, sigs...)
+	go func() {
+		defer signal.Stop(in)
+		select {
+			case <-in: out <- d.Close()
+			case <-stop: out <- ErrClosed
+		}
+	}()
+	return out
+}
+
+// Hands msg to the file table and waits for the answer
+func (d *Database) send(msg *types.DbMessage) (any, error) {
+	d.mux.RLock()
+	defer d.mux.RUnlock()
+	if d.fileTableIn == nil { return nil, ErrClosed }
+	return d.call(msg), nil
+}
+
+// send without the lock, for callers that hold it already
+func (d *Database) call(msg *types.DbMessage) any {
+	d.fileTableIn <- msg
+	return <-msg.Output
+}
+
+// Checkpoints every table, the log before the oldest
+// change still only in memory is freed
+func (d *Database) Checkpoint() error {
+	msg := &types.DbMessage{ Code: types.RUN_CHECKPOINT, Output: make(chan any, 1) }
+	res, err := d.send(msg)
+	if err != nil { return err }
+	err, _ = res.(error)
+	return err
+}
+
+// Only starts them, the tables write the pages out when they have nothing else to do
+func (d *Database) runCheckpoints(stop chan struct{}) {
+	ticker := time.NewTicker(CHECKPOINT_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+			case <-stop: return
+			case <-ticker.C: d.send(&types.DbMessage{ Code: types.BEGIN_CHECKPOINT, Output: make(chan any, 1) })
+		}
+	}
+}
@@ -1,14 +1,29 @@
 package database
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"syscall"
+	"sync/atomic"
 	"testing"
 	"time"
+	"mydb/core/indexes"
+	"mydb/core/logger"
 	"mydb/core/pages"
+	"mydb/core/prims"
+	"mydb/core/types"
 	"mydb/fileT"
 )
 
@@ -21,7 +36,7 @@ func Test_File_Table(t *testing.T) {
 	}
 
 	defer db.Close()
-	defer os.Remove("test.db")
+	defer removeDb("test.db")
 
 	var size, ti int64
 	var fileType int8
@@ -30,8 +45,7 @@ func Test_File_Table(t *testing.T) {
 	var idd string
 	var inTotal, delTotal, getTotal time.Duration
 
-	uidbytes, _ := hex.DecodeString("ABCABC123123ABC1ABCABC123123ABC1")
-	uid := hex.EncodeToString(uidbytes)
+	uid := testUid
 
 	// I believe for FID index is something like 98...	
 	// its expected that we get a clean call followed by a split call
@@ -109,13 +123,45 @@ func Test_File_Table(t *testing.T) {
 
 }
 
+// The process dies, its locks go with it and nothing is flushed
+func crash(db *Database) {
+	if db.Store != nil { db.Store.Close() }
+	if db.lockFile != nil { db.lockFile.Close() }
+}
+
+// the database, its lock file and the segments of its log
+func removeDb(path string) {
+	os.Remove(path)
+	os.Remove(LockPath(path))
+	os.RemoveAll(path + ".wal")
+}
+
+// Every test files its rows under the same uid
+var testUidBytes, _ = hex.DecodeString("ABCABC123123ABC1ABCABC123123ABC1")
+var testUid = hex.EncodeToString(testUidBytes)
+
+// The hash of row i, prefix keeps the rows of one test apart
+func testHash(prefix string, i int) [32]byte {
+	return sha256.Sum256([]byte(fmt.Sprintf("%s%d", prefix, i)))
+}
+
+// A new database at path, removed again once the test is done
+func openTest(t *testing.T, path string, opts Options) *Database {
+	t.Helper()
+	removeDb(path)
+	t.Cleanup(func() { removeDb(path) })
+	db, err := Open(path, opts)
+	if err != nil { t.Fatalf("Failed to open database: %v", err) }
+	return db
+}
+
 func PrintStats(inTotal, delTotal, getTotal time.Duration, ITERATIONS, LOOP int64, pageCount uint64) {
 	fmt.Printf("\n")
 	fmt.Printf(" AVG-INSERT: %03d micros\n", inTotal.Microseconds()/(ITERATIONS))
 	fmt.Printf(" AVG-DELETE: %03d micros\n", delTotal.Microseconds()/((ITERATIONS/LOOP)-1))
 	fmt.Printf(" AVG-GET:    %03d micros\n", getTotal.Microseconds()/(ITERATIONS/LOOP)-1)
 	fmt.Printf(" TOTAL PAGE: %03d\n", pageCount) 
-	fmt.Printf(" TOTAL SIZE: %dkb\n", (pageCount*uint64(pages.PAGE_SIZE))/1024) 
+	fmt.Printf(" TOTAL SIZE: %dkb\n", (pageCount*uint64(pages.DEFAULT_PAGE_SIZE))/1024) 
 	printMemStats()
 	fmt.Printf("\n")
 }
@@ -129,3 +175,1625 @@ func printMemStats() {
 	fmt.Printf(" NUMGC:	%v\n", m.NumGC)
 	fmt.Printf(" OBJEX:	%v\n", m.HeapObjects)
 }
+
+func Test_Recovery(t *testing.T) {
+	const COUNT = 2000
+	uid := testUid
+
+	// crash: the first database is never closed
+	db := openTest(t, "recover.db", Options{})
+	insertRange(t, db, "recovervalue", 0, COUNT)
+	for i := 0; i < COUNT; i += 3 {
+		hash := testHash("recovervalue", i)
+		if err := db.DeleteFile(uid, hash); err != nil { t.Fatalf("Failed to DELETE file: %v #%d", err, i) }
+	}
+
+	crash(db)
+	db = new(Database)
+	if err := db.Start("recover.db"); err != nil { t.Fatalf("Failed to recover database: %v", err) }
+	checkRecovered(t, db, uid, COUNT)
+
+	// crash again after writing on top of the recovered log
+	insertRange(t, db, "recovervalue", COUNT, COUNT*2)
+	for i := COUNT; i < COUNT*2; i++ {
+		if i % 3 != 0 { continue }
+		hash := testHash("recovervalue", i)
+		if err := db.DeleteFile(uid, hash); err != nil { t.Fatalf("Failed to DELETE file: %v #%d", err, i) }
+	}
+
+	crash(db)
+	db = new(Database)
+	if err := db.Start("recover.db"); err != nil { t.Fatalf("Failed to recover database: %v", err) }
+	defer db.Close()
+	checkRecovered(t, db, uid, COUNT*2)
+}
+
+// every third file was deleted before the crash
+func checkRecovered(t *testing.T, db *Database, uid string, count int) {
+	for i := range count {
+		hash := testHash("recovervalue", i)
+		h, _, err := db.GetFile(uid, hash)
+		if i % 3 == 0 {
+			if err == nil { t.Fatalf("Deleted file came back #%d", i) }
+			continue
+		}
+		if err != nil { t.Fatalf("Failed to GET file: %v #%d", err, i) }
+		if h.Id != hex.EncodeToString(hash[:16]) { t.Fatalf("Invalid id gotten #%d", i) }
+	}
+}
+
+// Inserts the prefix files numbered from up to but not including to
+func insertRange(t *testing.T, db *Database, prefix string, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		err := db.InsertFile(testUid, int64(1024+i), fileT.Jpeg, testHash(prefix, i), int64(1633036800-i))
+		if err != nil { t.Fatalf("Failed to insert file: %v #%d", err, i) }
+	}
+}
+
+// Every prefix file numbered from up to but not including to is there
+func checkRange(t *testing.T, db *Database, prefix string, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if _, _, err := db.GetFile(testUid, testHash(prefix, i)); err != nil { t.Fatalf("Failed to GET file: %v #%d", err, i) }
+	}
+}
+
+func Test_Cancel(t *testing.T) {
+	const COUNT = 500
+	uid := testUid
+
+	db := openTest(t, "cancel.db", Options{})
+	insertRange(t, db, "cancelvalue", 0, COUNT)
+
+	// enough entries in one transaction to split leaves, then throw it away
+	ft := db.fileTable
+	trxId, err := ft.BeginTxn()
+	if err != nil { t.Fatalf("Failed to begin: %v", err) }
+	for i := COUNT; i < COUNT*2; i++ {
+		hash := testHash("cancelvalue", i)
+		row := &fileT.FileRow{
+			Uid: [16]byte(testUidBytes), Hash: [16]byte(hash[:16]),
+			Size: int64(1024+i), FileType: fileT.Jpeg,
+			CreatedAt: int64(1633036800-i), RefCount: 1,
+		}
+		if err = fileT.NewFileEntry(ft.Index, row.ToBytes(), trxId); err != nil {
+			t.Fatalf("Failed to insert entry: %v #%d", err, i)
+		}
+	}
+	if err = ft.CancelTxn(trxId); err != nil { t.Fatalf("Failed to cancel: %v", err) }
+	checkCancelled(t, db, uid, COUNT)
+
+	// and it stays gone after a crash
+	crash(db)
+	db = new(Database)
+	if err := db.Start("cancel.db"); err != nil { t.Fatalf("Failed to recover database: %v", err) }
+	defer db.Close()
+	checkCancelled(t, db, uid, COUNT)
+}
+
+// the first count files made it, the next count were cancelled
+func checkCancelled(t *testing.T, db *Database, uid string, count int) {
+	for i := range count*2 {
+		hash := testHash("cancelvalue", i)
+		_, _, err := db.GetFile(uid, hash)
+		if i >= count && err == nil { t.Fatalf("Cancelled file is there #%d", i) }
+		if i < count && err != nil { t.Fatalf("Failed to GET file: %v #%d", err, i) }
+	}
+}
+
+// A cancel that cant put its pages back fails the table, what it left
+// is undone by the next start
+func Test_CancelFails(t *testing.T) {
+	const COUNT = 500
+	uid := testUid
+	vol := prims.NewFaultVolume(prims.Faults{})
+	db, err := Open("cancelfails.db", Options{ Volume: vol })
+	if err != nil { t.Fatalf("Failed to open database: %v", err) }
+	insertRange(t, db, "cancelvalue", 0, COUNT)
+
+	ft := db.fileTable
+	trxId, err := ft.BeginTxn()
+	if err != nil { t.Fatalf("Failed to begin: %v", err) }
+	for i := COUNT; i < COUNT*2; i++ {
+		hash := testHash("cancelvalue", i)
+		row := &fileT.FileRow{
+			Uid: [16]byte(testUidBytes), Hash: [16]byte(hash[:16]),
+			Size: int64(1024+i), FileType: fileT.Jpeg,
+			CreatedAt: int64(1633036800-i), RefCount: 1,
+		}
+		if err = fileT.NewFileEntry(ft.Index, row.ToBytes(), trxId); err != nil {
+			t.Fatalf("Failed to insert entry: %v #%d", err, i)
+		}
+	}
+	vol.FailRange("cancelfails.db", 0, 1 << 40)
+	if err = ft.CancelTxn(trxId); !errors.Is(err, ErrFailed) || !errors.Is(err, syscall.EIO) { t.Fatalf("Cancel onto a bad disk returned %v", err) }
+
+	// no more writes, and nothing is written out on close
+	if _, err := ft.BeginTxn(); !errors.Is(err, ErrFailed) { t.Fatalf("Began a transaction on a failed table, err %v", err) }
+	hash := testHash("cancelvalue", COUNT*2)
+	if err := db.InsertFile(uid, 1024, fileT.Jpeg, hash, 1633036800); !errors.Is(err, ErrFailed) { t.Fatalf("Inserted into a failed table, err %v", err) }
+	if err := db.Close(); !errors.Is(err, ErrFailed) { t.Fatalf("Closed a failed table with %v", err) }
+
+	db, err = Open("cancelfails.db", Options{ Volume: vol.Restart(prims.Faults{}) })
+	if err != nil { t.Fatalf("Failed to recover database: %v", err) }
+	defer db.Close()
+	checkCancelled(t, db, uid, COUNT)
+}
+
+// Pages a cancelled transaction claimed are handed out again before the
+// file grows, across a crash and across a checkpoint
+func Test_FreeList(t *testing.T) {
+	const COUNT = 500
+
+	db := openTest(t, "free.db", Options{})
+	insertRange(t, db, "freevalue", 0, COUNT)
+
+	ft := db.fileTable
+	trxId, err := ft.BeginTxn()
+	if err != nil { t.Fatalf("Failed to begin: %v", err) }
+	for i := COUNT; i < COUNT*3; i++ {
+		hash := testHash("cancelled", i)
+		row := &fileT.FileRow{
+			Uid: [16]byte(testUidBytes), Hash: [16]byte(hash[:16]),
+			Size: int64(1024+i), FileType: fileT.Jpeg,
+			CreatedAt: int64(1633036800-i), RefCount: 1,
+		}
+		if err = fileT.NewFileEntry(ft.Index, row.ToBytes(), trxId); err != nil {
+			t.Fatalf("Failed to insert entry: %v #%d", err, i)
+		}
+	}
+	if err = ft.CancelTxn(trxId); err != nil { t.Fatalf("Failed to cancel: %v", err) }
+	freed, total := db.FreePages(), db.Total
+	if freed == 0 { t.Fatalf("Cancel freed no pages") }
+
+	// the log gives them back after a crash
+	crash(db)
+	db = new(Database)
+	if err := db.Start("free.db"); err != nil { t.Fatalf("Failed to recover database: %v", err) }
+	if db.FreePages() != freed { t.Fatalf("Free pages after crash %d, want %d", db.FreePages(), freed) }
+
+	// the trunks do after a checkpoint
+	if err := db.Checkpoint(); err != nil { t.Fatalf("Failed to checkpoint: %v", err) }
+	crash(db)
+	db = new(Database)
+	if err := db.Start("free.db"); err != nil { t.Fatalf("Failed to recover database: %v", err) }
+	if db.FreePages() != freed { t.Fatalf("Free pages after checkpoint %d, want %d", db.FreePages(), freed) }
+
+	insertRange(t, db, "freevalue", COUNT, COUNT*2)
+	if db.Total != total { t.Fatalf("File grew to %d pages with %d free", db.Total, db.FreePages()) }
+	if db.FreePages() >= freed { t.Fatalf("No free page was reused") }
+
+	// claims since the checkpoint take the pages off the list again
+	left := db.FreePages()
+	crash(db)
+	db = new(Database)
+	if err := db.Start("free.db"); err != nil { t.Fatalf("Failed to recover database: %v", err) }
+	defer db.Close()
+	if db.FreePages() != left { t.Fatalf("Free pages after reuse %d, want %d", db.FreePages(), left) }
+	insertRange(t, db, "freevalue", COUNT*2, COUNT*3)
+	checkRange(t, db, "freevalue", 0, COUNT*3)
+}
+
+// A page a committed transaction freed after the checkpoint is
+// handed out again after a crash, the log has the free
+func Test_FreedPage(t *testing.T) {
+	const COUNT = 200
+
+	db := openTest(t, "freed.db", Options{})
+	insertRange(t, db, "freedvalue", 0, COUNT)
+	if err := db.Checkpoint(); err != nil { t.Fatalf("Failed to checkpoint: %v", err) }
+
+	ft := db.fileTable
+	commit := func(trxId uint64) {
+		errc := make(chan error, 1)
+		ft.CommitTxn(trxId, func(err error) { errc <- err })
+		if err := <-errc; err != nil { t.Fatalf("Failed to commit: %v", err) }
+	}
+	// claimed by one transaction, freed by the next
+	trxId, err := ft.BeginTxn()
+	if err != nil { t.Fatalf("Failed to begin: %v", err) }
+	id, err := db.ClaimFreePage(pages.IDX_LEAF)
+	if err != nil { t.Fatalf("Failed to claim a page: %v", err) }
+	axs := []*types.Action{types.AtomicAx(types.NEWPAGE, types.Page, id)}
+	if _, err := ft.Logger.NewTxn(&axs, &[]*[]byte{{}}, trxId); err != nil { t.Fatalf("Failed to log the claim: %v", err) }
+	commit(trxId)
+	freed := db.FreePages()
+
+	trxId, err = ft.BeginTxn()
+	if err != nil { t.Fatalf("Failed to begin: %v", err) }
+	if err := ft.Logger.FreePage(trxId, id); err != nil { t.Fatalf("Failed to free page: %v", err) }
+	if db.FreePages() != freed { t.Fatalf("Page %d freed before its transaction committed", id) }
+	commit(trxId)
+	if db.FreePages() != freed + 1 { t.Fatalf("Free pages after commit %d, want %d", db.FreePages(), freed + 1) }
+
+	crash(db)
+	db = new(Database)
+	if err := db.Start("freed.db"); err != nil { t.Fatalf("Failed to recover database: %v", err) }
+	defer db.Close()
+	if db.FreePages() != freed + 1 { t.Fatalf("Free pages after crash %d, want %d", db.FreePages(), freed + 1) }
+	if got, err := db.ClaimFreePage(pages.IDX_LEAF); err != nil || got != id {
+		t.Fatalf("Claimed page %d after the crash, err %v, page %d was freed", got, err, id)
+	}
+}
+
+func Test_WriteAhead(t *testing.T) {
+	const COUNT = 10000
+
+	db := openTest(t, "wal.db", Options{})
+	defer db.Close()
+	insertRange(t, db, "walvalue", 0, COUNT)
+
+	// whatever the cache evicted can not be ahead of the log
+	flushed := db.fileTable.Logger.FlushedLsn()
+	buff := make([]byte, pages.DEFAULT_PAGE_SIZE)
+	for id := uint64(1); id < db.Max; id++ {
+		p, err := pages.LoadPage(db.Store, id, buff)
+		if err != nil { t.Fatalf("Failed to load page %d: %v", id, err) }
+		if p.Lsn > flushed { t.Fatalf("Page %d has lsn %d, log is on disk to %d", id, p.Lsn, flushed) }
+	}
+}
+
+func Test_Durability(t *testing.T) {
+	const COUNT = 300
+	modes := []types.Durability{
+		{Mode: types.SYNC_COMMIT},
+		{Mode: types.GROUP_COMMIT, Window: time.Millisecond},
+		{Mode: types.NO_SYNC},
+	}
+	for _, dur := range modes {
+		removeDb("durable.db")
+		db, err := Open("durable.db", Options{Durability: dur})
+		if err != nil { t.Fatalf("Failed to start database: %v", err) }
+		l := db.fileTable.Logger
+		for i := range COUNT {
+			insertRange(t, db, "durablevalue", i, i+1)
+			// the commit record is the last one written
+			if dur.Mode != types.NO_SYNC && l.FlushedLsn() < l.Lsn {
+				t.Fatalf("Mode %d returned before the commit was synced #%d", dur.Mode, i)
+			}
+		}
+
+		crash(db)
+		db, err = Open("durable.db", Options{Durability: dur})
+		if err != nil { t.Fatalf("Failed to recover database: %v", err) }
+		checkRange(t, db, "durablevalue", 0, COUNT)
+		db.Close()
+	}
+	removeDb("durable.db")
+}
+
+func Test_GroupCommit(t *testing.T) {
+	const COUNT = 32
+	uid := testUid
+	vol := prims.NewFaultVolume(prims.Faults{})
+	dur := types.Durability{ Mode: types.GROUP_COMMIT, Window: 5 * time.Millisecond }
+	db, err := Open("group.db", Options{ Volume: vol, Durability: dur })
+	if err != nil { t.Fatalf("Failed to open database: %v", err) }
+
+	// committers that come in together share a sync
+	syncs := vol.Syncs()
+	errs := make(chan error, COUNT)
+	for i := range COUNT {
+		go func() {
+			hash := testHash("groupvalue", i)
+			errs <- db.InsertFile(uid, int64(1024+i), fileT.Jpeg, hash, int64(1633036800-i))
+		}()
+	}
+	for range COUNT {
+		if err := <-errs; err != nil { t.Fatalf("Failed to insert file: %v", err) }
+	}
+	if n := vol.Syncs() - syncs; n >= COUNT { t.Fatalf("%d commits took %d syncs", COUNT, n) }
+
+	// and every one of them made it through the power going
+	db, err = Open("group.db", Options{ Volume: vol.Restart(prims.Faults{}), Durability: dur })
+	if err != nil { t.Fatalf("Failed to recover database: %v", err) }
+	defer db.Close()
+	checkRange(t, db, "groupvalue", 0, COUNT)
+}
+
+func Test_Checkpoint(t *testing.T) {
+	const COUNT = 2000
+	uid := testUid
+	defer func(size uint32) { logger.SegmentSize = size }(logger.SegmentSize)
+	logger.SegmentSize = 1024 * 1024
+
+	db := openTest(t, "checkpoint.db", Options{})
+	insertRange(t, db, "recovervalue", 0, COUNT)
+	if err := db.Checkpoint(); err != nil { t.Fatalf("Failed to checkpoint: %v", err) }
+	redo := db.GetCheckpoint()
+	if redo == 0 { t.Fatalf("Checkpoint didnt record a redo lsn") }
+
+	// the log started in the first segment, it is deleted now
+	l := db.fileTable.Logger
+	if l.Segment == 1 { t.Fatalf("Log never left the first segment") }
+	if _, err := os.Stat(l.SegmentPath(1)); !os.IsNotExist(err) { t.Fatalf("Segment before the checkpoint was kept") }
+
+	// crash with work on both sides of the checkpoint
+	for i := 0; i < COUNT; i += 3 {
+		hash := testHash("recovervalue", i)
+		if err := db.DeleteFile(uid, hash); err != nil { t.Fatalf("Failed to DELETE file: %v #%d", err, i) }
+	}
+	crash(db)
+	db = new(Database)
+	if err := db.Start("checkpoint.db"); err != nil { t.Fatalf("Failed to recover database: %v", err) }
+	if db.GetCheckpoint() != redo { t.Fatalf("Checkpoint lsn %d, expected %d", db.GetCheckpoint(), redo) }
+	checkRecovered(t, db, uid, COUNT)
+
+	// and again on top of a checkpoint taken after recovery
+	if err := db.Checkpoint(); err != nil { t.Fatalf("Failed to checkpoint: %v", err) }
+	crash(db)
+	db = new(Database)
+	if err := db.Start("checkpoint.db"); err != nil { t.Fatalf("Failed to recover database: %v", err) }
+	defer db.Close()
+	checkRecovered(t, db, uid, COUNT)
+}
+
+// Checkpoints go on with a transaction open and while messages keep
+// coming, the log is kept from where the open one began
+func Test_FuzzyCheckpoint(t *testing.T) {
+	const COUNT = 2000
+
+	db := openTest(t, "fuzzy.db", Options{})
+	insertRange(t, db, "fuzzyvalue", 0, COUNT)
+
+	// a transaction left open, the crash makes it a loser
+	ft := db.fileTable
+	trxId := ft.Logger.NextTrxId()
+	id, err := db.ClaimFreePage(pages.IDX_LEAF)
+	if err != nil { t.Fatalf("Failed to claim a page: %v", err) }
+	axs := []*types.Action{types.AtomicAx(types.NEWPAGE, types.Page, id)}
+	if _, err := ft.Logger.NewTxn(&axs, &[]*[]byte{{}}, trxId); err != nil { t.Fatalf("Failed to log the claim: %v", err) }
+	opened := ft.Logger.Lsn
+
+	before := db.GetCheckpoint()
+	if err := db.Checkpoint(); err != nil { t.Fatalf("Failed to checkpoint: %v", err) }
+	if db.GetCheckpoint() <= before { t.Fatalf("Checkpoint waited for the open transaction") }
+	if start := ft.Logger.Start().Lsn; start >= opened { t.Fatalf("Log starts at lsn %d, the open transaction at %d", start, opened) }
+
+	// started in the background, written out between inserts
+	insertRange(t, db, "fuzzyvalue", COUNT, 2 * COUNT)
+	redo := db.GetCheckpoint()
+	msg := &types.DbMessage{ Code: types.BEGIN_CHECKPOINT, Output: make(chan any, 1) }
+	if _, err := db.send(msg); err != nil { t.Fatalf("Failed to begin checkpoint: %v", err) }
+	count := 2 * COUNT
+	for ; db.GetCheckpoint() == redo && count < 3 * COUNT; count++ { insertRange(t, db, "fuzzyvalue", count, count+1) }
+	if db.GetCheckpoint() == redo { t.Fatalf("Background checkpoint never finished") }
+
+	crash(db)
+	db = new(Database)
+	if err := db.Start("fuzzy.db"); err != nil { t.Fatalf("Failed to recover database: %v", err) }
+	defer db.Close()
+	checkRange(t, db, "fuzzyvalue", 0, count)
+	// undone, so the page it claimed is free again
+	if got, err := db.ClaimFreePage(pages.IDX_LEAF); err != nil || got != id {
+		t.Fatalf("Claimed page %d after the crash, err %v, page %d was claimed by the open transaction", got, err, id)
+	}
+}
+
+func Test_TornLog(t *testing.T) {
+	const COUNT = 50
+	uid := testUid
+	defer removeDb("torn.db")
+
+	// every byte of the last commit record gets flipped in turn,
+	// the transaction it closed is lost and everything before stays
+	for at := range logger.TRX_SIZE {
+		removeDb("torn.db")
+		db := new(Database)
+		if err := db.Start("torn.db"); err != nil { t.Fatalf("Failed to start database: %v", err) }
+		insertRange(t, db, "tornvalue", 0, COUNT + 1)
+
+		l := db.fileTable.Logger
+		seg, err := os.OpenFile(l.SegmentPath(l.Segment), os.O_RDWR, 0644)
+		if err != nil { t.Fatalf("Failed to open log: %v", err) }
+		off := int64(l.Offset) - logger.TRX_SIZE + int64(at)
+		b := make([]byte, 1)
+		if _, err := seg.ReadAt(b, off); err != nil { t.Fatalf("Failed to read log: %v", err) }
+		b[0] ^= 0xFF
+		if _, err := seg.WriteAt(b, off); err != nil { t.Fatalf("Failed to write log: %v", err) }
+		seg.Close()
+
+		crash(db)
+		db = new(Database)
+		if err := db.Start("torn.db"); err != nil { t.Fatalf("Failed to recover database: %v, byte %d", err, at) }
+		checkRange(t, db, "tornvalue", 0, COUNT)
+		if _, _, err := db.GetFile(uid, testHash("tornvalue", COUNT)); err == nil { t.Fatalf("Torn commit was kept, byte %d", at) }
+
+		// the log carries on from the torn record
+		insertRange(t, db, "tornvalue", COUNT, COUNT + 1)
+		crash(db)
+		db = new(Database)
+		if err := db.Start("torn.db"); err != nil { t.Fatalf("Failed to recover database: %v, byte %d", err, at) }
+		checkRange(t, db, "tornvalue", 0, COUNT + 1)
+		db.Close()
+	}
+}
+
+func Test_TrxIds(t *testing.T) {
+	const COUNT = 200
+	removeDb("trxids.db")
+	defer removeDb("trxids.db")
+
+	var last uint64
+	for round := range 3 {
+		db := new(Database)
+		if err := db.Start("trxids.db"); err != nil { t.Fatalf("Failed to start database: %v", err) }
+		l := db.fileTable.Logger
+		if id := l.NextTrxId(); id <= last { t.Fatalf("Id %d handed out again after a restart, last used was %d", id, last) }
+		insertRange(t, db, "trxvalue", round * COUNT, (round + 1) * COUNT)
+		// the second round restarts from a checkpoint
+		if round == 1 {
+			if err := db.Checkpoint(); err != nil { t.Fatalf("Failed to checkpoint: %v", err) }
+		}
+		// crash, the ids used so far are all below the next one
+		last = l.NextTrxId() - 1
+		crash(db)
+	}
+}
+
+// Ids go on past 32 bits and recovery still tells the transactions apart
+func Test_WideTrxIds(t *testing.T) {
+	const COUNT = 100
+
+	db := openTest(t, "wide.db", Options{})
+	db.Close()
+	patchMeta(t, "wide.db", func(body []byte) {
+		binary.LittleEndian.PutUint64(body[HEADER_SIZE + logger.LOG_TRX_OFF:], 1 << 32 - COUNT)
+	})
+
+	db = new(Database)
+	if err := db.Start("wide.db"); err != nil { t.Fatalf("Failed to start database: %v", err) }
+	insertRange(t, db, "widevalue", 0, COUNT * 2)
+	crash(db)
+	db = new(Database)
+	if err := db.Start("wide.db"); err != nil { t.Fatalf("Failed to recover database: %v", err) }
+	defer db.Close()
+	if id := db.fileTable.Logger.NextTrxId(); id <= 1 << 32 { t.Fatalf("Id %d after the ids passed 32 bits", id) }
+	checkRange(t, db, "widevalue", 0, COUNT * 2)
+}
+
+// A format 1 file still has its log in the cards with 4 byte ids,
+// it is recovered from them and the log goes on in the wide ones
+func Test_NarrowLog(t *testing.T) {
+	const COUNT = 200
+
+	db := openTest(t, "narrow.db", Options{})
+	insertRange(t, db, "narrowvalue", 0, COUNT)
+	crash(db)
+
+	// what format 1 left behind after a crash
+	narrowLog(t, "narrow.db")
+	patchMeta(t, "narrow.db", func(body []byte) {
+		binary.LittleEndian.PutUint32(body[len(body) - SUPERBLOCK_SIZE + VERSION_OFF:], 1)
+	})
+	db = new(Database)
+	if err := db.Start("narrow.db"); err != nil { t.Fatalf("Failed to recover the narrow log: %v", err) }
+	if db.Version != FORMAT_VERSION { t.Fatalf("File still at format %d", db.Version) }
+	checkRange(t, db, "narrowvalue", 0, COUNT)
+
+	// both kinds of card in one log
+	insertRange(t, db, "narrowvalue", COUNT, COUNT * 2)
+	crash(db)
+	db = new(Database)
+	if err := db.Start("narrow.db"); err != nil { t.Fatalf("Failed to recover the mixed log: %v", err) }
+	defer db.Close()
+	checkRange(t, db, "narrowvalue", 0, COUNT * 2)
+}
+
+// Edits the body of the meta page and its copy on a closed file
+func patchMeta(t *testing.T, path string, edit func(body []byte)) {
+	t.Helper()
+	file, err := prims.OS{}.Open(path, os.O_RDWR)
+	if err != nil { t.Fatalf("Failed to open file: %v", err) }
+	defer file.Close()
+	ids := []uint64{0}
+	for i := 0; i < len(ids); i++ {
+		buff := make([]byte, pages.DEFAULT_PAGE_SIZE)
+		if err := pages.ReadPage(file, ids[i], buff); err != nil { t.Fatalf("Failed to read page %d: %v", ids[i], err) }
+		if sb, ok := superblockOf(buff); ok && i == 0 { ids = append(ids, SuperblockFromBytes(sb).Mirror) }
+		edit(buff[pages.PAGE_HEADER_LENGTH:])
+		pages.SetChecksum(buff)
+		if _, err := file.WriteAt(buff, int64(ids[i]) * int64(pages.DEFAULT_PAGE_SIZE)); err != nil { t.Fatalf("Failed to write page: %v", err) }
+	}
+}
+
+// Rewrites the log of a file that never checkpointed
+// in the cards format 1 wrote, 4 byte ids and all
+func narrowLog(t *testing.T, path string) {
+	t.Helper()
+	in, err := Inspect(path, Options{})
+	if err != nil { t.Fatalf("Failed to inspect %s: %v", path, err) }
+	dump, err := in.Page(0)
+	in.Close()
+	if err != nil { t.Fatalf("Failed to read the meta page: %v", err) }
+	if dump.Meta.LogOffset != 0 { t.Fatalf("Log starts at offset %d, not at a segment", dump.Meta.LogOffset) }
+	dir := logger.LogDir(path)
+	segs := make(map[uint32][]byte)
+	crcs := crc32.MakeTable(crc32.Castagnoli)
+	err = logger.WalkLog(prims.OS{}, dir, dump.Meta.LogSegment, 0, func(r *logger.LogRecord) bool {
+		card := make([]byte, logger.TRX_SIZE - logger.NARROW_GAP)
+		card[logger.REC_BEGIN_OFF] = byte(types.TxnBegin)
+		binary.LittleEndian.PutUint32(card[logger.REC_TRX_OFF:], uint32(r.TrxId))
+		binary.LittleEndian.PutUint64(card[logger.REC_LSN_OFF - logger.NARROW_GAP:], r.Action.Lsn)
+		copy(card[logger.REC_ACTION_OFF - logger.NARROW_GAP:], r.Action.GetRaw())
+		card[logger.REC_COMMIT_OFF - logger.NARROW_GAP] = byte(r.Flag)
+		crc := crc32.Update(crc32.Checksum(card[:logger.REC_CRC_OFF - logger.NARROW_GAP], crcs), crcs, r.Value)
+		binary.LittleEndian.PutUint32(card[logger.REC_CRC_OFF - logger.NARROW_GAP:], crc)
+		segs[r.Segment] = append(append(segs[r.Segment], card...), r.Value...)
+		return true
+	})
+	if err != nil || len(segs) == 0 { t.Fatalf("Failed to walk the log: %v", err) }
+	for seg, data := range segs {
+		if err := os.WriteFile(logger.SegmentPath(dir, seg), data, 0644); err != nil { t.Fatalf("Failed to write segment: %v", err) }
+	}
+}
+
+// Copies the segments of dirs into dest, the longest copy of each, with
+// the times taken off the commits the way builds before them logged
+func untimedLog(t *testing.T, dest string, dirs ...string) {
+	t.Helper()
+	os.RemoveAll(dest)
+	if err := os.MkdirAll(dest, 0755); err != nil { t.Fatalf("Failed to make %s: %v", dest, err) }
+	for seg := uint32(1); ; seg++ {
+		var best []byte
+		for _, dir := range dirs {
+			data, err := os.ReadFile(logger.SegmentPath(dir, seg))
+			if err == nil && len(data) > len(best) { best = data }
+		}
+		if best == nil { break }
+		if err := os.WriteFile(logger.SegmentPath(dest, seg), best, 0644); err != nil { t.Fatalf("Failed to write segment: %v", err) }
+	}
+	segs := make(map[uint32][]byte)
+	crcs := crc32.MakeTable(crc32.Castagnoli)
+	err := logger.WalkLog(prims.OS{}, dest, 1, 0, func(r *logger.LogRecord) bool {
+		card := make([]byte, logger.TRX_SIZE)
+		card[logger.REC_BEGIN_OFF] = logger.REC_WIDE
+		binary.LittleEndian.PutUint64(card[logger.REC_TRX_OFF:], r.TrxId)
+		binary.LittleEndian.PutUint64(card[logger.REC_LSN_OFF:], r.Action.Lsn)
+		copy(card[logger.REC_ACTION_OFF:], r.Action.GetRaw())
+		card[logger.REC_COMMIT_OFF] = byte(r.Flag)
+		val := append([]byte(nil), r.Value...)
+		if r.At != 0 { clear(val) }
+		crc := crc32.Update(crc32.Checksum(card[:logger.REC_CRC_OFF], crcs), crcs, val)
+		binary.LittleEndian.PutUint32(card[logger.REC_CRC_OFF:], crc)
+		segs[r.Segment] = append(append(segs[r.Segment], card...), val...)
+		return true
+	})
+	if err != nil || len(segs) == 0 { t.Fatalf("Failed to walk the log: %v", err) }
+	for seg, data := range segs {
+		if err := os.WriteFile(logger.SegmentPath(dest, seg), data, 0644); err != nil { t.Fatalf("Failed to write segment: %v", err) }
+	}
+}
+
+func Test_PageChecksum(t *testing.T) {
+	const COUNT = 2000
+	uid := testUid
+
+	db := openTest(t, "checksum.db", Options{})
+	insertRange(t, db, "checksumvalue", 0, COUNT)
+	// everything is on disk and recovery has nothing to redo
+	if err := db.Checkpoint(); err != nil { t.Fatalf("Failed to checkpoint: %v", err) }
+
+	// flip a byte in the body of every leaf
+	buff := make([]byte, pages.DEFAULT_PAGE_SIZE)
+	leaves := make(map[uint64]bool)
+	for id := uint64(1); id < db.Max; id++ {
+		p, err := pages.LoadPage(db.Store, id, buff)
+		if err != nil { t.Fatalf("Failed to load page %d: %v", id, err) }
+		if p.GetType() == pages.IDX_LEAF { leaves[id] = true }
+	}
+	if len(leaves) == 0 { t.Fatalf("No leaf on disk") }
+	b := make([]byte, 1)
+	for leaf := range leaves {
+		off := int64(leaf) * int64(pages.DEFAULT_PAGE_SIZE) + int64(pages.DEFAULT_PAGE_SIZE) / 2
+		if _, err := db.Store.ReadAt(b, off); err != nil { t.Fatalf("Failed to read page: %v", err) }
+		b[0] ^= 0xFF
+		if _, err := db.Store.WriteAt(b, off); err != nil { t.Fatalf("Failed to write page: %v", err) }
+	}
+
+	var corrupt *pages.CorruptPageError
+	for leaf := range leaves {
+		_, err := pages.LoadPage(db.Store, leaf, buff)
+		if !errors.As(err, &corrupt) { t.Fatalf("Corrupt page loaded, err %v", err) }
+		if corrupt.Id != leaf || corrupt.Type != pages.IDX_LEAF {
+			t.Fatalf("Corruption reported for page %d %s, expected %d IDX_LEAF", corrupt.Id, corrupt.Type, leaf)
+		}
+	}
+
+	// the index runs into it as well
+	crash(db)
+	db = new(Database)
+	if err := db.Start("checksum.db"); err != nil { t.Fatalf("Failed to start database: %v", err) }
+	defer db.Close()
+	found := false
+	for i := range COUNT {
+		hash := testHash("checksumvalue", i)
+		_, _, err := db.GetFile(uid, hash)
+		if err == nil { continue }
+		if !errors.As(err, &corrupt) || !leaves[corrupt.Id] { t.Fatalf("Unexpected error: %v #%d", err, i) }
+		found = true
+	}
+	if !found { t.Fatalf("No read hit a corrupt leaf") }
+}
+
+// Page 0 carries a superblock and a copy of itself, files that are not
+// ours or too new are refused and the layout before it is upgraded
+func Test_Superblock(t *testing.T) {
+	const COUNT = 200
+
+	db := openTest(t, "super.db", Options{})
+	insertRange(t, db, "supervalue", 0, COUNT)
+	if err := db.Checkpoint(); err != nil { t.Fatalf("Failed to checkpoint: %v", err) }
+	if db.Version != FORMAT_VERSION || db.Mirror != 1 { t.Fatalf("Superblock %+v", db.Superblock) }
+	// goes around the lock like any other process could
+	file, err := prims.OS{}.Open("super.db", os.O_RDWR)
+	if err != nil { t.Fatalf("Failed to open file: %v", err) }
+	defer file.Close()
+	page := func(id uint64) []byte {
+		buff := make([]byte, pages.DEFAULT_PAGE_SIZE)
+		if err := pages.ReadPage(file, id, buff); err != nil { t.Fatalf("Failed to read page %d: %v", id, err) }
+		return buff
+	}
+	write := func(id uint64, buff []byte) {
+		pages.SetChecksum(buff)
+		if _, err := file.WriteAt(buff, int64(id) * int64(pages.DEFAULT_PAGE_SIZE)); err != nil { t.Fatalf("Failed to write page: %v", err) }
+	}
+
+	// a torn page 0 comes back from its copy
+	torn := page(0)
+	for i := pages.DEFAULT_PAGE_SIZE / 2; i < pages.DEFAULT_PAGE_SIZE; i++ { torn[i] ^= 0xFF }
+	if _, err := file.WriteAt(torn, 0); err != nil { t.Fatalf("Failed to write page: %v", err) }
+	crash(db)
+	db = new(Database)
+	if err := db.Start("super.db"); err != nil { t.Fatalf("Failed to start from the copy: %v", err) }
+	page(0)
+	checkRange(t, db, "supervalue", 0, COUNT)
+
+	// a newer format is refused
+	newer := page(0)
+	sb := newer[len(newer) - SUPERBLOCK_SIZE:]
+	binary.LittleEndian.PutUint32(sb[VERSION_OFF:], FORMAT_VERSION + 1)
+	binary.LittleEndian.PutUint64(sb[GENERATION_OFF:], db.Generation + 1)
+	old := page(0)
+	write(0, newer)
+	crash(db)
+	if err := new(Database).Start("super.db"); !errors.Is(err, ErrNewerFormat) { t.Fatalf("Newer file opened, err %v", err) }
+
+	// so is the layout before the superblock, its page 0 had a checksum and no type
+	prior := bytes.Clone(old)
+	clear(prior[len(prior) - SUPERBLOCK_SIZE:])
+	prior[pages.PAGETYPE_OFF] = byte(pages.NONE_PAGE)
+	write(0, prior)
+	if err := new(Database).Start("super.db"); !errors.Is(err, ErrOldFormat) { t.Fatalf("File from before the superblock opened, err %v", err) }
+	write(0, old)
+	db = new(Database)
+	if err := db.Start("super.db"); err != nil { t.Fatalf("Failed to start database: %v", err) }
+	defer db.Close()
+	checkRange(t, db, "supervalue", 0, COUNT)
+
+	// and the baseline, 1500 inserts made by the build at b931d53. It never
+	// wrote page 0, only the pages its cache let go of
+	removeDb("baseline.db")
+	defer removeDb("baseline.db")
+	gz, err := os.Open("testdata/baseline.db.gz")
+	if err != nil { t.Fatalf("Failed to open fixture: %v", err) }
+	defer gz.Close()
+	zr, err := gzip.NewReader(gz)
+	if err != nil { t.Fatalf("Failed to read fixture: %v", err) }
+	baseline, err := io.ReadAll(zr)
+	if err != nil { t.Fatalf("Failed to read fixture: %v", err) }
+	if err := os.WriteFile("baseline.db", baseline, 0644); err != nil { t.Fatalf("Failed to write file: %v", err) }
+	if err := new(Database).Start("baseline.db"); !errors.Is(err, ErrOldFormat) { t.Fatalf("Baseline file opened, err %v", err) }
+	if _, err := Inspect("baseline.db", Options{}); !errors.Is(err, ErrOldFormat) { t.Fatalf("Baseline file inspected, err %v", err) }
+	if after, err := os.ReadFile("baseline.db"); err != nil || !bytes.Equal(after, baseline) { t.Fatalf("Baseline file changed, err %v", err) }
+
+	// and anything else is not a database
+	removeDb("foreign.db")
+	defer removeDb("foreign.db")
+	foreign := make([]byte, pages.DEFAULT_PAGE_SIZE * 2)
+	copy(foreign, "#!/bin/sh\necho not a database\n")
+	if err := os.WriteFile("foreign.db", foreign, 0644); err != nil { t.Fatalf("Failed to write file: %v", err) }
+	if err := new(Database).Start("foreign.db"); !errors.Is(err, ErrNotDatabase) { t.Fatalf("Foreign file opened, err %v", err) }
+}
+
+// Settings reach the tables, bad ones are refused
+func Test_Options(t *testing.T) {
+	const COUNT = 2000
+
+	bad := []Options{
+		{CacheSize: 10},
+		{CacheSize: 100, CacheMin: 100},
+		{Durability: types.Durability{Mode: 9}},
+		{Durability: types.Durability{Mode: types.GROUP_COMMIT, Window: -time.Second}},
+		{Compress: true, PageSize: 4096},
+	}
+	for _, opts := range bad {
+		if _, err := Open("options.db", opts); err == nil { t.Fatalf("Opened with %+v", opts) }
+	}
+
+	opts := Options{ CacheSize: 64, GrowthStep: 10, LogThreshold: 64 * 1024, BasePath: "blobs" }
+	db := openTest(t, "options.db", opts)
+	defer db.Close()
+	if got := db.fileTable.Options; got.BasePath != "blobs/" || got.CacheMin != 25 || got.SweepInterval == 0 {
+		t.Fatalf("Table runs with %+v", got)
+	}
+	insertRange(t, db, "optionsvalue", 0, COUNT)
+	checkRange(t, db, "optionsvalue", 0, COUNT)
+
+	// page 0 and then steps of 10
+	if db.Max % 10 != 1 { t.Fatalf("File grew to %d pages", db.Max) }
+	if db.GetCheckpoint() == 0 || db.fileTable.Logger.ByteCount > 2 * opts.LogThreshold {
+		t.Fatalf("No checkpoint with %d bytes of log", db.fileTable.Logger.ByteCount)
+	}
+}
+
+// A new file takes the page size it is opened with and keeps it
+func Test_PageSize(t *testing.T) {
+	const COUNT = 3000
+	defer removeDb("pagesize.db")
+
+	if _, err := Open("pagesize.db", Options{PageSize: 12 * 1024}); err == nil { t.Fatalf("Opened with 12K pages") }
+	for _, size := range []int{8192, 16384, 32768} {
+		removeDb("pagesize.db")
+		db, err := Open("pagesize.db", Options{PageSize: size})
+		if err != nil { t.Fatalf("Failed to open with %d byte pages: %v", size, err) }
+		insertRange(t, db, "pagesizevalue", 0, COUNT)
+		if err := db.Checkpoint(); err != nil { t.Fatalf("Failed to checkpoint: %v", err) }
+		fileSize, err := db.Store.Size()
+		if err != nil || fileSize % int64(size) != 0 { t.Fatalf("File is %d bytes with %d byte pages", fileSize, size) }
+
+		// the file knows its size, asking for another one is refused
+		crash(db)
+		if _, err := Open("pagesize.db", Options{PageSize: 4096}); err == nil { t.Fatalf("Opened %d byte pages as 4K", size) }
+		db, err = Open("pagesize.db", Options{})
+		if err != nil { t.Fatalf("Failed to reopen with %d byte pages: %v", size, err) }
+		if db.GetPageSize() != uint16(size) { t.Fatalf("Reopened with %d byte pages, want %d", db.GetPageSize(), size) }
+		checkRange(t, db, "pagesizevalue", 0, COUNT)
+		db.Close()
+	}
+}
+
+func Test_MemoryVolume(t *testing.T) {
+	const COUNT = 2000
+	uid := testUid
+	vol := prims.NewMemVolume()
+
+	// crash: the files stay in the volume, the database is never closed
+	db, err := Open("memory.db", Options{Volume: vol})
+	if err != nil { t.Fatalf("Failed to open database: %v", err) }
+	insertRange(t, db, "recovervalue", 0, COUNT)
+	for i := 0; i < COUNT; i += 3 {
+		hash := testHash("recovervalue", i)
+		if err := db.DeleteFile(uid, hash); err != nil { t.Fatalf("Failed to DELETE file: %v #%d", err, i) }
+	}
+	if _, err := os.Stat("memory.db"); !os.IsNotExist(err) { t.Fatalf("Database reached the disk") }
+
+	db, err = Open("memory.db", Options{Volume: vol})
+	if err != nil { t.Fatalf("Failed to recover database: %v", err) }
+	defer db.Close()
+	checkRecovered(t, db, uid, COUNT)
+}
+
+func Test_InMemory(t *testing.T) {
+	const COUNT = 2000
+	uid := testUid
+
+	db := new(Database)
+	if err := db.Start(MEMORY); err != nil { t.Fatalf("Failed to start database: %v", err) }
+	defer db.Close()
+	other := new(Database)
+	if err := other.Start(MEMORY); err != nil { t.Fatalf("Failed to start database: %v", err) }
+	defer other.Close()
+
+	insertRange(t, db, "recovervalue", 0, COUNT)
+	for i := 0; i < COUNT; i += 3 {
+		hash := testHash("recovervalue", i)
+		if err := db.DeleteFile(uid, hash); err != nil { t.Fatalf("Failed to DELETE file: %v #%d", err, i) }
+	}
+	if err := db.Checkpoint(); err != nil { t.Fatalf("Failed to checkpoint: %v", err) }
+	checkRecovered(t, db, uid, COUNT)
+
+	// each database has its own memory and nothing reaches the disk
+	hash := testHash("recovervalue", 1)
+	if _, _, err := other.GetFile(uid, hash); err == nil { t.Fatalf("Found a file from another database") }
+	if _, err := os.Stat(MEMORY); !os.IsNotExist(err) { t.Fatalf("Database reached the disk") }
+}
+
+// What returned before the crash is there, the one it cut off may be
+func checkCrashed(t *testing.T, db *Database, uid string, count, inserted, deleted int, what string) {
+	for i := range count {
+		hash := testHash("recovervalue", i)
+		_, _, err := db.GetFile(uid, hash)
+		gone := i % 3 == 0 && i / 3 < deleted
+		switch {
+			case i < inserted && !gone && err != nil:
+				t.Fatalf("Lost file #%d in %s: %v", i, what, err)
+			case (gone || i > inserted) && err == nil:
+				t.Fatalf("File #%d came back in %s", i, what)
+		}
+	}
+}
+
+// Runs inserts and deletes until the storage fails.
+// Returns how far each got, the one that failed may or may not have happened
+func crashWorkload(db *Database, uid string, count int) (int, int) {
+	inserted, deleted := 0, 0
+	for ; inserted < count; inserted++ {
+		hash := testHash("recovervalue", inserted)
+		if db.InsertFile(uid, int64(1024+inserted), fileT.Jpeg, hash, int64(1633036800-inserted)) != nil { return inserted, deleted }
+		if inserted == count / 2 && db.Checkpoint() != nil { return inserted + 1, deleted }
+	}
+	for ; deleted * 3 < count; deleted++ {
+		hash := testHash("recovervalue", deleted * 3)
+		if db.DeleteFile(uid, hash) != nil { return inserted, deleted }
+	}
+	return inserted, deleted
+}
+
+// Waits for the goroutines to get back down to before
+func settled(t *testing.T, before int, what string) {
+	t.Helper()
+	for try := 0; runtime.NumGoroutine() > before; try++ {
+		if try == 100 { t.Fatalf("%d goroutines left running after %s, %d before", runtime.NumGoroutine(), what, before) }
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_Crash(t *testing.T) {
+	const COUNT = 80
+	uid := testUid
+	opts := func(vol prims.Volume) Options {
+		return Options{ Volume: vol, CacheSize: 64, GrowthStep: 10, LogThreshold: 32 * 1024 }
+	}
+
+	// how many writes a run takes without a crash
+	vol := prims.NewFaultVolume(prims.Faults{})
+	db, err := Open("crash.db", opts(vol))
+	if err != nil { t.Fatalf("Failed to open database: %v", err) }
+	crashWorkload(db, uid, COUNT)
+	db.Close()
+	writes := vol.Writes()
+
+	for at := 1; at <= writes; at++ {
+		faults := prims.Faults{ CrashAt: at, Seed: int64(at), KeepUnsynced: at % 2 == 0, Tear: at % 3 == 0 }
+		vol := prims.NewFaultVolume(faults)
+		db, err := Open("crash.db", opts(vol))
+		inserted, deleted := 0, 0
+		if err == nil {
+			inserted, deleted = crashWorkload(db, uid, COUNT)
+			db.Close()
+		}
+		if !vol.Crashed() { t.Fatalf("Never crashed at write %d", at) }
+
+		db, err = Open("crash.db", opts(vol.Restart(prims.Faults{})))
+		if err != nil { t.Fatalf("Failed to recover from a crash at write %d %+v: %v", at, faults, err) }
+		checkCrashed(t, db, uid, COUNT, inserted, deleted, fmt.Sprintf("a crash at write %d %+v", at, faults))
+		if err := db.Checkpoint(); err != nil { t.Fatalf("Failed to checkpoint after a crash at write %d: %v", at, err) }
+		db.Close()
+	}
+}
+
+func Test_IOErrors(t *testing.T) {
+	const COUNT = 80
+	uid := testUid
+	opts := func(vol prims.Volume) Options {
+		return Options{ Volume: vol, CacheSize: 64, GrowthStep: 10, LogThreshold: 32 * 1024 }
+	}
+
+	// a failed write is an error for whoever it was for, a checkpoint
+	// tries again later. The crash after it is recovered, a close
+	// the disk is gone for still stops everything it started
+	baseline := runtime.NumGoroutine()
+	for at := 1; at <= 300; at += 7 {
+		faults := prims.Faults{ FailAt: at }
+		vol := prims.NewFaultVolume(faults)
+		db, err := Open("eio.db", opts(vol))
+		inserted, deleted := 0, 0
+		if err == nil {
+			inserted, deleted = crashWorkload(db, uid, COUNT)
+			vol.Crash()
+			if db.Close() == nil { t.Fatalf("Closed without a disk after failed write %d", at) }
+		}
+		settled(t, baseline, fmt.Sprintf("failed write %d", at))
+
+		db, err = Open("eio.db", opts(vol.Restart(prims.Faults{})))
+		if err != nil { t.Fatalf("Failed to recover from failed write %d: %v", at, err) }
+		checkCrashed(t, db, uid, COUNT, inserted, deleted, fmt.Sprintf("failed write %d", at))
+		db.Close()
+	}
+
+	// pages that cant be read are errors, not wrong answers
+	vol := prims.NewFaultVolume(prims.Faults{})
+	db, err := Open("eio.db", opts(vol))
+	if err != nil { t.Fatalf("Failed to open database: %v", err) }
+	crashWorkload(db, uid, COUNT)
+	db.Close()
+	vol = vol.Restart(prims.Faults{})
+	db, err = Open("eio.db", opts(vol))
+	if err != nil { t.Fatalf("Failed to reopen database: %v", err) }
+	defer db.Close()
+	vol.FailRange("eio.db", 2 * int64(db.PageSize), int64(db.Max) * int64(db.PageSize))
+	failed := 0
+	for i := range COUNT {
+		hash := testHash("recovervalue", i)
+		if h, _, err := db.GetFile(uid, hash); err != nil {
+			failed++
+		} else if h.Id != hex.EncodeToString(hash[:16]) { t.Fatalf("Invalid id gotten #%d", i) }
+	}
+	if failed == 0 { t.Fatalf("Every read of a bad page went through") }
+}
+
+func Test_RecoveryFails(t *testing.T) {
+	const COUNT = 1000
+	uid := testUid
+	opts := func(vol prims.Volume) Options {
+		return Options{ Volume: vol, CacheSize: 64, GrowthStep: 10, LogThreshold: 32 * 1024 }
+	}
+	vol := prims.NewFaultVolume(prims.Faults{})
+	db, err := Open("fails.db", opts(vol))
+	if err != nil { t.Fatalf("Failed to open database: %v", err) }
+	crashWorkload(db, uid, COUNT)
+	vol = vol.Restart(prims.Faults{})
+
+	// a page the log has to replay into cant be read,
+	// past what finding the meta page reads
+	in, err := Inspect("fails.db", opts(vol))
+	if err != nil { t.Fatalf("Failed to inspect: %v", err) }
+	meta, err := in.Page(0)
+	if err != nil { t.Fatalf("Failed to dump the meta page: %v", err) }
+	records, err := in.Log(meta.Meta.CheckpointLsn + 1, 0, 0)
+	if err != nil { t.Fatalf("Failed to read the log: %v", err) }
+	in.Close()
+	var bad *RecordDump
+	for _, r := range records {
+		if r.Page != nil && *r.Page * uint64(meta.Meta.PageSize) >= uint64(pages.MAX_PAGE_SIZE) && r.Length > 0 {
+			bad = r
+			break
+		}
+	}
+	if bad == nil { t.Fatalf("Nothing to replay") }
+	// the table it started is stopped again
+	fails := func(what string) {
+		t.Helper()
+		before := runtime.NumGoroutine()
+		_, err = Open("fails.db", opts(vol))
+		if !errors.Is(err, syscall.EIO) { t.Fatalf("Recovered past %s it cant read, err %v", what, err) }
+		settled(t, before, "recovery past "+what)
+	}
+	vol.FailRange("fails.db", int64(*bad.Page) * int64(meta.Meta.PageSize), int64(meta.Meta.PageSize))
+	fails("a page")
+
+	// nor past the value of a record, the segment it is in is never cut short
+	vol = vol.Restart(prims.Faults{})
+	segment := logger.SegmentPath(logger.LogDir("fails.db"), bad.Segment)
+	vol.FailRange(segment, int64(bad.Offset + logger.TRX_SIZE), int64(bad.Length))
+	fails("a record")
+	vol = vol.Restart(prims.Faults{})
+	db, err = Open("fails.db", opts(vol))
+	if err != nil { t.Fatalf("Failed to recover once the log reads: %v", err) }
+	defer db.Close()
+	checkRecovered(t, db, uid, COUNT)
+}
+
+func Test_ReadOnly(t *testing.T) {
+	const COUNT = 200
+	uid := testUid
+
+	if _, err := Open("readonly.db", Options{ReadOnly: true}); err == nil { t.Fatalf("Opened a missing file read only") }
+	db := openTest(t, "readonly.db", Options{})
+	insertRange(t, db, "recovervalue", 0, COUNT)
+
+	// a writer keeps other writers out, not readers. One sees what
+	// was committed, from the log and from the file once it is checkpointed
+	if _, err := Open("readonly.db", Options{}); !errors.Is(err, ErrInUse) { t.Fatalf("Opened twice, err %v", err) }
+	for range 2 {
+		reader, err := Open("readonly.db", Options{ReadOnly: true})
+		if err != nil { t.Fatalf("Failed to read a file being written: %v", err) }
+		checkRange(t, reader, "recovervalue", 0, COUNT)
+		if err := reader.Close(); err != nil { t.Fatalf("Failed to close reader: %v", err) }
+		if err := db.Checkpoint(); err != nil { t.Fatalf("Failed to checkpoint: %v", err) }
+	}
+	hash := testHash("recovervalue", 0)
+	if err := db.DeleteFile(uid, hash); err != nil { t.Fatalf("Failed to delete file: %v", err) }
+	insertRange(t, db, "recovervalue", 0, 1)
+
+	// a log the file is behind on needs a writer to recover it
+	crash(db)
+	if _, err := Open("readonly.db", Options{ReadOnly: true}); !errors.Is(err, logger.ErrNeedsRecovery) { t.Fatalf("Read a file that needs recovery, err %v", err) }
+	db, err := Open("readonly.db", Options{})
+	if err != nil { t.Fatalf("Failed to recover database: %v", err) }
+	if err := db.Close(); err != nil { t.Fatalf("Failed to close database: %v", err) }
+	before, err := os.ReadFile("readonly.db")
+	if err != nil { t.Fatalf("Failed to read file: %v", err) }
+
+	// readers share it with each other and change nothing
+	readers := make([]*Database, 2)
+	for i := range readers {
+		readers[i], err = Open("readonly.db", Options{ReadOnly: true})
+		if err != nil { t.Fatalf("Failed to open read only: %v", err) }
+		checkRange(t, readers[i], "recovervalue", 0, COUNT)
+	}
+	if err := readers[0].InsertFile(uid, 1024, fileT.Jpeg, hash, 1633036800); !errors.Is(err, ErrReadOnly) { t.Fatalf("Inserted read only, err %v", err) }
+	if err := readers[0].DeleteFile(uid, hash); !errors.Is(err, ErrReadOnly) { t.Fatalf("Deleted read only, err %v", err) }
+	if err := readers[0].Close(); err != nil { t.Fatalf("Failed to close reader: %v", err) }
+	after, err := os.ReadFile("readonly.db")
+	if err != nil { t.Fatalf("Failed to read file: %v", err) }
+	if !bytes.Equal(before, after) { t.Fatalf("Readers changed the file") }
+
+	// and a writer comes in while one is still reading
+	db, err = Open("readonly.db", Options{})
+	if err != nil { t.Fatalf("Failed to open next to a reader: %v", err) }
+	defer db.Close()
+	checkRange(t, db, "recovervalue", 0, COUNT)
+	checkRange(t, readers[1], "recovervalue", 0, COUNT)
+	if err := readers[1].Close(); err != nil { t.Fatalf("Failed to close reader: %v", err) }
+}
+
+func Test_Close(t *testing.T) {
+	const COUNT = 200
+	uid := testUid
+
+	baseline := runtime.NumGoroutine()
+	db := openTest(t, "close.db", Options{})
+	insertRange(t, db, "recovervalue", 0, COUNT / 2)
+	// writers racing the close either get in or are turned away
+	done := make(chan error, COUNT / 2)
+	for i := COUNT / 2; i < COUNT; i++ {
+		go func() { done <- db.InsertFile(uid, int64(1024+i), fileT.Jpeg, testHash("recovervalue", i), int64(1633036800-i)) }()
+	}
+	if err := db.Close(); err != nil { t.Fatalf("Failed to close database: %v", err) }
+	for range COUNT / 2 {
+		if err := <-done; err != nil && !errors.Is(err, ErrClosed) { t.Fatalf("Insert during close, err %v", err) }
+	}
+	if err := db.Close(); err != nil { t.Fatalf("Second close failed: %v", err) }
+	if err := db.InsertFile(uid, 1024, fileT.Jpeg, testHash("recovervalue", 0), 1633036800); !errors.Is(err, ErrClosed) { t.Fatalf("Inserted after close, err %v", err) }
+	if _, _, err := db.GetFile(uid, [32]byte{}); !errors.Is(err, ErrClosed) { t.Fatalf("Read after close, err %v", err) }
+	if err := db.Checkpoint(); !errors.Is(err, ErrClosed) { t.Fatalf("Checkpointed after close, err %v", err) }
+	settled(t, baseline, "close")
+
+	// nothing left for recovery, a reader would refuse otherwise
+	db, err := Open("close.db", Options{ReadOnly: true})
+	if err != nil { t.Fatalf("Failed to open read only after close: %v", err) }
+	checkRange(t, db, "recovervalue", 0, COUNT / 2)
+	if err := db.Close(); err != nil { t.Fatalf("Failed to close reader: %v", err) }
+
+	db, err = Open("close.db", Options{})
+	if err != nil { t.Fatalf("Failed to reopen database: %v", err) }
+	closed := db.CloseOnSignal(syscall.SIGUSR1)
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	select {
+		case err := <-closed: if err != nil { t.Fatalf("Close on signal failed: %v", err) }
+		case <-time.After(10 * time.Second): t.Fatalf("Signal did not close the database")
+	}
+	if err := db.InsertFile(uid, 1024, fileT.Jpeg, testHash("recovervalue", 0), 1633036800); !errors.Is(err, ErrClosed) { t.Fatalf("Inserted after signal, err %v", err) }
+	if err := <-db.CloseOnSignal(syscall.SIGUSR1); !errors.Is(err, ErrClosed) { t.Fatalf("Waited on a closed database, err %v", err) }
+}
+
+// Holds a backup up until the writers got in
+type slowWriter struct {
+	w 		io.Writer
+	ready 	func() bool
+}
+
+func (s slowWriter) Write(p []byte) (int, error) {
+	for !s.ready() { time.Sleep(time.Millisecond) }
+	return s.w.Write(p)
+}
+
+func Test_Backup(t *testing.T) {
+	const COUNT = 2000
+	uid := testUid
+	removeDb("backup.db")
+	removeDb("restore.db")
+	defer removeDb("backup.db")
+	defer removeDb("restore.db")
+
+	// a small cache so pages are written out while they are being copied
+	db, err := Open("backup.db", Options{ CacheSize: 64, GrowthStep: 10, Durability: types.Durability{ Mode: types.NO_SYNC } })
+	if err != nil { t.Fatalf("Failed to open database: %v", err) }
+	defer db.Close()
+	insertRange(t, db, "recovervalue", 0, COUNT / 2)
+
+	// the first half is deleted and the second inserted during the copy
+	var pairs atomic.Int32
+	stop, done := make(chan struct{}), make(chan error, 1)
+	go func() {
+		for i := COUNT / 2; i < COUNT; i++ {
+			select {
+				case <-stop: done <- nil; return
+				default:
+			}
+			if err := db.InsertFile(uid, int64(1024+i), fileT.Jpeg, testHash("recovervalue", i), int64(1633036800-i)); err != nil { done <- err; return }
+			if err := db.DeleteFile(uid, testHash("recovervalue", i - COUNT / 2)); err != nil { done <- err; return }
+			// they wait for the backup
+			if pairs.Add(1) % 10 == 0 { db.Checkpoint() }
+		}
+		done <- nil
+	}()
+	for pairs.Load() < 10 { time.Sleep(time.Millisecond) }
+	var buff bytes.Buffer
+	// what is done before the copy starts has to be in it
+	before := int(pairs.Load()) + 20
+	_, err = db.Backup(slowWriter{ &buff, func() bool { return int(pairs.Load()) >= before } })
+	after := int(pairs.Load()) + 1 // one may have been on its way
+	close(stop)
+	if err != nil { t.Fatalf("Failed to back up: %v", err) }
+	if err := <-done; err != nil { t.Fatalf("Failed a write during the backup: %v", err) }
+	backup := buff.Bytes()
+
+	if _, err := Restore(bytes.NewReader(backup), "backup.db", Options{}); !errors.Is(err, ErrExists) { t.Fatalf("Restored over a database, err %v", err) }
+	if _, err := Restore(bytes.NewReader([]byte("not a backup")), "restore.db", Options{}); err == nil { t.Fatalf("Restored garbage") }
+	removeDb("restore.db")
+	restored, err := Restore(bytes.NewReader(backup), "restore.db", Options{})
+	if err != nil { t.Fatalf("Failed to restore: %v", err) }
+	defer restored.Close()
+
+	// the copy holds every write up to some point during it and none after,
+	// one insert may still be waiting for its delete
+	deleted, both := 0, 0
+	for i := range COUNT / 2 {
+		_, _, oldErr := restored.GetFile(uid, testHash("recovervalue", i))
+		_, _, newErr := restored.GetFile(uid, testHash("recovervalue", i + COUNT / 2))
+		if oldErr != nil && newErr != nil { t.Fatalf("Neither of #%d restored", i) }
+		if oldErr == nil && newErr == nil { both++ }
+		if oldErr != nil {
+			if deleted != i { t.Fatalf("Restored a delete out of order #%d", i) }
+			deleted++
+		}
+	}
+	if both > 1 { t.Fatalf("Restored %d inserts without their delete", both) }
+	if deleted < before || deleted > after { t.Fatalf("Restored %d deletes, %d to %d were done", deleted, before, after) }
+	// and takes writes like any other
+	insertRange(t, restored, "recovervalue", COUNT, COUNT + 100)
+	checkRange(t, restored, "recovervalue", COUNT, COUNT + 100)
+}
+
+// A backup that holds the log up for too long is given up on
+func Test_BackupLogLimit(t *testing.T) {
+	const COUNT = 3000
+	uid := testUid
+	removeDb("backuplimit.db")
+	removeDb("backuplimit_restore.db")
+	defer removeDb("backuplimit.db")
+	defer removeDb("backuplimit_restore.db")
+
+	opts := Options{ CacheSize: 64, GrowthStep: 10, LogThreshold: 32 * 1024, BackupLogLimit: 128 * 1024, Durability: types.Durability{ Mode: types.NO_SYNC } }
+	db, err := Open("backuplimit.db", opts)
+	if err != nil { t.Fatalf("Failed to open database: %v", err) }
+	defer db.Close()
+	insertRange(t, db, "limitvalue", 0, COUNT / 3)
+
+	// the copy waits until the writes made checkpoints go on without it
+	var inserted atomic.Int32
+	started, done := make(chan uint64, 1), make(chan error, 1)
+	go func(started chan uint64) {
+		redo := <-started
+		for i := COUNT / 3; i < COUNT; i++ {
+			if err := db.InsertFile(uid, int64(1024+i), fileT.Jpeg, testHash("limitvalue", i), int64(1633036800-i)); err != nil { done <- err; return }
+			inserted.Add(1)
+			if db.GetCheckpoint() != redo { break }
+		}
+		done <- nil
+	}(started)
+	var buff bytes.Buffer
+	_, err = db.Backup(slowWriter{ &buff, func() bool {
+		if started != nil { started <- db.GetCheckpoint() }
+		started = nil
+		return len(done) > 0
+	} })
+	if err := <-done; err != nil { t.Fatalf("Failed a write during the backup: %v", err) }
+	if !errors.Is(err, ErrBackupTooLong) { t.Fatalf("Backup held the log through %d inserts, err %v", inserted.Load(), err) }
+	if l := db.fileTable.Logger.ByteCount; l > 2 * opts.BackupLogLimit { t.Fatalf("Log grew to %d bytes during the backup", l) }
+
+	// the next one has the log to itself again
+	buff.Reset()
+	if _, err := db.Backup(&buff); err != nil { t.Fatalf("Failed to back up: %v", err) }
+	restored, err := Restore(bytes.NewReader(buff.Bytes()), "backuplimit_restore.db", Options{})
+	if err != nil { t.Fatalf("Failed to restore: %v", err) }
+	defer restored.Close()
+	checkRange(t, restored, "limitvalue", 0, COUNT / 3 + int(inserted.Load()))
+}
+
+func Test_IncrementalBackup(t *testing.T) {
+	const COUNT = 3000
+	uid := testUid
+	for _, path := range []string{"incr.db", "incr_restore.db", "incr_broken.db"} {
+		removeDb(path)
+		defer removeDb(path)
+	}
+	db, err := Open("incr.db", Options{ CacheSize: 64, Durability: types.Durability{ Mode: types.NO_SYNC } })
+	if err != nil { t.Fatalf("Failed to open database: %v", err) }
+	defer db.Close()
+	insertRange(t, db, "recovervalue", 0, COUNT)
+	var full, first, second bytes.Buffer
+	fullInfo, err := db.Backup(&full)
+	if err != nil { t.Fatalf("Failed to back up: %v", err) }
+
+	// a few changes only take a few pages
+	insertRange(t, db, "recovervalue", COUNT, COUNT + 20)
+	for i := range 20 {
+		if err := db.DeleteFile(uid, testHash("recovervalue", i)); err != nil { t.Fatalf("Failed to delete file: %v #%d", err, i) }
+	}
+	firstInfo, err := db.BackupSince(&first, fullInfo.Start)
+	if err != nil { t.Fatalf("Failed incremental backup: %v", err) }
+	// the log since the full one comes along whole, however far a segment got
+	if pages, data := backupBytes(first.Bytes(), BACKUP_PAGES), backupBytes(full.Bytes(), BACKUP_FILE); pages * 4 > data {
+		t.Fatalf("Incremental backup has %d bytes of pages, the full one %d", pages, data)
+	}
+	if info, err := ReadBackupInfo(bytes.NewReader(first.Bytes())); err != nil || info != firstInfo {
+		t.Fatalf("Read back %+v, err %v, backed up %+v", info, err, firstInfo)
+	}
+
+	// the second is taken while more go in, in order
+	var n atomic.Int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := COUNT + 20; i < COUNT + 200; i++ {
+			if err := db.InsertFile(uid, int64(1024+i), fileT.Jpeg, testHash("recovervalue", i), int64(1633036800-i)); err != nil { return }
+			n.Add(1)
+		}
+	}()
+	for n.Load() < 30 { time.Sleep(time.Millisecond) }
+	before := COUNT + 20 + int(n.Load())
+	_, err = db.BackupSince(&second, firstInfo.Start)
+	<-done
+	if err != nil { t.Fatalf("Failed incremental backup: %v", err) }
+
+	// out of order is refused
+	if _, err := Restore(bytes.NewReader(full.Bytes()), "incr_broken.db", Options{}, bytes.NewReader(second.Bytes())); !errors.Is(err, ErrBackupChain) {
+		t.Fatalf("Restored a broken chain, err %v", err)
+	}
+	restored, err := Restore(bytes.NewReader(full.Bytes()), "incr_restore.db", Options{}, bytes.NewReader(first.Bytes()), bytes.NewReader(second.Bytes()))
+	if err != nil { t.Fatalf("Failed to restore: %v", err) }
+	defer restored.Close()
+	missing := false
+	for i := range COUNT + 200 {
+		_, _, err := restored.GetFile(uid, testHash("recovervalue", i))
+		switch {
+			case i < 20:
+				if err == nil { t.Fatalf("Deleted file restored #%d", i) }
+			case i < before:
+				if err != nil { t.Fatalf("Failed to GET restored file: %v #%d", err, i) }
+			case err != nil:
+				missing = true
+			case missing:
+				t.Fatalf("Restored a file inserted after one that is missing #%d", i)
+		}
+	}
+}
+
+// How much of backup b went to the entries named with prefix
+func backupBytes(b []byte, prefix string) int64 {
+	n := int64(0)
+	tr := tar.NewReader(bytes.NewReader(b))
+	for hdr, err := tr.Next(); err == nil; hdr, err = tr.Next() {
+		if strings.HasPrefix(hdr.Name, prefix) { n += hdr.Size }
+	}
+	return n
+}
+
+func Test_PointInTime(t *testing.T) {
+	const COUNT = 1000
+	uid := testUid
+	for _, path := range []string{"pitr.db", "pitr_restore.db", "pitr_early.db", "pitr_untimed.db", "pitr_lsn.db"} {
+		removeDb(path)
+		defer removeDb(path)
+	}
+	os.RemoveAll("pitr.archive")
+	defer os.RemoveAll("pitr.archive")
+	defer os.RemoveAll("pitr.untimed")
+	defer func(size uint32) { logger.SegmentSize = size }(logger.SegmentSize)
+	logger.SegmentSize = 64 * 1024
+
+	// checkpoints often enough to send segments to the archive
+	db, err := Open("pitr.db", Options{ Archive: "pitr.archive", LogThreshold: 128 * 1024, Durability: types.Durability{ Mode: types.NO_SYNC } })
+	if err != nil { t.Fatalf("Failed to open database: %v", err) }
+	defer db.Close()
+	insertRange(t, db, "recovervalue", 0, COUNT / 2)
+	var full bytes.Buffer
+	info, err := db.Backup(&full)
+	if err != nil { t.Fatalf("Failed to back up: %v", err) }
+	insertRange(t, db, "recovervalue", COUNT / 2, COUNT)
+	inserted := db.fileTable.Logger.Lsn
+	time.Sleep(2 * time.Millisecond)
+	before := time.Now()
+	time.Sleep(2 * time.Millisecond)
+
+	// the bulk delete that should not have happened
+	for i := range COUNT {
+		if err := db.DeleteFile(uid, testHash("recovervalue", i)); err != nil { t.Fatalf("Failed to delete file: %v #%d", err, i) }
+	}
+	if err := db.Checkpoint(); err != nil { t.Fatalf("Failed to checkpoint: %v", err) }
+	if _, err := os.Stat(logger.SegmentPath("pitr.archive", 1)); err != nil { t.Fatalf("Nothing archived: %v", err) }
+	if _, err := os.Stat(logger.SegmentPath("pitr.archive", 1) + logger.ARCHIVE_TEMP); !os.IsNotExist(err) { t.Fatalf("Copy left behind in the archive: %v", err) }
+
+	logs := []string{ "pitr.archive", logger.LogDir("pitr.db") }
+	if _, err := RestoreTo(PointInTime{ Lsn: info.Lsn - 1, Logs: logs }, bytes.NewReader(full.Bytes()), "pitr_early.db", Options{}); !errors.Is(err, ErrTooEarly) {
+		t.Fatalf("Restored to before the backup, err %v", err)
+	}
+	restored, err := RestoreTo(PointInTime{ Time: before, Logs: logs }, bytes.NewReader(full.Bytes()), "pitr_restore.db", Options{})
+	if err != nil { t.Fatalf("Failed to restore: %v", err) }
+	checkRange(t, restored, "recovervalue", 0, COUNT)
+
+	// a log without commit times cant be held against the time, only an lsn
+	untimedLog(t, "pitr.untimed", logs...)
+	untimed := []string{ "pitr.untimed" }
+	if _, err := RestoreTo(PointInTime{ Time: before, Logs: untimed }, bytes.NewReader(full.Bytes()), "pitr_untimed.db", Options{}); !errors.Is(err, ErrUntimed) {
+		t.Fatalf("Restored past commits without a time, err %v", err)
+	}
+	byLsn, err := RestoreTo(PointInTime{ Time: before, Lsn: inserted, Logs: untimed }, bytes.NewReader(full.Bytes()), "pitr_lsn.db", Options{})
+	if err != nil { t.Fatalf("Failed to restore to an lsn: %v", err) }
+	checkRange(t, byLsn, "recovervalue", 0, COUNT)
+	if err := byLsn.Close(); err != nil { t.Fatalf("Failed to close restore: %v", err) }
+
+	// it goes on from there, the deletes stay gone
+	insertRange(t, restored, "recovervalue", COUNT, COUNT + 10)
+	if err := restored.Close(); err != nil { t.Fatalf("Failed to close restore: %v", err) }
+	restored, err = Open("pitr_restore.db", Options{})
+	if err != nil { t.Fatalf("Failed to reopen restore: %v", err) }
+	defer restored.Close()
+	checkRange(t, restored, "recovervalue", 0, COUNT + 10)
+}
+
+func Test_Encryption(t *testing.T) {
+	const COUNT = 300
+	for _, path := range []string{"enc.db", "enc_plain.db", "enc_restore.db"} {
+		removeDb(path)
+		defer removeDb(path)
+	}
+	key := prims.StaticKey(bytes.Repeat([]byte{7}, 32))
+	fill := func(path string, opts Options, from, to int) {
+		db, err := Open(path, opts)
+		if err != nil { t.Fatalf("Failed to open %s: %v", path, err) }
+		insertRange(t, db, "recovervalue", from, to)
+		if err := db.Close(); err != nil { t.Fatalf("Failed to close %s: %v", path, err) }
+	}
+	// whether a row shows in the file or its log
+	leaks := func(path string) bool {
+		hash := testHash("recovervalue", COUNT / 2)
+		paths, _ := filepath.Glob(logger.LogDir(path) + "/*")
+		for _, p := range append(paths, path) {
+			data, err := os.ReadFile(p)
+			if err != nil { t.Fatalf("Failed to read %s: %v", p, err) }
+			if bytes.Contains(data, hash[:16]) { return true }
+		}
+		return false
+	}
+
+	fill("enc_plain.db", Options{}, 0, COUNT)
+	if !leaks("enc_plain.db") { t.Fatalf("Row not found in a plain file, the check proves nothing") }
+	fill("enc.db", Options{ Keys: key }, 0, COUNT)
+	if leaks("enc.db") { t.Fatalf("Row found in the encrypted file") }
+
+	// no key or the wrong one is refused, and the file is left alone
+	before, _ := os.ReadFile("enc.db")
+	if _, err := Open("enc.db", Options{}); err == nil { t.Fatalf("Opened an encrypted file without a key") }
+	if _, err := Open("enc.db", Options{ Keys: prims.StaticKey(bytes.Repeat([]byte{8}, 32)) }); err == nil { t.Fatalf("Opened with the wrong key") }
+	if _, err := Open("enc_plain.db", Options{ Keys: key }); err == nil { t.Fatalf("Opened a plain file as encrypted") }
+	if after, _ := os.ReadFile("enc.db"); !bytes.Equal(before, after) { t.Fatalf("Failed opens changed the file") }
+
+	// after a rotation new blocks are sealed with the new key, the old ones still read
+	ring := prims.NewKeyRing()
+	ring.Add(1, key)
+	ring.Rotate(bytes.Repeat([]byte{9}, 32))
+	fill("enc.db", Options{ Keys: ring }, COUNT, 2 * COUNT)
+	data, _ := os.ReadFile("enc.db")
+	ids := map[uint32]int{}
+	for off := prims.FILE_HEADER_SIZE; off + prims.SEALED_SIZE <= len(data); off += prims.SEALED_SIZE {
+		ids[binary.LittleEndian.Uint32(data[off+prims.BLOCK_KEY_OFF:])]++
+	}
+	if ids[1] == 0 || ids[2] == 0 { t.Fatalf("Blocks by key %v, want some of both", ids) }
+	db, err := Open("enc.db", Options{ Keys: ring })
+	if err != nil { t.Fatalf("Failed to reopen after a rotation: %v", err) }
+	checkRange(t, db, "recovervalue", 0, 2 * COUNT)
+
+	// a restore comes out encrypted with the keys it is given
+	var backup bytes.Buffer
+	if _, err := db.Backup(&backup); err != nil { t.Fatalf("Failed to back up: %v", err) }
+	db.Close()
+	restored, err := Restore(&backup, "enc_restore.db", Options{ Keys: ring })
+	if err != nil { t.Fatalf("Failed to restore: %v", err) }
+	checkRange(t, restored, "recovervalue", 0, 2 * COUNT)
+	restored.Close()
+	if leaks("enc_restore.db") { t.Fatalf("Row found in the restored file") }
+
+	// torn blocks are put back from the log, or skipped in it
+	crashEvery(t, 3, "an encrypted", func(vol prims.Volume) Options {
+		return Options{ Volume: vol, Keys: key, CacheSize: 64, GrowthStep: 10, LogThreshold: 32 * 1024 }
+	})
+}
+
+// Crashes a run of crashWorkload at every step-th write, tearing the write
+// it happened in, and checks what it recovers to
+func crashEvery(t *testing.T, step int, what string, opts func(vol prims.Volume) Options) {
+	const COUNT = 80
+	uid := testUid
+	vol := prims.NewFaultVolume(prims.Faults{})
+	db, err := Open("crash.db", opts(vol))
+	if err != nil { t.Fatalf("Failed to open database: %v", err) }
+	crashWorkload(db, uid, COUNT)
+	db.Close()
+	writes := vol.Writes()
+	for at := 1; at <= writes; at += step {
+		faults := prims.Faults{ CrashAt: at, Seed: int64(at), KeepUnsynced: at % 2 == 0, Tear: true }
+		vol := prims.NewFaultVolume(faults)
+		db, err := Open("crash.db", opts(vol))
+		inserted, deleted := 0, 0
+		if err == nil {
+			inserted, deleted = crashWorkload(db, uid, COUNT)
+			db.Close()
+		}
+		db, err = Open("crash.db", opts(vol.Restart(prims.Faults{})))
+		if err != nil { t.Fatalf("Failed to recover from %s crash at write %d %+v: %v", what, at, faults, err) }
+		checkCrashed(t, db, uid, COUNT, inserted, deleted, fmt.Sprintf("%s crash at write %d %+v", what, at, faults))
+		db.Close()
+	}
+}
+
+func Test_Compression(t *testing.T) {
+	const COUNT = 3000
+	for _, path := range []string{"zip.db", "zip_plain.db"} {
+		removeDb(path)
+		defer removeDb(path)
+	}
+	// reads every file back, returns the features the file was opened with
+	reopen := func(path string, opts Options) uint32 {
+		db, err := Open(path, opts)
+		if err != nil { t.Fatalf("Failed to reopen %s: %v", path, err) }
+		defer db.Close()
+		checkRange(t, db, "recovervalue", 0, COUNT)
+		return db.Features
+	}
+	// the disk the file takes and the log written before the checkpoint on close
+	fill := func(path string, opts Options) (int64, int64) {
+		db, err := Open(path, opts)
+		if err != nil { t.Fatalf("Failed to open %s: %v", path, err) }
+		insertRange(t, db, "recovervalue", 0, COUNT)
+		if err := db.Checkpoint(); err != nil { t.Fatalf("Failed to checkpoint: %v", err) }
+		var logged int64
+		segs, _ := filepath.Glob(logger.LogDir(path) + "/*")
+		for _, seg := range segs {
+			if info, err := os.Stat(seg); err == nil { logged += info.Size() }
+		}
+		if err := db.Close(); err != nil { t.Fatalf("Failed to close %s: %v", path, err) }
+		var st syscall.Stat_t
+		if err := syscall.Stat(path, &st); err != nil { t.Fatalf("Failed to stat %s: %v", path, err) }
+		return st.Blocks * 512, logged
+	}
+	opts := Options{ PageSize: 32768, LogThreshold: 1 << 30, Durability: types.Durability{ Mode: types.NO_SYNC } }
+	plainDisk, plainLog := fill("zip_plain.db", opts)
+	opts.Compress = true
+	disk, logged := fill("zip.db", opts)
+	if disk * 5 > plainDisk * 4 { t.Fatalf("Compressed file takes %d bytes of disk, plain %d", disk, plainDisk) }
+	if logged * 10 > plainLog * 9 { t.Fatalf("Compressed log is %d bytes, plain %d", logged, plainLog) }
+
+	// either way reads both, only the compressed one is flagged
+	if reopen("zip.db", Options{}) != FEATURE_COMPRESSED { t.Fatalf("Compressed file isnt flagged") }
+	if reopen("zip_plain.db", Options{ Compress: true }) != 0 { t.Fatalf("Plain file is flagged") }
+
+	// the flag is on disk before the first compressed image, not at the next checkpoint
+	vol := prims.NewFaultVolume(prims.Faults{})
+	db, err := Open("zip.db", Options{ Volume: vol, Compress: true, PageSize: 16384 })
+	if err != nil { t.Fatalf("Failed to open: %v", err) }
+	insertRange(t, db, "recovervalue", 0, 1)
+	if db.fileTable.Logger.Lsn == 0 || db.Features != FEATURE_COMPRESSED { t.Fatalf("Logged an image with features %x", db.Features) }
+	vol.Crash()
+	db, err = Open("zip.db", Options{ Volume: vol.Restart(prims.Faults{}) })
+	if err != nil { t.Fatalf("Failed to recover: %v", err) }
+	if db.Features != FEATURE_COMPRESSED { t.Fatalf("Flag didnt make it through a crash") }
+	db.Close()
+
+	// a torn compressed page is put back from its image in the log
+	crashEvery(t, 3, "a compressed", func(vol prims.Volume) Options {
+		return Options{ Volume: vol, Compress: true, PageSize: 16384, CacheSize: 64, GrowthStep: 10, LogThreshold: 32 * 1024 }
+	})
+}
+
+func Test_Check(t *testing.T) {
+	const COUNT = 2000
+	uid := testUid
+
+	db := openTest(t, "check.db", Options{ Durability: types.Durability{ Mode: types.NO_SYNC } })
+	insertRange(t, db, "checkvalue", 0, COUNT)
+	for i := 0; i < COUNT; i += 3 {
+		if err := db.DeleteFile(uid, testHash("checkvalue", i)); err != nil { t.Fatalf("Failed to delete file: %v #%d", err, i) }
+	}
+	if err := db.Close(); err != nil { t.Fatalf("Failed to close: %v", err) }
+	report, err := Check("check.db", Options{})
+	if err != nil { t.Fatalf("Failed to check: %v", err) }
+	if !report.Ok() { t.Fatalf("Healthy file has problems: %v", report.Violations) }
+	if report.Reached != int(report.Used) + 1 { t.Fatalf("Reached %d pages of %d", report.Reached, report.Used + 1) }
+
+	// next to a writer it sees what the writer committed
+	db, err = Open("check.db", Options{})
+	if err != nil { t.Fatalf("Failed to reopen: %v", err) }
+	insertRange(t, db, "checkvalue", COUNT, COUNT + 200)
+	report, err = Check("check.db", Options{})
+	if err != nil { t.Fatalf("Failed to check next to a writer: %v", err) }
+	if !report.Ok() { t.Fatalf("File being written has problems: %v", report.Violations) }
+	if report.Used != db.Total { t.Fatalf("Checked %d pages in use, the writer has %d", report.Used, db.Total) }
+
+	// a file that needs recovery only as it is
+	crash(db)
+	if _, err := Check("check.db", Options{}); !errors.Is(err, logger.ErrNeedsRecovery) { t.Fatalf("Checked a file that needs recovery, err %v", err) }
+	report, err = CheckAsIs("check.db", Options{})
+	if err != nil { t.Fatalf("Failed to check as is: %v", err) }
+	if p := report.Pending; p.From == 0 || p.To < p.From { t.Fatalf("Pending lsns %d to %d", p.From, p.To) }
+
+	// break a sibling link and free a slot a row is in
+	db, err = Open("check.db", Options{})
+	if err != nil { t.Fatalf("Failed to reopen: %v", err) }
+	defer db.Close()
+	buff := make([]byte, db.PageSize)
+	var leaf, data uint64
+	for id := uint64(1); id <= db.Total && (leaf == 0 || data == 0); id++ {
+		if err := pages.ReadPage(db.Store, id, buff); err != nil { t.Fatalf("Failed to read page %d: %v", id, err) }
+		switch pages.PageType(buff[pages.PAGETYPE_OFF]) {
+			case pages.IDX_LEAF:
+				if leaf != 0 || binary.LittleEndian.Uint64(buff[indexes.NEXT_OFFSET:]) == 0 { continue }
+				leaf = id
+				binary.LittleEndian.PutUint64(buff[indexes.NEXT_OFFSET:], id)
+			case pages.FILE_FIXED:
+				if data != 0 || buff[pages.PAGE_HEADER_LENGTH] & 0x02 == 0 { continue }
+				data = id
+				buff[pages.PAGE_HEADER_LENGTH] &^= 0x02
+			default: continue
+		}
+		if err := pages.WritePage(db.Store, id, buff); err != nil { t.Fatalf("Failed to write page %d: %v", id, err) }
+	}
+	if leaf == 0 || data == 0 { t.Fatalf("No leaf or data page to break") }
+	report, err = db.check()
+	if err != nil { t.Fatalf("Failed to check: %v", err) }
+	found := map[uint64]bool{}
+	for _, v := range report.Violations { found[v.Page] = true }
+	if !found[leaf] || !found[data] { t.Fatalf("Broken pages %d and %d not reported: %v", leaf, data, report.Violations) }
+}
+
+func Test_Inspect(t *testing.T) {
+	const COUNT = 1000
+
+	db := openTest(t, "inspect.db", Options{ Durability: types.Durability{ Mode: types.NO_SYNC } })
+	insertRange(t, db, "inspectvalue", 0, COUNT)
+	if err := db.Checkpoint(); err != nil { t.Fatalf("Failed to checkpoint: %v", err) }
+	insertRange(t, db, "inspectvalue", COUNT, COUNT + 10)
+	// looked at before recovery, read only opens refuse it
+	crash(db)
+	if _, err := Open("inspect.db", Options{ ReadOnly: true }); !errors.Is(err, logger.ErrNeedsRecovery) { t.Fatalf("Read only open of a crashed file: %v", err) }
+	in, err := Inspect("inspect.db", Options{})
+	if err != nil { t.Fatalf("Failed to inspect: %v", err) }
+	defer in.Close()
+
+	meta, err := in.Page(0)
+	if err != nil || meta.Meta == nil { t.Fatalf("Failed to dump the meta page: %v", err) }
+	tree, err := in.Tree(pages.FID_IDX)
+	if err != nil { t.Fatalf("Failed to dump the tree: %v", err) }
+	if tree.Root != meta.Meta.Roots["FID_IDX"] || len(tree.Levels) == 0 { t.Fatalf("Tree from root %d with %d levels, meta page has %d", tree.Root, len(tree.Levels), meta.Meta.Roots["FID_IDX"]) }
+
+	// every row the leaves point at is taken in its bitmap
+	entries := 0
+	for _, leaf := range tree.Levels[len(tree.Levels)-1] {
+		if leaf.Item == nil || !leaf.Item.Leaf { t.Fatalf("Page %d on the last level is a %s", leaf.Id, leaf.Type) }
+		for _, e := range leaf.Item.Entries {
+			entries++
+			data, err := in.Page(e.Page)
+			if err != nil || data.Slots == nil { t.Fatalf("Row on page %d that has no slots: %v", e.Page, err) }
+			if data.Slots.Bitmap[*e.Slot] != '1' { t.Fatalf("Row in free slot %d of page %d", *e.Slot, e.Page) }
+		}
+	}
+	// what came after the checkpoint is only in the log
+	if entries != COUNT { t.Fatalf("Leaves hold %d entries, want %d", entries, COUNT) }
+
+	records, err := in.Log(0, 0, 0)
+	if err != nil { t.Fatalf("Failed to read the log: %v", err) }
+	commits := 0
+	for i, r := range records {
+		if i > 0 && r.Lsn != records[i-1].Lsn + 1 { t.Fatalf("Record %d has lsn %d after %d", i, r.Lsn, records[i-1].Lsn) }
+		if r.Flag == types.TxnCommit.String() { commits++ }
+	}
+	// the checkpoint let go of the log before it
+	if commits < 10 { t.Fatalf("Log has %d commits, want at least 10", commits) }
+	from := records[2].Lsn
+	if records, _ = in.Log(from, 5, 0); len(records) != 5 || records[0].Lsn != from { t.Fatalf("Log from %d gave %d records", from, len(records)) }
+}
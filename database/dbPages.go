@@ -1,42 +1,22 @@
 package database
 
 import (
-	"encoding/binary"
 	"errors"
 	"log"
-	"syscall"
 	"mydb/core/pages"
-	"mydb/core/prims"
-	"mydb/core/types"
 )
 
-func (d *Database) NewFreePage(p types.PageLike) error {
-	d.lock.Lock()
-	defer d.lock.Unlock()
-
-	pageId := p.GetId()
+// Puts the page on the free list, it is handed out again before the file grows.
+// Nothing is written until the next checkpoint, a crash before that
+// gets the page back from the log, from the FREEPAGE record of a committed
+// transaction or the NEWPAGE of a cancelled one
+func (d *Database) NewFreePage(pageId uint64) error {
 	if d.DBHeader == nil { return errors.New("Header not initialized") }
 	if pageId == 0 { return errors.New("Invalid page ID") }
 
-	newPageOffset := int64(pageId) * int64(pages.PAGE_SIZE)
-
-	// ZERO PAGE
-	zeroBuff := make([]byte, pages.PAGE_SIZE)
-	_, err := prims.Write(d.Fd, zeroBuff, newPageOffset)
-	if err != nil { return nil }
-
-	// UPDATE FREE LIST
-	if d.Last != 0 {
-		lastOffset := int64(d.Last * uint64(pages.PAGE_SIZE))
-		buff := make([]byte, 8)
-		binary.LittleEndian.PutUint64(buff, pageId)
-
-		_, err = prims.Write(d.Fd, buff, lastOffset + pages.NEXT_OFF)
-		if err != nil { return err }
-
-	}
-	d.Last = pageId
-
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.push(pageId)
 	return nil
 }
 
@@ -46,37 +26,60 @@ func (d*Database) ClaimFreePage(pageType pages.PageType) (uint64, error) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
-	var fPId uint64
-	var err error
-	// Store the free list pointer
-	if d.Next == 0 {
-		if d.Max == 0 || d.Total >= d.Max-1 {
-			// No free pages available
-			err = d.AllocateNewPages()
-			if err != nil { return 0, err }
-		}
-		d.Total++
+	if id, ok := d.pop(); ok { return id, nil }
 
-		fPId = d.Total
+	if d.Max == 0 || d.Total >= d.Max-1 {
+		// No free pages available
+		err := d.AllocateNewPages()
+		if err != nil { return 0, err }
 	}
+	d.Total++
+	return d.Total, nil
+}
 
-	// Update the free list pointer to the next page
-	d.Next = pages.ReadNext(d.Fd, fPId)
-
-	return fPId, err
+// Recovery found the page in use, it must not be claimed again
+func (d *Database) MarkClaimed(pageId uint64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.isFree[pageId] { d.remove(pageId) }
+	if pageId > d.Total { d.Total = pageId }
+	if d.Max <= d.Total { d.Max = d.Total + 1 }
 }
 
 func (d *Database) AllocateNewPages() (error){
 	if d.DBHeader == nil { return errors.New("No header in database") }
-	// Allocate a new page
-	d.Max += 100
+	// Allocate a new page, a file that failed to grow stays as it was
+	grown := d.Max + d.Options.GrowthStep
 
-	err := syscall.Ftruncate(d.Fd, int64(d.Max * uint64(pages.PAGE_SIZE)))
+	err := d.Store.Truncate(int64(grown * uint64(d.PageSize)))
 	if err != nil {
 		log.Printf("Error truncating file to new page size: %v", err)
 		return errors.New("Syscall error in allocate new page")
 	}
+	d.Max = grown
 	return nil
 }
 
+func (d *Database) GetCheckpoint() uint64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.CheckpointLsn
+}
 
+// Writes the free list out and puts the header in the meta page,
+// the caller syncs before it writes the meta page
+func (d *Database) SetCheckpoint(lsn uint64) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.writeFreeList(); err != nil { return err }
+	d.DBHeader.CheckpointLsn = lsn
+	d.DBHeader.ToBytes(d.metaPage.Body[:HEADER_SIZE])
+	return nil
+}
+
+// Pages on the free list, trunks included
+func (d *Database) FreePages() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return len(d.free)
+}
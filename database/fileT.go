@@ -16,8 +16,8 @@ func (d *Database) GetFile(uid string, hash [32]byte,
 		},
 		Output: make(chan any, 1),
 	}
-	d.fileTableIn <- msg
-	result := <- msg.Output
+	result, err := d.send(msg)
+	if err != nil { return nil, nil, err }
 	if res, ok := result.(*fileT.GetFileOut); ok {
 		return res.Header, res.Blobc, res.Error
 	}
@@ -28,6 +28,7 @@ func (d *Database) InsertFile(
 	uid string, size int64, fileType int8, 
 	Hash [32]byte, Time int64,
 ) error {
+	if d.Options.ReadOnly { return ErrReadOnly }
 	msg := &types.DbMessage{
 		Code: types.INSERT_FILE,
 		Msg: &fileT.InsertFileMsg{
@@ -39,8 +40,8 @@ func (d *Database) InsertFile(
 		},
 		Output: make(chan any, 1),
 	}
-	d.fileTableIn <- msg
-	result := <- msg.Output
+	result, err := d.send(msg)
+	if err != nil { return err }
 	if res, ok := result.(*fileT.InsertFileOut); ok {
 		return res.Error
 	}
@@ -48,6 +49,7 @@ func (d *Database) InsertFile(
 }
 
 func (d *Database) DeleteFile(uid string, hash [32]byte) error {
+	if d.Options.ReadOnly { return ErrReadOnly }
 	msg := &types.DbMessage{
 		Code: types.DELETE_FILE,
 		Msg: &fileT.GetFileMsg{
@@ -56,8 +58,8 @@ func (d *Database) DeleteFile(uid string, hash [32]byte) error {
 		},
 		Output: make(chan any, 1),
 	}
-	d.fileTableIn <- msg
-	result := <- msg.Output
+	result, err := d.send(msg)
+	if err != nil { return err }
 	if res, ok := result.(*fileT.InsertFileOut); ok {
 		return res.Error
 	}
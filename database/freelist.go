@@ -0,0 +1,101 @@
+package database
+
+import (
+	"encoding/binary"
+	"slices"
+	"mydb/core/pages"
+)
+
+// The free list is a stack kept in memory, every checkpoint writes it out
+// into trunk pages taken from the free pages themselves.
+// A trunk is a FREE_PAGE, Next points at the following trunk and the body holds
+//	0	count	uint32
+//	8	ids		uint64 * count
+// Trunks sit at the bottom of the stack so they are claimed last, by then every
+// id written on them is in use. On load a trunk that was overwritten since
+// ends the chain, recovery then drops whatever the log shows in use.
+const (
+	TRUNK_COUNT_OFF = 0
+	TRUNK_IDS_OFF   = 8
+)
+
+// ids a trunk holds
+func (d *Database) trunkCap() int {
+	return (int(d.PageSize) - int(pages.PAGE_HEADER_LENGTH) - TRUNK_IDS_OFF) / 8
+}
+
+func (h *DBHeader) push(id uint64) {
+	if h.isFree[id] { return }
+	h.isFree[id] = true
+	h.free = append(h.free, id)
+}
+
+func (h *DBHeader) pop() (uint64, bool) {
+	if len(h.free) == 0 { return 0, false }
+	id := h.free[len(h.free)-1]
+	h.free = h.free[:len(h.free)-1]
+	delete(h.isFree, id)
+	return id, true
+}
+
+// keeps the order so the trunks stay at the bottom
+func (h *DBHeader) remove(id uint64) {
+	delete(h.isFree, id)
+	if i := slices.Index(h.free, id); i >= 0 { h.free = slices.Delete(h.free, i, i+1) }
+}
+
+// Reads the trunk chain the header points at
+func (d *Database) readFreeList() error {
+	buff := make([]byte, d.PageSize)
+	trunks, ids := []uint64{}, []uint64{}
+	for id := d.FreeTrunk; id != 0 && id < d.Max; {
+		if uint64(len(trunks) + len(ids)) >= d.FreeCount { break }
+		if err := pages.ReadPage(d.Store, id, buff); err != nil {
+			if _, ok := err.(*pages.CorruptPageError); ok { break }
+			return err
+		}
+		page := &pages.Page{}
+		page.FromBytes(buff)
+		if page.GetType() != pages.FREE_PAGE || slices.Contains(trunks, id) { break }
+
+		trunks = append(trunks, id)
+		n := int(binary.LittleEndian.Uint32(page.Body[TRUNK_COUNT_OFF:]))
+		if n > d.trunkCap() { break }
+		for i := range n {
+			ids = append(ids, binary.LittleEndian.Uint64(page.Body[TRUNK_IDS_OFF + i*8:]))
+		}
+		id = page.Next
+	}
+
+	for _, id := range append(trunks, ids...) {
+		if id != 0 && id <= d.Total { d.push(id) }
+	}
+	d.FreeCount = uint64(len(d.free))
+	return nil
+}
+
+// Only free pages are written so a crash half way through harms nothing,
+// the header still points at the old chain until the meta page is written
+func (d *Database) writeFreeList() error {
+	n, per := len(d.free), d.trunkCap()
+	trunks := (n + per) / (per + 1)
+	ids := d.free[trunks:]
+
+	buff := make([]byte, d.PageSize)
+	for i := range trunks {
+		page := pages.NewPage(d.Store, d.free[i], pages.FREE_PAGE, buff)
+		if i+1 < trunks { page.Next = d.free[i+1] }
+
+		chunk := ids[min(i*per, len(ids)):min((i+1)*per, len(ids))]
+		binary.LittleEndian.PutUint32(page.Body[TRUNK_COUNT_OFF:], uint32(len(chunk)))
+		for j, id := range chunk {
+			binary.LittleEndian.PutUint64(page.Body[TRUNK_IDS_OFF + j*8:], id)
+		}
+		if err := page.Flush(page.ToBytes()); err != nil { return err }
+	}
+
+	d.FreeTrunk = 0
+	if n > 0 { d.FreeTrunk = d.free[0] }
+	d.FreeCount = uint64(n)
+	return nil
+}
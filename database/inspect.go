@@ -0,0 +1,310 @@
+package database
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"mydb/core/fsm"
+	"mydb/core/indexes"
+	"mydb/core/logger"
+	"mydb/core/pages"
+	"mydb/core/types"
+)
+
+// Looks at a file page by page without starting it. The log isnt
+// replayed and nothing is written, so a file that needs recovery
+// can be looked at as it was left
+type Inspector struct {
+	d *Database
+}
+
+// What a page holds, only the parts its type has are set.
+// Keys and values are hex
+type PageDump struct {
+	Id 			uint64 `json:"id"`
+	Type 		string `json:"type"`
+	Compressed 	bool `json:"compressed,omitempty"`
+	Lsn 		uint64 `json:"lsn"`
+	Checksum 	uint32 `json:"checksum"`
+	Corrupt 	string `json:"corrupt,omitempty"` // why it didnt read back whole, the rest is what is there
+	Next 		uint64 `json:"next,omitempty"`
+	Prev 		uint64 `json:"prev,omitempty"`
+
+	Meta 		*MetaDump `json:"meta,omitempty"` // META_PAGE
+	Item 		*ItemDump `json:"item,omitempty"` // IDX_NODE and IDX_LEAF
+	Slots 		*SlotsDump `json:"slots,omitempty"` // FILE_FIXED
+	Free 		[]uint64 `json:"free,omitempty"` // FREE_PAGE, a trunk of the free list
+}
+
+type MetaDump struct {
+	Version 		uint32 `json:"version"`
+	PageSize 		uint32 `json:"pageSize"`
+	Features 		uint32 `json:"features"`
+	Mirror 			uint64 `json:"mirror"`
+	Generation 		uint64 `json:"generation"`
+
+	Total 			uint64 `json:"total"`
+	Max 			uint64 `json:"max"`
+	FreeTrunk 		uint64 `json:"freeTrunk"`
+	FreeCount 		uint64 `json:"freeCount"`
+	CheckpointLsn 	uint64 `json:"checkpointLsn"`
+
+	// where the log starts
+	LogSegment 		uint32 `json:"logSegment"`
+	LogOffset 		uint32 `json:"logOffset"`
+	LogLsn 			uint64 `json:"logLsn"`
+	LastTrx 		uint64 `json:"lastTrx"`
+	Roots 			map[string]uint64 `json:"roots"`
+}
+
+type ItemDump struct {
+	Leaf 		bool `json:"leaf"`
+	KeySize 	int `json:"keySize"`
+	EntrySize 	int `json:"entrySize"`
+	N 			int `json:"n"`
+	Dirty 		int `json:"dirty,omitempty"`
+	Next 		uint64 `json:"next,omitempty"`
+	Prev 		uint64 `json:"prev,omitempty"`
+	Keys 		[]string `json:"keys,omitempty"` // separators of a node
+	Children 	[]uint64 `json:"children,omitempty"`
+	Entries 	[]EntryDump `json:"entries,omitempty"` // of a leaf, deleted ones included
+}
+
+type EntryDump struct {
+	Key 	string `json:"key"`
+	Dirty 	bool `json:"dirty,omitempty"`
+	Page 	uint64 `json:"page"` // the row is on, or the free space map has room on
+	Slot 	*int `json:"slot,omitempty"` // of the row
+	Size 	*int `json:"size,omitempty"` // of the slots the free space map has room for
+	Free 	*int `json:"free,omitempty"` // slots it counts free
+}
+
+type SlotsDump struct {
+	Size 		int `json:"size"`
+	Capacity 	int `json:"capacity"`
+	Used 		int `json:"used"`
+	Bitmap 		string `json:"bitmap"` // a 1 for every slot taken, slot 0 first
+}
+
+type TreeDump struct {
+	Schema 	string `json:"schema"`
+	Root 	uint64 `json:"root"`
+	Levels 	[][]*PageDump `json:"levels"` // from the root down, left to right
+}
+
+type RecordDump struct {
+	Segment uint32 `json:"segment"`
+	Offset 	int `json:"offset"`
+	Lsn 	uint64 `json:"lsn"`
+	TrxId 	uint64 `json:"trx"`
+	Flag 	string `json:"flag"`
+	Op 		string `json:"op"`
+	VType 	string `json:"vtype"`
+	Dest 	int64 `json:"dest"`
+	Page 	*uint64 `json:"page,omitempty"` // the dest is on
+	Length 	int `json:"length"`
+	At 		int64 `json:"at,omitempty"` // when a commit was made, unix nanoseconds
+	Value 	string `json:"value,omitempty"`
+}
+
+// Opens path for looking at, opts tell how it is stored
+func Inspect(path string, opts Options) (*Inspector, error) {
+	opts.ReadOnly = true
+	opts, err := withDefaults(opts)
+	if err != nil { return nil, err }
+	d := &Database{ FilePath: path, Options: opts }
+	store, err := opts.Volume.Open(path, os.O_RDONLY)
+	if err != nil { return nil, errors.New("Failed to open database file: " + err.Error()) }
+	d.Store = store
+	defer func() {if err != nil { d.Close() }}()
+
+	if err = store.Lock(true); err != nil { return nil, err }
+	version, err := d.findMeta()
+	if err != nil { return nil, err }
+	if version < FORMAT_VERSION {
+		err = errors.New("Database has to be opened for writing once to create or upgrade it")
+		return nil, err
+	}
+	buff := make([]byte, d.PageSize)
+	d.metaPage, err = pages.LoadPage(store, 0, buff)
+	if err != nil { return nil, err }
+	d.DBHeader = DBHeaderFromBytes(d.metaPage.Body[:HEADER_SIZE])
+	size, err := store.Size()
+	if err != nil { return nil, err }
+	d.Max = uint64(size / int64(d.PageSize))
+	return &Inspector{ d }, nil
+}
+
+func (in *Inspector) Close() error { return in.d.Close() }
+
+// The schemas that have a tree, by name
+func TreeSchema(name string) (pages.PageType, bool) {
+	for _, t := range checkedTrees {
+		if t.schema.String() == name { return t.schema, true }
+	}
+	return 0, false
+}
+
+// Dumps page id as it is on disk, a page that fails its checksum
+// is dumped anyway with Corrupt set
+func (in *Inspector) Page(id uint64) (*PageDump, error) {
+	d := in.d
+	if id >= d.Max { return nil, fmt.Errorf("Page %d is past the end of the file, it has %d", id, d.Max) }
+	buff := make([]byte, d.PageSize)
+	err := pages.ReadPage(d.Store, id, buff)
+	if err != nil && !errors.As(err, new(*pages.CorruptPageError)) { return nil, err }
+	// reading it put it back together, the flag is on disk
+	raw := make([]byte, 1)
+	d.Store.ReadAt(raw, int64(id) * int64(d.PageSize))
+	dump := &PageDump{ Id: id, Compressed: raw[0] & pages.COMPRESSED != 0 }
+	if err != nil { dump.Corrupt = err.Error() }
+
+	t := pages.PageType(buff[pages.PAGETYPE_OFF])
+	dump.Type = t.String()
+	dump.Lsn = binary.LittleEndian.Uint64(buff[pages.LSN_OFF:])
+	dump.Checksum = binary.LittleEndian.Uint32(buff[pages.CHECKSUM_OFF:])
+	switch t {
+		case pages.IDX_NODE, pages.IDX_LEAF:
+			// the header of an index page goes on differently
+			dump.Item = item(buff)
+			return dump, nil
+	}
+	page := &pages.Page{}
+	page.FromBytes(buff)
+	dump.Next, dump.Prev = page.Next, page.Prev
+	switch t {
+		case pages.META_PAGE: dump.Meta = meta(page, buff)
+		case pages.FILE_FIXED: dump.Slots = slots(page)
+		case pages.FREE_PAGE:
+			n := min(int(binary.LittleEndian.Uint32(page.Body[TRUNK_COUNT_OFF:])), d.trunkCap())
+			dump.Free = make([]uint64, n)
+			for i := range n { dump.Free[i] = binary.LittleEndian.Uint64(page.Body[TRUNK_IDS_OFF + i*8:]) }
+	}
+	return dump, nil
+}
+
+func meta(page *pages.Page, buff []byte) *MetaDump {
+	m := &MetaDump{ Roots: make(map[string]uint64) }
+	if sb, ok := superblockOf(buff); ok {
+		s := SuperblockFromBytes(sb)
+		m.Version, m.PageSize, m.Features, m.Mirror, m.Generation = s.Version, s.PageSize, s.Features, s.Mirror, s.Generation
+	}
+	h := DBHeaderFromBytes(page.Body[:HEADER_SIZE])
+	m.Total, m.Max, m.FreeTrunk, m.FreeCount, m.CheckpointLsn = h.Total, h.Max, h.FreeTrunk, h.FreeCount, h.CheckpointLsn
+
+	state := page.Body[HEADER_SIZE:]
+	m.LogSegment = binary.LittleEndian.Uint32(state[logger.LOG_OLDEST_OFF:])
+	m.LogOffset = binary.LittleEndian.Uint32(state[logger.LOG_OLDEST_CUR_OFF:])
+	m.LogLsn = binary.LittleEndian.Uint64(state[logger.LOG_OLDEST_LSN_OFF:])
+	m.LastTrx = binary.LittleEndian.Uint64(state[logger.LOG_TRX_OFF:])
+	for _, t := range checkedTrees { m.Roots[t.schema.String()] = treeRoot(page, t.schema) }
+	return m
+}
+
+func item(buff []byte) *ItemDump {
+	it := &ItemDump{
+		Leaf: pages.PageType(buff[pages.PAGETYPE_OFF]) == pages.IDX_LEAF,
+		KeySize: int(binary.LittleEndian.Uint16(buff[indexes.KEY_SIZE_OFFSET:])),
+		EntrySize: int(binary.LittleEndian.Uint16(buff[indexes.ENTRY_SIZE_OFFSET:])),
+		N: int(binary.LittleEndian.Uint16(buff[indexes.N_OFFSET:])),
+	}
+	if it.KeySize == 0 { return it }
+	if !it.Leaf {
+		node := new(indexes.BTreeNode)
+		// a node that says it has more keys than fit is cut short
+		it.N = min(it.N, (len(buff) - indexes.BNODE_HEADER_LENGTH - indexes.CHILD_SIZE) / (it.KeySize + indexes.CHILD_SIZE))
+		binary.LittleEndian.PutUint16(buff[indexes.N_OFFSET:], uint16(it.N))
+		node.FromBytes(buff)
+		for _, key := range node.Keys { it.Keys = append(it.Keys, hex.EncodeToString(key)) }
+		it.Children = node.Children
+		return it
+	}
+	leaf := new(indexes.BTreeLeaf)
+	leaf.FromBytes(buff)
+	it.Dirty, it.Next, it.Prev = int(leaf.Dirty), leaf.Next, leaf.Prev
+	if it.EntrySize < it.KeySize + 8 { return it }
+	count := min(it.N + it.Dirty, len(leaf.Body) / it.EntrySize)
+	for i := range count {
+		entry := leaf.Body[i*it.EntrySize:(i+1)*it.EntrySize]
+		key, value := entry[:it.KeySize], entry[it.KeySize:]
+		e := EntryDump{ Key: hex.EncodeToString(key), Dirty: key[it.KeySize-1] == indexes.IS_DIRTY }
+		if it.KeySize == fsm.FSM_KEY_SIZE {
+			size, free := int(binary.LittleEndian.Uint16(key[fsm.SIZE_OFFSET:])), int(key[fsm.COUNT_OFFSET]) - 1
+			e.Page, e.Size, e.Free = binary.LittleEndian.Uint64(value), &size, &free
+		} else {
+			loc := value[len(value)-8:]
+			slot := int(loc[7])
+			e.Page, e.Slot = binary.LittleEndian.Uint64(append(loc[:7:7], 0)), &slot
+		}
+		it.Entries = append(it.Entries, e)
+	}
+	return it
+}
+
+func slots(page *pages.Page) *SlotsDump {
+	s := &SlotsDump{ Size: int(page.GetSlotSize()), Capacity: int(page.GetSlotCapacity()) }
+	bitmap := make([]byte, s.Capacity)
+	for i := range s.Capacity {
+		bitmap[i] = '0'
+		if page.Body[i/8] & (1 << (i%8)) != 0 {
+			bitmap[i] = '1'
+			s.Used++
+		}
+	}
+	s.Bitmap = string(bitmap)
+	return s
+}
+
+// Dumps the tree of schema a level at a time, pages that cant be
+// read or are reached again end the walk down from them
+func (in *Inspector) Tree(schema pages.PageType) (*TreeDump, error) {
+	tree := &TreeDump{ Schema: schema.String(), Root: treeRoot(in.d.metaPage, schema), Levels: [][]*PageDump{} }
+	if tree.Root == 0 { return tree, nil }
+	seen := map[uint64]bool{}
+	for level := []uint64{ tree.Root }; len(level) > 0; {
+		var next []uint64
+		dumps := make([]*PageDump, 0, len(level))
+		for _, id := range level {
+			if seen[id] || id >= in.d.Max { continue }
+			seen[id] = true
+			dump, err := in.Page(id)
+			if err != nil { return nil, err }
+			dumps = append(dumps, dump)
+			if dump.Item != nil && !dump.Item.Leaf { next = append(next, dump.Item.Children...) }
+		}
+		tree.Levels = append(tree.Levels, dumps)
+		level = next
+	}
+	return tree, nil
+}
+
+// Decodes the log from where the meta page says it starts, records
+// before lsn from are skipped and no more than limit are returned, 0 for all.
+// Values are cut to their first values bytes, all of them when it is below 0
+func (in *Inspector) Log(from uint64, limit, values int) ([]*RecordDump, error) {
+	d := in.d
+	state := d.metaPage.Body[HEADER_SIZE:]
+	seg := binary.LittleEndian.Uint32(state[logger.LOG_OLDEST_OFF:])
+	cursor := binary.LittleEndian.Uint32(state[logger.LOG_OLDEST_CUR_OFF:])
+	records := []*RecordDump{}
+	if seg == 0 { return records, nil } // no log yet
+	err := logger.WalkLog(d.Options.Volume, logger.LogDir(d.FilePath), seg, int(cursor), func(r *logger.LogRecord) bool {
+		if r.Action.Lsn < from { return true }
+		a := r.Action
+		rec := &RecordDump{
+			Segment: r.Segment, Offset: r.Offset, Lsn: a.Lsn, TrxId: r.TrxId,
+			Flag: r.Flag.String(), Op: a.GetOperation().String(), VType: types.DataType(a.GetVType()).String(),
+			Dest: a.GetDest(), Length: len(r.Value), At: r.At,
+		}
+		if page, ok := a.GetPageId(uint16(d.PageSize)); ok { rec.Page = &page }
+		value := r.Value
+		if values >= 0 { value = value[:min(len(value), values)] }
+		rec.Value = hex.EncodeToString(value)
+		records = append(records, rec)
+		return limit == 0 || len(records) < limit
+	})
+	if os.IsNotExist(err) { return records, nil }
+	return records, err
+}
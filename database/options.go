@@ -0,0 +1,71 @@
+package database
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"mydb/core/cache"
+	"mydb/core/logger"
+	"mydb/core/pages"
+	"mydb/core/prims"
+	"mydb/core/types"
+	"mydb/fileT"
+)
+
+type Options = types.Options
+
+const (
+	GROWTH_STEP      = 100 // pages, default
+	MIN_CACHE_SIZE   = 64  // a split with its parents has to fit with room to spare
+	MAX_CACHE_SIZE   = 1<<16 - 1
+	BACKUP_LOG_LIMIT = 4   // times the log threshold, default
+)
+
+// Fills in the defaults and refuses what cant work
+func withDefaults(o Options) (Options, error) {
+	// 0 takes the size of the file, or the default for a new one
+	if o.PageSize != 0 && !pages.ValidPageSize(o.PageSize) {
+		return o, errors.New("Page size has to be 4K, 8K, 16K or 32K")
+	}
+	// a 4K page cant give back a unit of the disk
+	if o.Compress && o.PageSize != 0 && o.PageSize <= pages.COMPRESS_UNIT {
+		return o, errors.New("Compression needs pages over 4K")
+	}
+	if o.CacheSize == 0 { o.CacheSize = cache.CACHE_SIZE }
+	if o.CacheSize < MIN_CACHE_SIZE || o.CacheSize > MAX_CACHE_SIZE {
+		return o, errors.New("Cache size has to be between 64 and 65535 pages")
+	}
+	if o.CacheMin == 0 { o.CacheMin = min(cache.CACHE_MIN, o.CacheSize / 2) }
+	if o.CacheMin < 0 || o.CacheMin >= o.CacheSize {
+		return o, errors.New("Cache minimum has to be below the cache size")
+	}
+	if o.SweepInterval == 0 { o.SweepInterval = cache.SWEEP_INTERVAL }
+	if o.LogThreshold == 0 { o.LogThreshold = logger.LogThreshold }
+	if o.BackupLogLimit == 0 { o.BackupLogLimit = uint32(min(uint64(o.LogThreshold) * BACKUP_LOG_LIMIT, math.MaxUint32)) }
+	if o.BackupLogLimit < o.LogThreshold {
+		return o, errors.New("Backup log limit cant be below the log threshold")
+	}
+	if o.GrowthStep == 0 { o.GrowthStep = GROWTH_STEP }
+
+	if o.Volume == nil { o.Volume = prims.OS{} }
+	if _, ok := o.Volume.(*prims.Encrypted); o.Keys != nil && !ok { o.Volume = prims.Encrypt(o.Volume, o.Keys) }
+
+	if o.BasePath == "" { o.BasePath = fileT.BASE_PATH }
+	if !strings.HasSuffix(o.BasePath, "/") { o.BasePath += "/" }
+
+	switch o.Durability.Mode {
+		case types.SYNC_COMMIT, types.GROUP_COMMIT, types.NO_SYNC:
+		default: return o, errors.New("Unknown durability mode")
+	}
+	if o.Durability.Window < 0 || o.Durability.GroupSize < 0 {
+		return o, errors.New("Group commit window and size cant be negative")
+	}
+	return o, nil
+}
+
+// Opens the database at path, creating it if there is none
+func Open(path string, opts Options) (*Database, error) {
+	d := &Database{ Options: opts }
+	if err := d.Start(path); err != nil { return nil, err }
+	return d, nil
+}
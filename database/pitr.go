@@ -0,0 +1,79 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+	"mydb/core/logger"
+)
+
+// Where a restore stops, the first commit past either is left out
+// along with everything after it. Commits logged before they had a time
+// cant be placed against Time, past the end of the backup they need an Lsn
+type PointInTime struct {
+	Lsn 	uint64 // 0 for no limit
+	Time 	time.Time // zero for no limit
+	// directories with more of the log than the backups have, the archive
+	// and the log of the database itself. The longest copy of a segment wins
+	Logs 	[]string
+}
+
+var (
+	ErrTooEarly = errors.New("Point in time is before the end of the backup")
+	ErrUntimed  = errors.New("Log has commits without a time, restore to an lsn instead")
+)
+
+// Restores like Restore, then replays the log on from where the backups end
+// up to the point in time. Whatever was committed after it is lost,
+// from then on the database goes its own way
+func RestoreTo(to PointInTime, r io.Reader, path string, opts Options, incrementals ...io.Reader) (*Database, error) {
+	return restore(&to, r, path, opts, incrementals)
+}
+
+// Puts the longest copy of every segment from the first one of the backup on
+// into the log, then cuts it at the point in time
+func (rs *restorer) cutAt(to PointInTime) error {
+	// the pages of the backup may already hold anything up to its end
+	if (to.Lsn != 0 && to.Lsn < rs.info.Lsn) || (!to.Time.IsZero() && to.Time.Before(rs.info.Time)) {
+		return fmt.Errorf("%w: it goes up to lsn %d at %v", ErrTooEarly, rs.info.Lsn, rs.info.Time)
+	}
+	first := rs.first
+	if first == 0 { first = 1 } // the backup had no log, whatever comes first
+	for seg := first; ; seg++ {
+		dest := logger.SegmentPath(rs.dir, seg)
+		best, size := "", int64(-1)
+		for _, path := range append([]string{dest}, segmentPaths(to.Logs, seg)...) {
+			st, err := rs.vol.Open(path, os.O_RDONLY)
+			if err != nil { continue }
+			n, err := st.Size()
+			st.Close()
+			if err == nil && n > size { best, size = path, n }
+		}
+		if best == "" { break }
+		if best == dest { continue }
+		st, err := rs.vol.Open(best, os.O_RDONLY)
+		if err != nil { return err }
+		err = restoreFile(rs.vol, dest, io.NewSectionReader(st, 0, size))
+		st.Close()
+		if err != nil { return err }
+	}
+
+	at := to.Time.UnixNano()
+	_, err := logger.CutLog(rs.vol, rs.dir, first, func(lsn uint64, t int64) (bool, error) {
+		if to.Lsn != 0 && lsn > to.Lsn { return false, nil }
+		if to.Time.IsZero() || t != 0 { return to.Time.IsZero() || t <= at, nil }
+		// the backup goes up to its time, an lsn says where to stop after
+		if lsn <= rs.info.Lsn || to.Lsn != 0 { return true, nil }
+		return false, fmt.Errorf("%w: lsn %d", ErrUntimed, lsn)
+	})
+	if os.IsNotExist(err) { return nil } // no log at all
+	return err
+}
+
+func segmentPaths(dirs []string, seg uint32) []string {
+	paths := make([]string, len(dirs))
+	for i, dir := range dirs { paths[i] = logger.SegmentPath(dir, seg) }
+	return paths
+}
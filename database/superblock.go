@@ -0,0 +1,269 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mydb/core/logger"
+	"mydb/core/pages"
+	"mydb/core/prims"
+)
+
+// SUPERBLOCK, the last bytes of the meta page, little endian.
+// It sits at the end so the offsets older files and their logs use stay put,
+// which leaves the page size to be found by trying each one.
+//	0	magic		[8]byte
+//	8	version		uint32	format of the file
+//	12	page size	uint32
+//	16	features	uint32	flags, a file with one this build doesnt know is refused,
+//						see FEATURE_COMPRESSED
+//	24	mirror		uint64	page holding the second copy of the meta page
+//	32	generation	uint64	bumped on every write, the newer copy wins
+const (
+	MAGIC_OFF      = 0
+	VERSION_OFF    = 8
+	PAGE_SIZE_OFF  = 12
+	FEATURES_OFF   = 16
+	MIRROR_OFF     = 24
+	GENERATION_OFF = 32
+
+	SUPERBLOCK_SIZE = 40
+
+	// 0 is the layout before the superblock, only a header at the start.
+	// 2 logs 8 byte transaction ids, see logger.REC_WIDE
+	FORMAT_VERSION uint32 = 2
+
+	// the file or its log has a compressed page or image in it,
+	// set before the first one is written
+	FEATURE_COMPRESSED uint32 = 1 << 0
+	KNOWN_FEATURES uint32 = FEATURE_COMPRESSED
+)
+
+var MAGIC = []byte("MYGODB\x00\x01")
+
+var (
+	ErrNotDatabase = errors.New("Not a My-Go-DB database file")
+	ErrNewerFormat = errors.New("Database file was written by a newer version")
+	// there is no migration from before the superblock, the data has to be
+	// read out with the build that wrote it and inserted again
+	ErrOldFormat = errors.New("Database file is from before format 1 and cant be opened")
+)
+
+type Superblock struct {
+	Version 	uint32
+	PageSize 	uint32
+	Features 	uint32
+	Mirror 		uint64
+	Generation 	uint64
+}
+
+// buff is the whole page
+func superblockOf(buff []byte) ([]byte, bool) {
+	sb := buff[len(buff) - SUPERBLOCK_SIZE:]
+	return sb, bytes.Equal(sb[MAGIC_OFF:MAGIC_OFF + 8], MAGIC)
+}
+
+func SuperblockFromBytes(sb []byte) Superblock {
+	return Superblock{
+		Version: binary.LittleEndian.Uint32(sb[VERSION_OFF:]),
+		PageSize: binary.LittleEndian.Uint32(sb[PAGE_SIZE_OFF:]),
+		Features: binary.LittleEndian.Uint32(sb[FEATURES_OFF:]),
+		Mirror: binary.LittleEndian.Uint64(sb[MIRROR_OFF:]),
+		Generation: binary.LittleEndian.Uint64(sb[GENERATION_OFF:]),
+	}
+}
+
+func (s *Superblock) ToBytes(sb []byte) {
+	copy(sb[MAGIC_OFF:], MAGIC)
+	binary.LittleEndian.PutUint32(sb[VERSION_OFF:], s.Version)
+	binary.LittleEndian.PutUint32(sb[PAGE_SIZE_OFF:], s.PageSize)
+	binary.LittleEndian.PutUint32(sb[FEATURES_OFF:], s.Features)
+	binary.LittleEndian.PutUint64(sb[MIRROR_OFF:], s.Mirror)
+	binary.LittleEndian.PutUint64(sb[GENERATION_OFF:], s.Generation)
+}
+
+// Refuses what this build cant read
+func (s *Superblock) check() error {
+	if s.Version > FORMAT_VERSION || s.Features & ^KNOWN_FEATURES != 0 {
+		return fmt.Errorf("%w: format %d features %x", ErrNewerFormat, s.Version, s.Features)
+	}
+	if !pages.ValidPageSize(int(s.PageSize)) {
+		return fmt.Errorf("Database page size %d isnt supported", s.PageSize)
+	}
+	return nil
+}
+
+// buff is as long as the page size the copy should have
+func readMirror(store prims.Storage, id uint64, buff []byte) (Superblock, bool) {
+	if id == 0 || pages.ReadPage(store, id, buff) != nil { return Superblock{}, false }
+	if pages.PageType(buff[pages.PAGETYPE_OFF]) != pages.META_PAGE { return Superblock{}, false }
+	sb, ok := superblockOf(buff)
+	if !ok { return Superblock{}, false }
+	m := SuperblockFromBytes(sb)
+	return m, m.PageSize == uint32(len(buff))
+}
+
+// Finds the newest whole copy of the meta page and makes sure it is page 0.
+// Returns the format the file is in, 0 for a new file
+func (d *Database) findMeta() (uint32, error) {
+	buff := make([]byte, pages.MAX_PAGE_SIZE)
+	n, err := d.Store.ReadAt(buff, 0)
+	// a block of page 0 that wont decrypt ends the read, the copy may be whole
+	sealed := errors.Is(err, prims.ErrAuth)
+	if err != nil && !sealed { return 0, err }
+	clear(buff[n:])
+
+	// a torn page 0 still tells where its copy is if the superblock made it
+	size, whole := 0, false
+	for s := int(pages.MIN_PAGE_SIZE); s <= int(pages.MAX_PAGE_SIZE); s *= 2 {
+		sb, ok := superblockOf(buff[:s])
+		if !ok || SuperblockFromBytes(sb).PageSize != uint32(s) { continue }
+		d.Superblock = SuperblockFromBytes(sb)
+		size = s
+		whole = pages.VerifyChecksum(0, buff[:s]) == nil
+		break
+	}
+	if size == 0 && !sealed && pages.VerifyChecksum(0, buff[:pages.MIN_PAGE_SIZE]) == nil {
+		// new files are all zeroes and get the size they were opened with
+		if err := d.priorFormat(); err != nil { return 0, err }
+		d.Superblock = Superblock{ PageSize: uint32(d.Options.PageSize) }
+		if d.PageSize == 0 { d.PageSize = uint32(pages.DEFAULT_PAGE_SIZE) }
+		return 0, nil
+	}
+
+	// the copy is on page 1 unless the file was upgraded
+	var mbuff []byte
+	var m Superblock
+	mok := false
+	if size != 0 && d.Mirror != 1 {
+		mbuff = make([]byte, size)
+		m, mok = readMirror(d.Store, d.Mirror, mbuff)
+	}
+	for s := int(pages.MIN_PAGE_SIZE); s <= int(pages.MAX_PAGE_SIZE) && !mok; s *= 2 {
+		mbuff = make([]byte, s)
+		m, mok = readMirror(d.Store, 1, mbuff)
+	}
+
+	switch {
+		case mok && (!whole || m.Generation > d.Generation):
+			// put the copy back before anything reads page 0
+			if d.Options.ReadOnly { return 0, logger.ErrNeedsRecovery }
+			d.Superblock = m
+			binary.LittleEndian.PutUint64(mbuff[pages.PAGEID_OFF:], 0)
+			pages.SetChecksum(mbuff)
+			if _, err := d.Store.WriteAt(mbuff, 0); err != nil { return 0, err }
+			if err := d.Store.Sync(); err != nil { return 0, err }
+		case !whole && size == 0 && sealed:
+			return 0, err
+		case !whole && size == 0:
+			return 0, ErrNotDatabase
+		case !whole:
+			return 0, &pages.CorruptPageError{ Id: 0, Type: pages.META_PAGE }
+	}
+	return d.Version, d.Superblock.check()
+}
+
+// A file without a superblock is new only if it is all zeroes, the first
+// page that isnt tells what it is. Files from before the superblock have 4K
+// pages, the baseline ones never wrote page 0 and start every other page
+// with its type and a 4 byte id, no checksum. The ones after checksum
+// their pages but never set the type of page 0
+func (d *Database) priorFormat() error {
+	size, err := d.Store.Size()
+	if err != nil { return err }
+	buff := make([]byte, pages.MIN_PAGE_SIZE)
+	for id := int64(0); id * int64(len(buff)) < size; id++ {
+		n, err := d.Store.ReadAt(buff, id * int64(len(buff)))
+		if err != nil && !errors.Is(err, io.EOF) { return err }
+		clear(buff[n:])
+		if bytes.Count(buff, []byte{0}) == len(buff) { continue }
+		baseline := id != 0 && binary.LittleEndian.Uint32(buff[pages.PAGEID_OFF:]) == uint32(id) &&
+			pages.VerifyChecksum(uint64(id), buff) != nil
+		checksummed := id == 0 && pages.VerifyChecksum(0, buff) == nil &&
+			pages.PageType(buff[pages.PAGETYPE_OFF]) == pages.NONE_PAGE
+		if baseline || checksummed { return fmt.Errorf("%w: %s", ErrOldFormat, d.FilePath) }
+		return ErrNotDatabase
+	}
+	return nil
+}
+
+// Brings a file up to FORMAT_VERSION in place, runs once the header
+// and free list are loaded and before the tables start
+func (d *Database) upgrade(from uint32) error {
+	switch from {
+		case 0:
+			// a new file, the superblock takes the end of the meta page
+			mirror, err := d.claimMirror()
+			if err != nil { return err }
+			d.Superblock = Superblock{ Version: 1, PageSize: d.PageSize, Mirror: mirror }
+		case 1:
+			// the pages stay as they are, the log goes on with wide cards
+			// after the narrow ones and recovery reads both. Builds that
+			// only know format 1 would take a wide card for a torn end
+	}
+	d.Version = FORMAT_VERSION
+	return d.WriteMeta()
+}
+
+// The copy goes past the end of the file, so it can never be a page in use.
+// What the header had not handed out yet goes on the free list instead
+func (d *Database) claimMirror() (uint64, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for id := d.Total + 1; id < d.Max; id++ { d.push(id) }
+	mirror := d.Max
+	d.Total = mirror
+	if err := d.AllocateNewPages(); err != nil { return 0, err }
+
+	// the rest of the header waits for a checkpoint, the page count cant
+	body := d.metaPage.Body
+	binary.LittleEndian.PutUint64(body[TOTAL_PAGES_OFF:], d.Total)
+	binary.LittleEndian.PutUint64(body[MAX_PAGES_OFF:], d.Max)
+	return mirror, nil
+}
+
+// The meta page goes out twice, page 0 then its copy, each synced
+// before the next so a torn write always leaves one whole copy
+func (d *Database) WriteMeta() error {
+	d.lock.Lock()
+	d.Generation++
+	body := d.metaPage.Body
+	d.Superblock.ToBytes(body[len(body) - SUPERBLOCK_SIZE:])
+	d.lock.Unlock()
+
+	d.metaPage.PageType = uint8(pages.META_PAGE)
+	buff := d.metaPage.ToBytes()
+	if err := d.metaPage.Flush(buff); err != nil { return err }
+	if err := d.Store.Sync(); err != nil { return err }
+
+	mirror := make([]byte, len(buff))
+	copy(mirror, buff)
+	binary.LittleEndian.PutUint64(mirror[pages.PAGEID_OFF:], d.Mirror)
+	pages.SetChecksum(mirror)
+	if _, err := d.Store.WriteAt(mirror, int64(d.Mirror) * int64(len(buff))); err != nil { return err }
+	return d.Store.Sync()
+}
+
+// Sets the FEATURE_COMPRESSED flag on disk if it isnt there yet.
+// The meta page in memory can hold changes the log hasnt got, so only
+// the superblock of each copy on disk is patched. The next WriteMeta
+// writes the flag with the rest
+func (d *Database) MarkCompressed() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.Features & FEATURE_COMPRESSED != 0 { return nil }
+	s := d.Superblock
+	s.Features |= FEATURE_COMPRESSED
+	s.Generation++
+	buff := make([]byte, d.PageSize)
+	for _, id := range []uint64{ 0, d.Mirror } {
+		if err := pages.ReadPage(d.Store, id, buff); err != nil { return err }
+		s.ToBytes(buff[len(buff) - SUPERBLOCK_SIZE:])
+		if err := pages.WritePage(d.Store, id, buff); err != nil { return err }
+		if err := d.Store.Sync(); err != nil { return err }
+	}
+	d.Superblock = s
+	return nil
+}
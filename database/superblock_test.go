@@ -0,0 +1,67 @@
+package database
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+	"mydb/core/pages"
+	"mydb/core/prims"
+)
+
+func Test_SuperblockBytes(t *testing.T) {
+	page := make([]byte, pages.DEFAULT_PAGE_SIZE)
+	if _, ok := superblockOf(page); ok { t.Fatalf("Zeroes read as a superblock") }
+
+	s := Superblock{ Version: FORMAT_VERSION, PageSize: uint32(len(page)), Mirror: 1 << 40, Generation: 1 << 50 }
+	s.ToBytes(page[len(page) - SUPERBLOCK_SIZE:])
+	sb, ok := superblockOf(page)
+	if !ok { t.Fatalf("Superblock lost its magic") }
+	if got := SuperblockFromBytes(sb); got != s { t.Fatalf("Superblock %+v read back as %+v", s, got) }
+	if err := s.check(); err != nil { t.Fatalf("Refused a superblock this build wrote: %v", err) }
+
+	// what a newer build may write is refused, as is a size none writes
+	for _, bad := range []Superblock{
+		{ Version: FORMAT_VERSION + 1, PageSize: s.PageSize },
+		{ Version: FORMAT_VERSION, PageSize: s.PageSize, Features: KNOWN_FEATURES + 1 },
+	} {
+		if err := bad.check(); !errors.Is(err, ErrNewerFormat) { t.Fatalf("Superblock %+v passed, err %v", bad, err) }
+	}
+	if err := (&Superblock{ Version: FORMAT_VERSION, PageSize: 1000 }).check(); err == nil { t.Fatalf("Page size 1000 passed") }
+}
+
+// Files without a superblock, told apart by their first page that isnt zeroes
+func Test_PriorFormat(t *testing.T) {
+	size := int(pages.MIN_PAGE_SIZE)
+	baseline := make([]byte, size)
+	baseline[pages.PAGETYPE_OFF] = byte(pages.IDX_LEAF)
+	binary.LittleEndian.PutUint32(baseline[pages.PAGEID_OFF:], 2)
+	checksummed := make([]byte, size)
+	checksummed[size - 1] = 1
+	pages.SetChecksum(checksummed)
+	foreign := make([]byte, size)
+	copy(foreign, "not a database")
+
+	for _, c := range []struct {
+		name string
+		id int
+		page []byte
+		want error
+	}{
+		{ "new", 0, nil, nil },
+		{ "baseline", 2, baseline, ErrOldFormat },
+		{ "checksummed", 0, checksummed, ErrOldFormat },
+		{ "foreign", 1, foreign, ErrNotDatabase },
+	} {
+		st, err := prims.NewMemVolume().Open(c.name, os.O_RDWR | os.O_CREATE)
+		if err != nil { t.Fatalf("Failed to open %s: %v", c.name, err) }
+		if err := st.Truncate(int64(4 * size)); err != nil { t.Fatalf("Failed to size %s: %v", c.name, err) }
+		if c.page != nil {
+			if _, err := st.WriteAt(c.page, int64(c.id * size)); err != nil { t.Fatalf("Failed to write %s: %v", c.name, err) }
+		}
+		d := &Database{ Store: st, FilePath: c.name }
+		if err := d.priorFormat(); !errors.Is(err, c.want) {
+			t.Fatalf("%s file came out as %v, not %v", c.name, err, c.want)
+		}
+	}
+}
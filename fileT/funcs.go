@@ -5,13 +5,12 @@ import (
 	"errors"
 	"mydb/core/indexes"
 	"mydb/core/pages"
-	"mydb/core/types"
 	"mydb/utils"
 	"os"
 )
 
 const (
-	BASE_PATH = "/var/lib/socialz/"
+	BASE_PATH = "/var/lib/socialz/" // default, see Options.BasePath
 )
 
 type GetFileMsg struct {
@@ -69,7 +68,7 @@ func (t *FileTable) GetFile(m *GetFileMsg, outPut chan any) {
 	go func() {
 		defer close(blobc)
 		// initialize variables
-		file, err := os.Open(BASE_PATH + m.Uid + "/" + out.Header.Id)
+		file, err := os.Open(t.Options.BasePath + m.Uid + "/" + out.Header.Id)
 		if err != nil { 
 			if errors.Is(err, os.ErrNotExist) {
 			}
@@ -127,18 +126,19 @@ func (t *FileTable)InsertFile(m *InsertFileMsg, outPut chan any) {
 	row.Blob = 0
 	row.Padding = [3]byte{}
 
-	//	check if the file already exists
-	q := NewFIDQuery(t.Index, key)
-	offsets, err := q.GetEntries(false, true)
-	if !errors.Is(err, indexes.EntryNotFoundError) || len(offsets) > 0 {
+	// every page touched from here on is logged at commit
+	trxId, err := t.BeginTxn()
+	if err != nil { 
 		out.Error = err
 		outPut <- out
 		return
 	}
 
-	trxId, err := utils.RandomInt32()
-	if err != nil { 
-		out.Error = err
+	//	check if the file already exists
+	q := NewFIDQuery(t.Index, key)
+	offsets, err := q.GetEntries(false, true)
+	if !errors.Is(err, indexes.EntryNotFoundError) || len(offsets) > 0 {
+		out.Error = t.cancel(trxId, err)
 		outPut <- out
 		return
 	}
@@ -146,7 +146,7 @@ func (t *FileTable)InsertFile(m *InsertFileMsg, outPut chan any) {
 	// Claim space in table and set to row
 	pid, err := t.FSM.GetFixedSpace(uint16(FILE_ROW_SIZE), pages.FILE_FIXED, trxId)
 	if err != nil { 
-		out.Error = err
+		out.Error = t.cancel(trxId, err)
 		outPut <- out
 		return
 	}
@@ -154,41 +154,39 @@ func (t *FileTable)InsertFile(m *InsertFileMsg, outPut chan any) {
 
 	page, err := t.GetPage(pid)
 	if err != nil {
-		out.Error = err
+		out.Error = t.cancel(trxId, err)
 		outPut <- out
 		return
 	}
 	p := page.(*pages.Page)
 	p.Lock()
 	defer p.Unlock()
-	//
-	// initialize actions and vals for logger/engine
-	axs := make([]*types.Action, 1)
-	vals := make([]*[]byte, 1)
-	// Create the WAL action for the row
-	axs[0] = types.InsertAx(types.NLBlob, pid.Pack(), FILE_ROW_SIZE)
-	// Marshal the row
+
+	// Marshal the row, the bytes get logged when the txn commits
 	rowBytes := row.ToBytes()
-	vals[0] = &rowBytes
 	t.PutRow(row)
+	copy(p.GetFixRow(pid), rowBytes)
 
-	// ALl are pending
-	p.Lsn, out.Error = t.Logger.NewTxn(&axs, &vals, trxId) 
+	out.Error = NewFileEntry(t.Index, rowBytes, trxId)
 	if out.Error != nil { 
+		out.Error = t.cancel(trxId, out.Error)
 		outPut <- out
 		return
 	}
+	t.CommitTxn(trxId, reply(out, outPut))
+}
 
-	copy(p.GetFixRow(pid), rowBytes)
-
-	out.Error = NewFileEntry(t.Index, rowBytes, trxId)
-	if out.Error != nil { 
+// Answers once the commit is durable, Run goes on in the meantime
+func reply(out *InsertFileOut, outPut chan any) func(error) {
+	return func(err error) {
+		out.Error = err
 		outPut <- out
-		return
 	}
-	t.Logger.CommitTxn(trxId)
+}
 
-	outPut <- out
+// Cancels trxId after err, a cancel that fails is reported along with it
+func (t *FileTable) cancel(trxId uint64, err error) error {
+	return errors.Join(err, t.CancelTxn(trxId))
 }
 
 func (t *FileTable)DeleteFile(m *GetFileMsg, outPut chan any) {
@@ -205,10 +203,17 @@ func (t *FileTable)DeleteFile(m *GetFileMsg, outPut chan any) {
 	m.Hash[16] = indexes.IS_CLEAN
 	key := append(uidBytes, m.Hash[:17]...)
 
+	trxId, err := t.BeginTxn()
+	if err != nil { 
+		out.Error = err
+		outPut <- out
+		return
+	}
+
 	q := NewFIDQuery(t.Index, key)
 	rawPids, err := q.GetEntries(false,true)
 	if err != nil { 
-		out.Error = err
+		out.Error = t.cancel(trxId, err)
 		outPut <- out
 		return
 	}
@@ -216,7 +221,7 @@ func (t *FileTable)DeleteFile(m *GetFileMsg, outPut chan any) {
 	pid := pages.NewPageId(rawPids[0])
 	pl, err := t.GetPage(pid)
 	if err != nil {
-		out.Error = err
+		out.Error = t.cancel(trxId, err)
 		outPut <- out
 		return
 	}
@@ -232,36 +237,18 @@ func (t *FileTable)DeleteFile(m *GetFileMsg, outPut chan any) {
 	rowBytes := p.GetFixRow(pid)
 	row.FromBytes(rowBytes)
 
-	axs, vals := make([]*types.Action, 1), make([]*[]byte, 1)
-	axs[0] = types.DeleteAx(types.NLBlob, pid.Pack(), FILE_ROW_SIZE)
-	vals[0] = &rowBytes
-
-	trxId, err := utils.RandomInt32()
-	if err != nil { 
-		out.Error = err
-		outPut <- out
-		return
-	}
-
-	p.Lsn, out.Error = t.Logger.NewTxn(&axs, &vals, trxId)
-	if out.Error != nil {
-		outPut <- out
-		return
-	}
-
 	// just decriment count and return
 	refCount := row.GetColumn("Ref_Count").(int32)
 	if refCount > 1 {
 		row.SetColumn("Ref_Count", refCount-1) 
-		t.Logger.CommitTxn(trxId)
-		outPut<-out
+		t.CommitTxn(trxId, reply(out, outPut))
 		return
 	}
 
 	// free up the row
 	out.Error = t.GetFSM().PutFixedSpace(FILE_ROW_SIZE, pid, trxId)
 	if out.Error != nil {
-		t.Logger.CancelTxn(trxId)
+		out.Error = t.cancel(trxId, out.Error)
 		outPut <- out
 		return
 	}
@@ -269,12 +256,10 @@ func (t *FileTable)DeleteFile(m *GetFileMsg, outPut chan any) {
 	// Log deleting the index entries
 	out.Error = DeleteFileEntry(t.Index, row.ToBytes(), trxId)
 	if out.Error != nil {
-		t.Logger.CancelTxn(trxId)
+		out.Error = t.cancel(trxId, out.Error)
 		outPut <- out
 		return
 	}
 
-	t.Logger.CommitTxn(trxId)
-	outPut<-out
+	t.CommitTxn(trxId, reply(out, outPut))
 }
-
@@ -94,7 +94,7 @@ func deriveEntryAndKey(row []byte, schema pages.PageType) ([]byte, []byte) {
 
 func NewFTypeQuery(
 	i *indexes.Idx, key []byte, 
-	limit int, trxId ...int32,
+	limit int, trxId ...uint64,
 ) *indexes.IdxQuery {
 
 	if len(trxId) == 0 { trxId = append(trxId, 0) }
@@ -107,7 +107,7 @@ func NewFTypeQuery(
 
 func NewFTimeQuery(
 	i *indexes.Idx, key []byte, 
-	limit int, trxId ...int32,
+	limit int, trxId ...uint64,
 ) *indexes.IdxQuery {
 
 	if len(trxId) == 0 { trxId = append(trxId, 0) }
@@ -118,7 +118,7 @@ func NewFTimeQuery(
 	)
 }
 func NewFIDQuery(
-	i *indexes.Idx, key []byte, trxId ...int32,
+	i *indexes.Idx, key []byte, trxId ...uint64,
 ) *indexes.IdxQuery {
 	if len(trxId) == 0 { trxId = append(trxId, 0) }
 	return indexes.NewIdxQuery( 
@@ -128,7 +128,7 @@ func NewFIDQuery(
 	)
 }
 
-func NewFileEntry(i *indexes.Idx,row []byte, trxId int32) (error) {
+func NewFileEntry(i *indexes.Idx,row []byte, trxId uint64) (error) {
 	var key []byte
 	var entry []byte
 
@@ -149,7 +149,7 @@ func NewFileEntry(i *indexes.Idx,row []byte, trxId int32) (error) {
 	return err
 }
 
-func DeleteFileEntry(i *indexes.Idx, row []byte, trxId int32) (error) {
+func DeleteFileEntry(i *indexes.Idx, row []byte, trxId uint64) (error) {
 	var key []byte
 
 	q := NewFTypeQuery(i, key, 1, trxId)
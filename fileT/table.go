@@ -32,13 +32,34 @@ func (t *FileTable) SetIndexAndColumns(metaPage *pages.Page) {
 }
 
 func (t *FileTable) Run(in chan *types.DbMessage) {
-	MAIN: for msg := range in {
+	MAIN: for {
+		var msg *types.DbMessage
+		// a checkpoint under way is written out while nothing is waiting
+		select {
+		case msg = <-in:
+		default:
+			if t.CheckpointStep() { continue }
+			msg = <-in
+		}
+		if msg == nil { break }
 		switch msg.Code {
 		case types.GET_FILE: t.GetFile(msg.Msg.(*GetFileMsg), msg.Output)
 		case types.INSERT_FILE: t.InsertFile(msg.Msg.(*InsertFileMsg), msg.Output)
 		case types.DELETE_FILE: t.DeleteFile(msg.Msg.(*GetFileMsg), msg.Output)
-		// case types.RECOVERY: execution.ExecuteAction(t.GetLogger(), msg.Msg.(*types.Action))
-		case types.TERMINATE: break MAIN
+		case types.RECOVERY: t.Recover(msg.Msg.(*[]*types.Action), msg.Output)
+		case types.ROLLBACK: t.Rollback(msg.Msg.(uint64), msg.Output)
+		case types.RUN_CHECKPOINT: msg.Output <- t.Checkpoint()
+		case types.BEGIN_CHECKPOINT:
+			t.BeginCheckpoint()
+			msg.Output <- nil
+		case types.START_BACKUP: t.StartBackup(msg.Output)
+		case types.LOG_END: t.LogEnd(msg.Msg.(uint64), msg.Output)
+		case types.END_BACKUP: t.EndBackup(msg.Msg.(uint64), msg.Output)
+		case types.TERMINATE:
+			msg.Output <- t.Close()
+			break MAIN
 		}
+		// the log isnt caught up with until recovery is done
+		if msg.Code != types.RECOVERY && msg.Code != types.ROLLBACK { t.CheckpointIfLong() }
 	}
 }
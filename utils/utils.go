@@ -1,18 +1,25 @@
 package utils
 
-import (
-	"crypto/rand"
-	"encoding/binary"
-	"errors"
-)
-
 const BUFFER_SIZE = 1024
 
-func RandomInt32() (int32, error) {
-	buf := make([]byte, 4)
-	n, err := rand.Read(buf)
-	if n != 4 {
-		return 0, errors.New("Rand Read ZERO")
+// Returns the [start, end) ranges where before and after differ.
+// Ranges closer than gap bytes are merged into one.
+func DiffRanges(before, after []byte, gap int) [][2]int {
+	ranges := make([][2]int, 0, 4)
+	n := min(len(before), len(after))
+	for i := 0; i < n; i++ {
+		if before[i] == after[i] { continue }
+		start := i
+		end := i + 1
+		for j := end; j < n && j < end + gap; j++ {
+			if before[j] != after[j] { end = j + 1 }
+		}
+		if len(ranges) > 0 && start - ranges[len(ranges)-1][1] < gap {
+			ranges[len(ranges)-1][1] = end
+		} else {
+			ranges = append(ranges, [2]int{start, end})
+		}
+		i = end - 1
 	}
-	return int32(binary.LittleEndian.Uint32(buf)), err
+	return ranges
 }